@@ -0,0 +1,98 @@
+// Package main provides adaptive downloads for the speed test server.
+// This file contains the /download/adaptive endpoint, which picks each
+// download size from the throughput of the session's previous download.
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// adaptiveInitialBytes is the size of a session's first adaptive
+	// download, unless -max-download-bytes is smaller
+	adaptiveInitialBytes = 1024 * 1024
+	// adaptiveMaxGrowth bounds how many times larger each download can be
+	// than the previous one
+	adaptiveMaxGrowth = 4
+	// adaptiveMaxSteps is the number of times the size is re-picked before
+	// it is held for the rest of the session
+	adaptiveMaxSteps = 8
+	// adaptiveTargetDuration is the download time the size converges on
+	adaptiveTargetDuration = 5 * time.Second
+)
+
+// adaptiveState tracks the escalation of a session's adaptive downloads.
+type adaptiveState struct {
+	// size is the payload size of the next download, or 0 before the first
+	size int
+	// steps counts the sizes picked from observed throughput so far
+	steps int
+}
+
+// nextAdaptiveSize returns the size that would take adaptiveTargetDuration
+// at the observed throughput, growing at most adaptiveMaxGrowth times over
+// the current size and staying within adaptiveInitialBytes and
+// -max-download-bytes.
+func nextAdaptiveSize(current int, observed transferStats) int {
+	limit := min(current*adaptiveMaxGrowth, activeConfig.MaxDownloadBytes)
+	if observed.Duration <= 0 {
+		return limit
+	}
+	bytesPerSecond := float64(observed.Bytes) / observed.Duration.Seconds()
+	next := int(bytesPerSecond * adaptiveTargetDuration.Seconds())
+	return max(min(adaptiveInitialBytes, limit), min(next, limit))
+}
+
+// adaptiveSize returns the size of the session's next adaptive download
+// and the number of escalation steps taken so far.
+func (s *sessionStore) adaptiveSize(id string) (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.touch(id).adaptive
+	if state.size == 0 {
+		return min(adaptiveInitialBytes, activeConfig.MaxDownloadBytes), 0
+	}
+	return min(state.size, activeConfig.MaxDownloadBytes), state.steps
+}
+
+// adapt picks the session's next adaptive download size from the
+// throughput observed downloading size bytes. Once adaptiveMaxSteps sizes
+// have been picked, the size is held.
+func (s *sessionStore) adapt(id string, size int, observed transferStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := &s.touch(id).adaptive
+	if state.steps >= adaptiveMaxSteps {
+		return
+	}
+	state.size = nextAdaptiveSize(size, observed)
+	state.steps++
+}
+
+// adaptiveDownloadHandler serves a download sized from the session's
+// previous adaptive download, so successive calls converge on a size that
+// takes about adaptiveTargetDuration without any client-side escalation.
+// X-Adaptive-Step reports how many times the size has been re-picked.
+func adaptiveDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := requestSession(r)
+	if !ok {
+		http.Error(w, "Adaptive downloads require a valid ?session= ID", http.StatusBadRequest)
+		return
+	}
+
+	size, steps := sessions.adaptiveSize(id)
+	w.Header().Set("X-Adaptive-Step", strconv.Itoa(steps))
+
+	if observed, ok := sendDownload(w, r, size, 0); ok {
+		sessions.adapt(id, size, observed)
+	}
+}
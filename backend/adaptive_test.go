@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveSizeEscalatesThenStabilizes(t *testing.T) {
+	store := newSessionStore(time.Minute)
+
+	// Throughput ramps up as the connection warms, then levels off
+	const mb = 1024 * 1024
+	rates := []float64{1 * mb, 2 * mb, 4 * mb, 8 * mb, 8 * mb, 8 * mb, 8 * mb}
+
+	var sizes []int
+	for _, rate := range rates {
+		size, _ := store.adaptiveSize("ramp")
+		sizes = append(sizes, size)
+		elapsed := time.Duration(float64(size) / rate * float64(time.Second))
+		store.adapt("ramp", size, transferStats{Bytes: int64(size), Duration: elapsed})
+	}
+
+	for i := 1; i <= 4; i++ {
+		if sizes[i] <= sizes[i-1] {
+			t.Errorf("expected size to escalate at step %d, got %v", i, sizes)
+		}
+	}
+	for i := 5; i < len(sizes); i++ {
+		if sizes[i] != sizes[4] {
+			t.Errorf("expected size to stabilize after step 4, got %v", sizes)
+		}
+	}
+	if target := int(8 * mb * adaptiveTargetDuration.Seconds()); sizes[len(sizes)-1] != target {
+		t.Errorf("expected size to converge on %d, got %d", target, sizes[len(sizes)-1])
+	}
+}
+
+func TestAdaptiveSizeBounds(t *testing.T) {
+	store := newSessionStore(time.Minute)
+
+	// An effectively infinite rate escalates as fast as allowed
+	for i := 0; i < adaptiveMaxSteps+3; i++ {
+		size, _ := store.adaptiveSize("fast")
+		if i > 0 && size > activeConfig.MaxDownloadBytes {
+			t.Fatalf("size %d exceeds the cap %d", size, activeConfig.MaxDownloadBytes)
+		}
+		store.adapt("fast", size, transferStats{Bytes: int64(size), Duration: time.Nanosecond})
+	}
+	size, steps := store.adaptiveSize("fast")
+	if size != activeConfig.MaxDownloadBytes {
+		t.Errorf("expected size to reach the cap %d, got %d", activeConfig.MaxDownloadBytes, size)
+	}
+	if steps != adaptiveMaxSteps {
+		t.Errorf("expected escalation to stop after %d steps, got %d", adaptiveMaxSteps, steps)
+	}
+
+	// A very slow first download never drops below the initial size
+	size, _ = store.adaptiveSize("slow")
+	store.adapt("slow", size, transferStats{Bytes: int64(size), Duration: time.Hour})
+	if size, _ = store.adaptiveSize("slow"); size != adaptiveInitialBytes {
+		t.Errorf("expected size %d for a slow link, got %d", adaptiveInitialBytes, size)
+	}
+}
+
+func TestAdaptiveSizeMaxDownloadBytes(t *testing.T) {
+	for _, limit := range []int{4 * 1024 * 1024, 512 * 1024} {
+		t.Run(strconv.Itoa(limit), func(t *testing.T) {
+			useConfig(t, func(cfg *Config) { cfg.MaxDownloadBytes = limit })
+			store := newSessionStore(time.Minute)
+
+			// Neither the first size nor any escalation may pass the cap
+			for i := 0; i <= adaptiveMaxSteps; i++ {
+				size, _ := store.adaptiveSize("capped")
+				if size > limit {
+					t.Fatalf("step %d: size %d exceeds -max-download-bytes %d", i, size, limit)
+				}
+				store.adapt("capped", size, transferStats{Bytes: int64(size), Duration: time.Nanosecond})
+			}
+			if size, _ := store.adaptiveSize("capped"); size != limit {
+				t.Errorf("expected size to reach the cap %d, got %d", limit, size)
+			}
+		})
+	}
+}
+
+func TestAdaptiveDownloadHandler(t *testing.T) {
+	useSessions(t)
+
+	w := httptest.NewRecorder()
+	adaptiveDownloadHandler(w, httptest.NewRequest("GET", "/download/adaptive", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d without a session, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	var lengths []int
+	for step := 0; step < 2; step++ {
+		w := httptest.NewRecorder()
+		adaptiveDownloadHandler(w, httptest.NewRequest("GET", "/download/adaptive?session=abc", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		if got := w.Header().Get("X-Adaptive-Step"); got != strconv.Itoa(step) {
+			t.Errorf("expected X-Adaptive-Step %d, got %q", step, got)
+		}
+		lengths = append(lengths, w.Body.Len())
+	}
+
+	if lengths[0] != adaptiveInitialBytes {
+		t.Errorf("expected first download of %d bytes, got %d", adaptiveInitialBytes, lengths[0])
+	}
+	if lengths[1] <= lengths[0] {
+		t.Errorf("expected second download to be larger, got %v", lengths)
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
 	"net/http/httptest"
-	"strings"
+	"slices"
+	"sync/atomic"
 	"testing"
 )
 
 func BenchmarkPingHandler(b *testing.B) {
 	req := httptest.NewRequest("GET", "/ping", nil)
-	
+
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		w := httptest.NewRecorder()
@@ -18,7 +24,19 @@ func BenchmarkPingHandler(b *testing.B) {
 
 func BenchmarkDownloadHandler(b *testing.B) {
 	req := httptest.NewRequest("GET", "/download", nil)
-	
+	b.SetBytes(downloadSize)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		downloadHandler(w, req)
+	}
+}
+
+func BenchmarkDownloadHandlerZeroFill(b *testing.B) {
+	req := httptest.NewRequest("GET", "/download?fill=zero", nil)
+	b.SetBytes(downloadSize)
+
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		w := httptest.NewRecorder()
@@ -27,25 +45,86 @@ func BenchmarkDownloadHandler(b *testing.B) {
 }
 
 func BenchmarkUploadHandler(b *testing.B) {
-	data := strings.NewReader(strings.Repeat("a", 1024*1024)) // 1MB of data
-	
+	payload := bytes.Repeat([]byte("a"), 1024*1024) // 1MB of data
+	data := bytes.NewReader(payload)
+	b.SetBytes(int64(len(payload)))
+
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
+		// Rewind the reader, otherwise every iteration after the first
+		// uploads an empty body
+		data.Seek(0, io.SeekStart)
 		req := httptest.NewRequest("POST", "/upload", data)
 		w := httptest.NewRecorder()
 		b.StartTimer()
-		
+
 		uploadHandler(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
 	}
 }
 
 func BenchmarkRateLimiter(b *testing.B) {
-	limiter := newRateLimiter()
-	
+	limiter := newRateLimiter(defaultRateLimit, defaultRateWindow)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			limiter.isAllowed("test-ip")
+		}
+	})
+}
+
+// BenchmarkTokenBucketLimiter is BenchmarkRateLimiter for the token
+// bucket, whose per-client state doesn't grow with the request rate.
+func BenchmarkTokenBucketLimiter(b *testing.B) {
+	limiter := newTokenBucketLimiter(defaultRateLimit, defaultRateWindow, defaultRateLimit)
+	b.ReportAllocs()
+
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
 			limiter.isAllowed("test-ip")
 		}
 	})
 }
+
+// BenchmarkRateLimiterAlgorithms runs every selectable rate-limiting
+// algorithm under the same parallel single-client workload as
+// BenchmarkRateLimiter.
+func BenchmarkRateLimiterAlgorithms(b *testing.B) {
+	for _, name := range slices.Sorted(maps.Keys(rateLimitAlgorithms)) {
+		b.Run(name, func(b *testing.B) {
+			limiter := rateLimitAlgorithms[name](defaultRateLimit, defaultRateWindow, 0)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					limiter.isAllowed("test-ip")
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkRateLimiterManyIPs shows how each algorithm scales with the
+// number of distinct clients tracked in its map.
+func BenchmarkRateLimiterManyIPs(b *testing.B) {
+	const clients = 100_000
+	ips := make([]string, clients)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(rateLimitAlgorithms)) {
+		b.Run(name, func(b *testing.B) {
+			limiter := rateLimitAlgorithms[name](defaultRateLimit, defaultRateWindow, 0)
+			var next atomic.Int64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					limiter.isAllowed(ips[next.Add(1)%clients])
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Package main provides bandwidth budgeting for the speed test server.
+// This file contains the server-wide daily download cap.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dailyBudget counts the bytes served by downloads each UTC day against a
+// server-wide cap. The count is held in memory and resets on restart.
+type dailyBudget struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	resetAt time.Time
+}
+
+func newDailyBudget(limit int64) *dailyBudget {
+	return &dailyBudget{
+		limit:   limit,
+		resetAt: nextUTCMidnight(clock()),
+	}
+}
+
+func nextUTCMidnight(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// roll starts a new day's count once the reset time has passed.
+// Callers must hold b.mu.
+func (b *dailyBudget) roll(now time.Time) {
+	if !now.Before(b.resetAt) {
+		b.used = 0
+		b.resetAt = nextUTCMidnight(now)
+	}
+}
+
+// exhausted reports whether today's cap has been reached, and if so how
+// long until it resets.
+func (b *dailyBudget) exhausted() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := clock()
+	b.roll(now)
+	if b.used < b.limit {
+		return 0, false
+	}
+	return b.resetAt.Sub(now), true
+}
+
+func (b *dailyBudget) add(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll(clock())
+	b.used += int64(n)
+}
+
+// withDailyCap refuses downloads with 503 Service Unavailable once the
+// daily budget is spent, and counts the bytes of accepted downloads
+// against it.
+func withDailyCap(budget *dailyBudget, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if wait, spent := budget.exhausted(); spent {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+			w.Header().Set(rejectedByHeader, "daily-cap")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Error:      "Daily download bandwidth cap reached",
+				RetryAfter: retryAfter,
+			})
+			return
+		}
+
+		handler(&meteredWriter{ResponseWriter: w, count: budget.add}, r)
+	}
+}
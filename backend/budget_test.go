@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDailyCapRefusesDownloadsOnceSpent(t *testing.T) {
+	budget := newDailyBudget(downloadSize + 1)
+	handler := withDailyCap(budget, downloadHandler)
+
+	// The first download fits under the cap, the second pushes past it
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/download", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("download %d: expected status %d, got %d", i+1, http.StatusOK, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/download", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d once cap is spent, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retryAfter <= 0 || retryAfter > 24*60*60 {
+		t.Errorf("expected Retry-After until the next day, got %q", w.Header().Get("Retry-After"))
+	}
+
+	// Rolling over to the next day restores the budget
+	budget.resetAt = time.Now().Add(-time.Second)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/download", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d after day rollover, got %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,47 @@
+// Package main provides download buffer reuse for the speed test server.
+// This file contains a buffer pool that bounds the memory it retains.
+package main
+
+// defaultBufferPoolSize is the number of idle download buffers kept for reuse
+const defaultBufferPoolSize = 64
+
+// bufferPool recycles download buffers. Unlike sync.Pool, it retains at
+// most a fixed number of idle buffers, so a traffic spike cannot leave it
+// holding an unbounded amount of memory; buffers beyond the cap are
+// allocated per request and left to the garbage collector.
+type bufferPool struct {
+	idle chan []byte
+}
+
+func newBufferPool(maxIdle int) *bufferPool {
+	return &bufferPool{idle: make(chan []byte, maxIdle)}
+}
+
+// downloadBuffers is the process-wide pool used by the download handlers.
+var downloadBuffers = newBufferPool(defaultBufferPoolSize)
+
+// get returns a buffer of length size, reusing an idle one if it is large
+// enough.
+func (p *bufferPool) get(size int) []byte {
+	select {
+	case b := <-p.idle:
+		if cap(b) >= size {
+			return b[:size]
+		}
+	default:
+	}
+	return make([]byte, size)
+}
+
+// put returns a buffer to the pool, dropping it if the pool is full.
+func (p *bufferPool) put(b []byte) {
+	select {
+	case p.idle <- b:
+	default:
+	}
+}
+
+// retained returns the number of idle buffers held by the pool.
+func (p *bufferPool) retained() int {
+	return len(p.idle)
+}
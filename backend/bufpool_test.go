@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestBufferPoolBoundsRetained(t *testing.T) {
+	const maxIdle = 8
+	pool := newBufferPool(maxIdle)
+
+	// Far more concurrent users than the pool retains
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				b := pool.get(defaultChunkSize)
+				if len(b) != defaultChunkSize {
+					t.Errorf("expected a %d-byte buffer, got %d", defaultChunkSize, len(b))
+					return
+				}
+				pool.put(b)
+				if n := pool.retained(); n > maxIdle {
+					t.Errorf("pool retained %d buffers, cap is %d", n, maxIdle)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := pool.retained(); n > maxIdle {
+		t.Errorf("pool retained %d buffers after the spike, cap is %d", n, maxIdle)
+	}
+}
+
+func TestBufferPoolReuse(t *testing.T) {
+	pool := newBufferPool(1)
+
+	b := pool.get(4096)
+	pool.put(b)
+	if reused := pool.get(1024); &reused[0] != &b[0] {
+		t.Error("expected a large idle buffer to be reused for a smaller request")
+	}
+
+	pool.put(make([]byte, 1024))
+	if got := pool.get(4096); len(got) != 4096 {
+		t.Errorf("expected a fresh 4096-byte buffer when the idle one is too small, got %d", len(got))
+	}
+
+	// A zero-size pool retains nothing
+	empty := newBufferPool(0)
+	empty.put(make([]byte, 1024))
+	if n := empty.retained(); n != 0 {
+		t.Errorf("expected a zero-size pool to retain nothing, got %d", n)
+	}
+}
@@ -0,0 +1,65 @@
+// Package main provides feature discovery for the speed test server.
+// This file contains the /capabilities endpoint.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// capabilities reports which optional features this deployment supports,
+// derived from the effective configuration, so a single frontend can adapt
+// to differently configured servers.
+func capabilities(cfg *Config) map[string]bool {
+	return map[string]bool{
+		// Features built into every server
+		"sizeParam":        true,
+		"sessions":         true,
+		"parallelStreams":  true,
+		"gzipDiagnostic":   true,
+		"loadTest":         true,
+		"units":            true,
+		"burstPing":        true,
+		"multiPing":        true,
+		"adaptiveDownload": true,
+		"directionalRtt":   true,
+		"duration":         true,
+		"uploadDuration":   true,
+		"detailedUpload":   true,
+		"zeroFill":         true,
+
+		// Not supported by this server
+		"range": false,
+		"quic":  false,
+
+		// Features that depend on configuration
+		"loadShedding":        cfg.MaxInFlight > 0 || cfg.MaxEgressMbps > 0,
+		"dailyDownloadCap":    cfg.DailyDownloadCapGB > 0,
+		"downloadSizeJitter":  cfg.DownloadSizeJitter > 0,
+		"requireUploadOrigin": cfg.RequireUploadOrigin,
+		"tcpInfo":             cfg.TCPInfo && tcpInfoSupported,
+		"tracing":             cfg.OTelEndpoint != "",
+		"downloadToken":       cfg.DownloadTokenSecret != "",
+		"websocket":           cfg.MaxWSConns > 0,
+		"tcpEcho":             cfg.TCPEchoPort > 0,
+		// HTTP/2, and with it server push, is only negotiated over TLS
+		"tls":   cfg.tlsEnabled(),
+		"http2": cfg.tlsEnabled(),
+		"push":  cfg.tlsEnabled(),
+	}
+}
+
+// capabilitiesHandler returns a handler that reports the server's
+// capabilities for the given configuration as a JSON object of feature flags.
+func capabilitiesHandler(cfg *Config) http.HandlerFunc {
+	features := capabilities(cfg)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(features)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCapabilitiesHandler(t *testing.T) {
+	enabled := defaultConfig()
+	enabled.DailyDownloadCapGB = 100
+	enabled.RequireUploadOrigin = true
+	enabled.TCPEchoPort = 9000
+	enabled.TLSCert, enabled.TLSKey = "cert.pem", "key.pem"
+	disabled := defaultConfig()
+	disabled.MaxWSConns = 0
+
+	tests := []struct {
+		name     string
+		cfg      *Config
+		expected map[string]bool
+	}{
+		{
+			name: "Defaults",
+			cfg:  defaultConfig(),
+			expected: map[string]bool{
+				"sizeParam":           true,
+				"quic":                false,
+				"dailyDownloadCap":    false,
+				"requireUploadOrigin": false,
+				"websocket":           true,
+				"tcpEcho":             false,
+				"http2":               false,
+				"push":                false,
+				"zeroFill":            true,
+			},
+		},
+		{
+			name: "Enabled Options",
+			cfg:  enabled,
+			expected: map[string]bool{
+				"sizeParam":           true,
+				"quic":                false,
+				"dailyDownloadCap":    true,
+				"requireUploadOrigin": true,
+				"tcpEcho":             true,
+				"tls":                 true,
+				"http2":               true,
+				"push":                true,
+			},
+		},
+		{
+			name: "Disabled WebSocket",
+			cfg:  disabled,
+			expected: map[string]bool{
+				"websocket": false,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			capabilitiesHandler(tt.cfg)(w, httptest.NewRequest("GET", "/capabilities", nil))
+
+			var features map[string]bool
+			if err := json.NewDecoder(w.Body).Decode(&features); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.expected {
+				got, ok := features[name]
+				if !ok {
+					t.Errorf("missing capability %q", name)
+				} else if got != want {
+					t.Errorf("capability %q: expected %v, got %v", name, want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Package main provides capacity reporting for the speed test server.
+// This file contains the CPU sampler and the /capacity endpoint.
+package main
+
+import (
+	"math"
+	"net/http"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// cpuSampleInterval is the shortest period the CPU load is measured over;
+// requests arriving sooner reuse the previous measurement
+const cpuSampleInterval = time.Second
+
+// cpuSampler measures the fraction of the Go runtime's CPU capacity
+// (GOMAXPROCS cores) that was busy, from the runtime's own CPU accounting,
+// so it works on every platform without reading OS files. It samples
+// lazily: each measurement covers the time since the previous one.
+//
+// It reads time.Now rather than clock, because it measures real CPU time.
+type cpuSampler struct {
+	mu       sync.Mutex
+	sampled  time.Time
+	total    float64
+	idle     float64
+	fraction float64
+}
+
+var cpuMetrics = []metrics.Sample{
+	{Name: "/cpu/classes/total:cpu-seconds"},
+	{Name: "/cpu/classes/idle:cpu-seconds"},
+}
+
+// load returns the busy fraction of the CPU, between 0 and 1, over the
+// last sample interval. The first call covers the time since startup.
+func (s *cpuSampler) load() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if !s.sampled.IsZero() && now.Sub(s.sampled) < cpuSampleInterval {
+		return s.fraction
+	}
+
+	readings := make([]metrics.Sample, len(cpuMetrics))
+	copy(readings, cpuMetrics)
+	metrics.Read(readings)
+	if readings[0].Value.Kind() != metrics.KindFloat64 || readings[1].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	total, idle := readings[0].Value.Float64(), readings[1].Value.Float64()
+	if elapsed := total - s.total; elapsed > 0 {
+		s.fraction = math.Max(0, math.Min(1, 1-(idle-s.idle)/elapsed))
+	}
+	s.sampled, s.total, s.idle = now, total, idle
+	return s.fraction
+}
+
+// cpuLoad samples the CPU load reported by /capacity.
+var cpuLoad = &cpuSampler{}
+
+// CapacityResponse is the JSON body of /capacity.
+type CapacityResponse struct {
+	// CPULoad is the busy fraction of the server's CPU, from 0 to 1
+	CPULoad float64 `json:"cpuLoad"`
+	// ActiveStreams is the number of speed tests in progress
+	ActiveStreams int64 `json:"activeStreams"`
+	// MaxStreams is the -max-inflight cap on ActiveStreams, if set
+	MaxStreams int64 `json:"maxStreams,omitempty"`
+	// EgressMbps is the bandwidth speed tests used over the last second
+	EgressMbps float64 `json:"egressMbps"`
+	// HeadroomMbps is the bandwidth left below -max-egress-mbps. It is
+	// omitted without a cap, as the server can't know the link's capacity.
+	HeadroomMbps *float64 `json:"headroomMbps,omitempty"`
+	// Busy is true if a speed test started now would be refused with 503
+	Busy bool `json:"busy"`
+}
+
+// capacityHandler reports the server's current load and the headroom left
+// below its configured caps, so a client can scale down or delay a heavy
+// parallel test while the server is busy.
+func capacityHandler(load *loadMonitor, cpu *cpuSampler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		active := load.inFlight.Load()
+		egress := load.egress.rate()
+		_, busy := load.overloaded(active + 1)
+
+		response := CapacityResponse{
+			CPULoad:       cpu.load(),
+			ActiveStreams: active,
+			MaxStreams:    load.maxInFlight,
+			EgressMbps:    float64(egress) * 8 / 1e6,
+			Busy:          busy,
+		}
+		if load.maxEgress > 0 {
+			headroom := float64(max(0, load.maxEgress-egress)) * 8 / 1e6
+			response.HeadroomMbps = &headroom
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, r, response)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// blockingRecorder is a ResponseRecorder whose first body write signals
+// started and then waits for release, holding its request in flight.
+type blockingRecorder struct {
+	*httptest.ResponseRecorder
+	started chan struct{}
+	release chan struct{}
+	writes  int
+}
+
+func (w *blockingRecorder) Write(p []byte) (int, error) {
+	if w.writes++; w.writes == 1 {
+		close(w.started)
+		<-w.release
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+// getCapacity fetches /capacity from the mux and decodes its fields.
+func getCapacity(t *testing.T, mux *http.ServeMux) map[string]any {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/capacity", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var fields map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestCapacityHandler(t *testing.T) {
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(2, 100, 0))
+
+	idle := getCapacity(t, mux)
+	for _, field := range []string{"cpuLoad", "activeStreams", "maxStreams", "egressMbps", "headroomMbps", "busy"} {
+		if _, ok := idle[field]; !ok {
+			t.Errorf("missing field %q", field)
+		}
+	}
+	if load, _ := idle["cpuLoad"].(float64); load < 0 || load > 1 {
+		t.Errorf("expected a CPU load between 0 and 1, got %v", idle["cpuLoad"])
+	}
+	if idle["activeStreams"] != 0.0 || idle["headroomMbps"] != 100.0 || idle["busy"] != false {
+		t.Errorf("expected an idle server with full headroom, got %v", idle)
+	}
+
+	// Hold a download in flight, then one more test fills -max-inflight
+	download := &blockingRecorder{ResponseRecorder: httptest.NewRecorder(), started: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mux.ServeHTTP(download, httptest.NewRequest("GET", "/download?bytes=1024", nil))
+	}()
+	<-download.started
+
+	busy := getCapacity(t, mux)
+	close(download.release)
+	<-done
+	if busy["activeStreams"] != 1.0 {
+		t.Errorf("expected 1 active stream during the download, got %v", busy["activeStreams"])
+	}
+	if busy["busy"] != false {
+		t.Error("expected room for one more test below -max-inflight 2")
+	}
+
+	if after := getCapacity(t, mux); after["activeStreams"] != 0.0 {
+		t.Errorf("expected no active streams after the download, got %v", after["activeStreams"])
+	}
+}
+
+func TestCapacityWithoutCaps(t *testing.T) {
+	fields := getCapacity(t, newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0)))
+	if _, ok := fields["headroomMbps"]; ok {
+		t.Error("expected no bandwidth headroom without -max-egress-mbps")
+	}
+	if _, ok := fields["maxStreams"]; ok {
+		t.Error("expected no stream cap without -max-inflight")
+	}
+}
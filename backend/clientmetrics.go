@@ -0,0 +1,118 @@
+// Package main provides per-client Prometheus gauges for the speed test
+// server. This file contains the bounded set of client series that
+// -client-metrics exposes at /metrics, so operators can chart individual
+// clients' measured speeds over time.
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Client identifiers accepted by -client-metrics-label
+const (
+	clientLabelIP      = "ip"
+	clientLabelSession = "session"
+)
+
+// clientGauges holds the latest measurements of at most limit clients.
+// Every client is a label value on the gauges, and a Prometheus server
+// keeps each label value as a separate series, so the set must not grow
+// with the number of clients ever seen: once it is full, the client
+// measured least recently is evicted to make room.
+type clientGauges struct {
+	mu      sync.Mutex
+	limit   int
+	label   string
+	clients map[string]*list.Element
+	// recent orders the clients from most to least recently measured
+	recent  *list.List
+	evicted int64
+}
+
+// clientSeries is the latest measurement of one client.
+type clientSeries struct {
+	client       string
+	downloadMbps float64
+	uploadMbps   float64
+}
+
+func newClientGauges(limit int, label string) *clientGauges {
+	return &clientGauges{
+		limit:   limit,
+		label:   label,
+		clients: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// clientMetrics receives every recorded result when -client-metrics is set.
+var clientMetrics *clientGauges
+
+// client returns the identifier r's measurements are recorded under: its
+// session with the session label when it names one, and otherwise its
+// address without the port, which changes with every connection.
+func (g *clientGauges) client(r *http.Request) string {
+	if g.label == clientLabelSession {
+		if id, ok := requestSession(r); ok {
+			return id
+		}
+	}
+	return addrHost(clientIP(r))
+}
+
+// record sets the client's gauge of the given kind, "download" or
+// "upload", to mbps.
+func (g *clientGauges) record(client, kind string, mbps float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	element, ok := g.clients[client]
+	if ok {
+		g.recent.MoveToFront(element)
+	} else {
+		if g.recent.Len() >= g.limit {
+			oldest := g.recent.Back()
+			delete(g.clients, g.recent.Remove(oldest).(*clientSeries).client)
+			g.evicted++
+		}
+		element = g.recent.PushFront(&clientSeries{client: client})
+		g.clients[client] = element
+	}
+
+	series := element.Value.(*clientSeries)
+	if kind == "upload" {
+		series.uploadMbps = mbps
+	} else {
+		series.downloadMbps = mbps
+	}
+}
+
+// writeMetrics renders the gauges in the Prometheus text format, most
+// recently measured client first. A client not yet measured in one
+// direction has no sample for that gauge.
+func (g *clientGauges) writeMetrics(b *strings.Builder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, gauge := range []struct {
+		name, help string
+		value      func(*clientSeries) float64
+	}{
+		{"pinguen_client_download_mbps", "Throughput of each client's latest download, in Mbps.", func(s *clientSeries) float64 { return s.downloadMbps }},
+		{"pinguen_client_upload_mbps", "Throughput of each client's latest upload, in Mbps.", func(s *clientSeries) float64 { return s.uploadMbps }},
+	} {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+		for element := g.recent.Front(); element != nil; element = element.Next() {
+			series := element.Value.(*clientSeries)
+			if value := gauge.value(series); value > 0 {
+				fmt.Fprintf(b, "%s{client=\"%s\"} %g\n", gauge.name, labelEscaper.Replace(series.client), value)
+			}
+		}
+	}
+	fmt.Fprintf(b, "# HELP pinguen_client_series Clients with per-client gauges.\n# TYPE pinguen_client_series gauge\npinguen_client_series %d\n", g.recent.Len())
+	fmt.Fprintf(b, "# HELP pinguen_client_series_evicted_total Clients whose gauges were dropped to stay within -client-metrics.\n# TYPE pinguen_client_series_evicted_total counter\npinguen_client_series_evicted_total %d\n", g.evicted)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// useClientMetrics enables per-client gauges for the duration of the test.
+func useClientMetrics(t *testing.T, limit int, label string) {
+	previous := clientMetrics
+	clientMetrics = newClientGauges(limit, label)
+	t.Cleanup(func() { clientMetrics = previous })
+}
+
+// clientGauge returns the value of the metric's sample for client at
+// /metrics, and false if there is none.
+func clientGauge(t *testing.T, mux *http.ServeMux, metric, client string) (float64, bool) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	prefix := metric + `{client="` + client + `"} `
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, prefix); ok {
+			mbps, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("malformed sample line %q", line)
+			}
+			return mbps, true
+		}
+	}
+	return 0, false
+}
+
+func TestClientMetricsGauge(t *testing.T) {
+	useClientMetrics(t, 10, clientLabelIP)
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	download := httptest.NewRequest("GET", "/download?bytes=65536", nil)
+	download.RemoteAddr = "203.0.113.7:50123"
+	mux.ServeHTTP(httptest.NewRecorder(), download)
+
+	// The port changes with every connection, so it is not part of the label
+	if mbps, ok := clientGauge(t, mux, "pinguen_client_download_mbps", "203.0.113.7"); !ok || mbps <= 0 {
+		t.Errorf("expected a download gauge for the client, got %v (present %v)", mbps, ok)
+	}
+	if _, ok := clientGauge(t, mux, "pinguen_client_upload_mbps", "203.0.113.7"); ok {
+		t.Error("expected no upload gauge before the client uploaded")
+	}
+}
+
+func TestClientMetricsSessionLabel(t *testing.T) {
+	useClientMetrics(t, 10, clientLabelSession)
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	upload := httptest.NewRequest("POST", "/upload?session=abc123", strings.NewReader(strings.Repeat("a", 4096)))
+	mux.ServeHTTP(httptest.NewRecorder(), upload)
+	if _, ok := clientGauge(t, mux, "pinguen_client_upload_mbps", "abc123"); !ok {
+		t.Error("expected an upload gauge labeled with the session")
+	}
+
+	// Without a session the address is used instead
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/download?bytes=4096", nil))
+	if _, ok := clientGauge(t, mux, "pinguen_client_download_mbps", "192.0.2.1"); !ok {
+		t.Error("expected a download gauge labeled with the address outside a session")
+	}
+}
+
+func TestClientMetricsEviction(t *testing.T) {
+	gauges := newClientGauges(2, clientLabelIP)
+	gauges.record("a", "download", 10)
+	gauges.record("b", "download", 20)
+	// Measuring a again makes b the least recently measured
+	gauges.record("a", "upload", 5)
+	gauges.record("c", "download", 30)
+
+	var b strings.Builder
+	gauges.writeMetrics(&b)
+	metrics := b.String()
+	for _, expected := range []string{
+		`pinguen_client_download_mbps{client="a"} 10`,
+		`pinguen_client_upload_mbps{client="a"} 5`,
+		`pinguen_client_download_mbps{client="c"} 30`,
+		"pinguen_client_series 2",
+		"pinguen_client_series_evicted_total 1",
+	} {
+		if !strings.Contains(metrics, expected+"\n") {
+			t.Errorf("expected %q in the metrics, got:\n%s", expected, metrics)
+		}
+	}
+	if strings.Contains(metrics, `client="b"`) {
+		t.Errorf("expected the least recently measured client to be evicted, got:\n%s", metrics)
+	}
+}
@@ -0,0 +1,11 @@
+// Package main provides the time source for the speed test server.
+// This file contains the injectable clock used in place of time.Now.
+package main
+
+import "time"
+
+// clock returns the current time. Handlers, limiters and stores call it
+// instead of time.Now so tests can substitute a fake clock and exercise
+// windows and expiry without sleeping. Timer-driven code such as the load
+// test's latency sampler keeps using real time.
+var clock = time.Now
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced time source for tests.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// useFakeClock replaces the package clock with a fake one for the duration
+// of the test.
+func useFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{now: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	previous := clock
+	clock = c.Now
+	t.Cleanup(func() { clock = previous })
+	return c
+}
+
+func TestRateLimiterWindowExpiry(t *testing.T) {
+	for name, newLimiter := range rateLimitAlgorithms {
+		t.Run(name, func(t *testing.T) {
+			c := useFakeClock(t)
+			limiter := newLimiter(defaultRateLimit, defaultRateWindow, 0)
+
+			for i := 0; i < defaultRateLimit; i++ {
+				if !limiter.isAllowed("client") {
+					t.Fatalf("request %d rejected within the limit", i+1)
+				}
+			}
+			if limiter.isAllowed("client") {
+				t.Fatal("expected the request over the limit to be rejected")
+			}
+
+			// Just before the next request slot frees up the client is
+			// still limited: at the end of the window, or for a token
+			// bucket when its next token is due
+			wait := defaultRateWindow
+			if name == "token-bucket" {
+				wait = defaultRateWindow / defaultRateLimit
+			}
+			c.advance(wait - time.Millisecond)
+			if limiter.isAllowed("client") {
+				t.Error("expected the client to stay limited until its next request slot")
+			}
+
+			// A whole window later every algorithm has its full limit back
+			c.advance(defaultRateWindow)
+			if !limiter.isAllowed("client") {
+				t.Error("expected the client to be allowed once the window passed")
+			}
+			if usage := limiter.usage("client"); usage.Remaining != defaultRateLimit-1 {
+				t.Errorf("expected %d remaining in the new window, got %d", defaultRateLimit-1, usage.Remaining)
+			}
+		})
+	}
+}
+
+func TestFixedWindowRollover(t *testing.T) {
+	c := useFakeClock(t)
+	limiter := newFixedWindowLimiter(2, time.Minute)
+
+	limiter.isAllowed("client")
+	c.advance(59 * time.Second)
+	limiter.isAllowed("client")
+	if limiter.isAllowed("client") {
+		t.Fatal("expected the request over the limit to be rejected")
+	}
+
+	// The window rolls over a minute after its first request, restoring the
+	// whole limit at once
+	c.advance(time.Second)
+	for i := 0; i < 2; i++ {
+		if !limiter.isAllowed("client") {
+			t.Fatalf("request %d rejected in the new window", i+1)
+		}
+	}
+
+	// A client idle for a whole window is forgotten by the next sweep
+	limiter.isAllowed("idle")
+	c.advance(2 * time.Minute)
+	limiter.isAllowed("client")
+	if _, exists := limiter.windows["idle"]; exists {
+		t.Error("expected the idle client's window to be evicted")
+	}
+	if n := len(limiter.windows); n != 1 {
+		t.Errorf("expected 1 tracked client, got %d", n)
+	}
+}
+
+func TestRateLimiterEvictsIdleClients(t *testing.T) {
+	c := useFakeClock(t)
+	limiter := newRateLimiter(defaultRateLimit, time.Minute)
+
+	limiter.isAllowed("idle")
+	c.advance(2 * time.Minute)
+	limiter.isAllowed("client")
+	if _, exists := limiter.requests["idle"]; exists {
+		t.Error("expected the idle client's requests to be evicted")
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	c := useFakeClock(t)
+	// Two tokens a minute, with room for a burst of three
+	limiter := newTokenBucketLimiter(2, time.Minute, 3)
+
+	for i := 0; i < 3; i++ {
+		if !limiter.isAllowed("client") {
+			t.Fatalf("request %d rejected within the burst capacity", i+1)
+		}
+	}
+	if limiter.isAllowed("client") {
+		t.Fatal("expected the request over the capacity to be rejected")
+	}
+	if usage := limiter.usage("client"); usage.Remaining != 0 || usage.Reset.Sub(c.Now()) != 30*time.Second {
+		t.Errorf("expected no tokens and the next one in 30s, got %d and %v", usage.Remaining, usage.Reset.Sub(c.Now()))
+	}
+
+	// A token is gained every 30s, and rejected requests don't cost one
+	c.advance(29 * time.Second)
+	if limiter.isAllowed("client") {
+		t.Error("expected the client to stay limited until the next token")
+	}
+	c.advance(time.Second)
+	if !limiter.isAllowed("client") {
+		t.Error("expected a request to be allowed once a token refilled")
+	}
+
+	// An idle client's bucket fills up to its capacity and no further
+	c.advance(time.Hour)
+	if usage := limiter.usage("client"); usage.Remaining != 3 || !usage.Reset.Equal(c.Now()) {
+		t.Errorf("expected a full bucket of 3 tokens, got %d resetting in %v", usage.Remaining, usage.Reset.Sub(c.Now()))
+	}
+}
+
+func TestRateLimiterConfiguredWindow(t *testing.T) {
+	const limit, window = 3, 10 * time.Second
+	for name, newLimiter := range rateLimitAlgorithms {
+		t.Run(name, func(t *testing.T) {
+			c := useFakeClock(t)
+			limiter := newLimiter(limit, window, 0)
+
+			for i := 0; i < limit; i++ {
+				if !limiter.isAllowed("client") {
+					t.Fatalf("request %d rejected within the limit", i+1)
+				}
+			}
+			if limiter.isAllowed("client") {
+				t.Fatal("expected the request over the limit to be rejected")
+			}
+			if usage := limiter.usage("client"); usage.Limit != limit {
+				t.Errorf("expected a limit of %d, got %d", limit, usage.Limit)
+			}
+
+			c.advance(2 * window)
+			if !limiter.isAllowed("client") {
+				t.Error("expected the client to be allowed once the configured window passed")
+			}
+		})
+	}
+}
+
+func TestRateLimitResetHeader(t *testing.T) {
+	c := useFakeClock(t)
+	handler := withRateLimit(newFixedWindowLimiter(defaultRateLimit, defaultRateWindow), pingHandler)
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/ping", nil))
+	c.advance(15 * time.Second)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/ping", nil))
+	if got := w.Header().Get("X-RateLimit-Reset"); got != "45" {
+		t.Errorf("expected X-RateLimit-Reset 45 after 15s of a 60s window, got %q", got)
+	}
+}
@@ -0,0 +1,75 @@
+// Package main provides clock monitoring for the speed test server.
+// This file contains the wall-clock drift reported by /status.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// clockDriftInterval is how often the wall clock is compared against
+	// the monotonic clock between /status requests
+	clockDriftInterval = time.Minute
+	// clockSyncThreshold is the drift beyond which the wall clock is
+	// reported as unsynchronized
+	clockSyncThreshold = 100 * time.Millisecond
+)
+
+// driftMonitor tracks how far the wall clock has moved relative to the
+// monotonic clock since startup. The monotonic clock only ever advances at
+// a steady rate, so any difference means the wall clock was stepped or
+// slewed, for example by NTP correcting it, and timestamps taken from it
+// while that happened are suspect.
+//
+// It reads time.Now rather than clock, because it measures the real clocks
+// of the host.
+type driftMonitor struct {
+	mu    sync.Mutex
+	start time.Time
+	drift time.Duration
+	// maxDrift is the largest drift observed by any sample
+	maxDrift time.Duration
+}
+
+func newDriftMonitor() *driftMonitor {
+	return &driftMonitor{start: time.Now()}
+}
+
+// sample measures the current drift and returns it along with the largest
+// drift seen so far.
+func (m *driftMonitor) sample() (drift, maxDrift time.Duration) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Round(0) strips the monotonic reading, so the first difference uses
+	// wall time only while the second uses the monotonic clock
+	wallElapsed := now.Round(0).Sub(m.start.Round(0))
+	monotonicElapsed := now.Sub(m.start)
+	m.drift = wallElapsed - monotonicElapsed
+	if m.drift.Abs() > m.maxDrift.Abs() {
+		m.maxDrift = m.drift
+	}
+	return m.drift, m.maxDrift
+}
+
+// run samples the drift every interval until stop is closed, so steps of
+// the wall clock are noticed even if they are later undone.
+func (m *driftMonitor) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+// clockDrift is the drift monitor of this process, started with it.
+var clockDrift = newDriftMonitor()
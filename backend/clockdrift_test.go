@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatusReportsClockDrift(t *testing.T) {
+	w := httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/status", nil))
+
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"clockDriftMs", "clockMaxDriftMs", "clockStable"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("expected %s in /status", name)
+		}
+	}
+
+	var response StatusResponse
+	w = httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/status", nil))
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing adjusts the clock during a test run
+	threshold := float64(clockSyncThreshold) / float64(time.Millisecond)
+	if math.Abs(response.ClockDriftMs) >= threshold {
+		t.Errorf("expected negligible drift, got %vms", response.ClockDriftMs)
+	}
+	if !response.ClockStable {
+		t.Error("expected the clock to be reported stable")
+	}
+}
@@ -0,0 +1,870 @@
+// Package main provides configuration handling for the speed test server.
+// This file contains the Config type, environment variables and
+// command-line flag parsing.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request log formats accepted by -log-format and LOG_FORMAT
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Config holds the runtime settings of the speed test server.
+type Config struct {
+	// Port is the TCP port the server listens on.
+	Port int
+	// MaxInFlight is the number of concurrent speed-test requests above
+	// which new requests are shed with 503. Zero disables the check.
+	MaxInFlight int
+	// MaxEgressMbps is the outgoing bandwidth, in megabits per second, above
+	// which new speed-test requests are shed with 503. Zero disables the check.
+	MaxEgressMbps float64
+	// OverloadRetryAfter is the back-off advertised to shed clients.
+	OverloadRetryAfter time.Duration
+	// RequireUploadOrigin rejects uploads without an allowed Origin header.
+	RequireUploadOrigin bool
+	// LoadTestDuration is how long /loadtest streams data for.
+	LoadTestDuration time.Duration
+	// DailyDownloadCapGB caps the gigabytes served by /download per UTC day.
+	// Zero disables the cap.
+	DailyDownloadCapGB float64
+	// SymmetricRatio is the download/upload throughput ratio beyond which a
+	// session's link is classified as asymmetric.
+	SymmetricRatio float64
+	// RatePrecision is the number of decimal places reported rates are
+	// rounded to.
+	RatePrecision int
+	// InstanceID identifies this server instance in the X-Instance-ID
+	// header and /status. Empty generates a random ID at startup.
+	InstanceID string
+	// Location describes where the server runs, such as "us-east-1", for
+	// clients testing against several servers. Empty leaves it out of
+	// /status.
+	Location string
+	// Headers are static headers added to every response.
+	Headers http.Header
+	// AllowedOrigins is the CORS origin allowlist, also used by
+	// RequireUploadOrigin. The first entry is the default
+	// Access-Control-Allow-Origin when the request has no matching Origin.
+	AllowedOrigins []string
+	// CORSMaxAge is how long browsers may cache a CORS preflight response
+	// before sending another. Zero leaves it to the browser.
+	CORSMaxAge time.Duration
+	// RateAlgorithm names the rate-limiting algorithm, one of the keys of
+	// rateLimitAlgorithms.
+	RateAlgorithm string
+	// RateLimit is the number of requests each client may make to the
+	// rate-limited routes per RateWindow.
+	RateLimit int
+	// RateWindow is the period over which RateLimit is counted.
+	RateWindow time.Duration
+	// RateBurst is the capacity of each client's bucket with the
+	// token-bucket algorithm, which refills at RateLimit per RateWindow.
+	// The subnet and ping limits burst in the same proportion to their
+	// limits. Zero uses RateLimit, and other algorithms refuse it.
+	RateBurst int
+	// SubnetRateLimit is the number of requests all clients of one network
+	// together may make to the rate-limited routes per RateWindow. Zero
+	// disables the subnet limit.
+	SubnetRateLimit int
+	// SubnetMaxInFlight caps the speed tests in progress from one network
+	// at a time. Zero disables the cap.
+	SubnetMaxInFlight int
+	// SubnetV4Prefix and SubnetV6Prefix are the prefix lengths that group
+	// IPv4 and IPv6 clients into networks for the subnet limits.
+	SubnetV4Prefix int
+	SubnetV6Prefix int
+	// DebugToken is the bearer token required by the diagnostic endpoints,
+	// /debug/vars and /debug/ratelimit/top, which reveal server internals
+	// and client addresses. Empty disables those endpoints.
+	DebugToken string
+	// GatewaySecret is the value GatewayHeader must carry on every request,
+	// including those to the operational endpoints, so that only traffic
+	// routed through a CDN or gateway adding it reaches the server. Empty
+	// disables the check.
+	GatewaySecret string
+	// GatewayHeader names the header checked against GatewaySecret.
+	GatewayHeader string
+	// TrustProxy identifies clients by the X-Forwarded-For or X-Real-IP
+	// header of the reverse proxy in front of the server, rather than by
+	// the address of the connection.
+	TrustProxy bool
+	// PingRateLimit is the per-client requests-per-minute limit of the
+	// latency probes (/ping, /ping/burst, /multiping and /rtt), which are tracked
+	// separately from the stricter limit of the other routes.
+	PingRateLimit int
+	// ReliableDownloadBytes is the download size below which the result is
+	// flagged as an unreliable measurement.
+	ReliableDownloadBytes int
+	// DownloadSizeJitter is the maximum number of random bytes added to each
+	// download to defeat caching. Zero disables jitter.
+	DownloadSizeJitter int
+	// LogFormat is the request log format, logFormatText or logFormatJSON.
+	LogFormat string
+	// LogSlowMs restricts request logging to requests taking at least this
+	// many milliseconds, plus any that fail. Zero logs every request.
+	LogSlowMs int
+	// TCPInfo reports the kernel's retransmission count and RTT for each
+	// download and upload connection. Only supported on Linux.
+	TCPInfo bool
+	// DownloadBytes is the size of a download that doesn't ask for one
+	// with ?bytes=.
+	DownloadBytes int
+	// MaxDownloadBytes caps the download size a client may request via
+	// ?bytes=. Larger requests are served this many bytes.
+	MaxDownloadBytes int
+	// MaxUploadBytes caps the size of an upload body. Larger uploads are
+	// refused with 413.
+	MaxUploadBytes int64
+	// TCPEchoPort is the TCP port of the raw echo server for latency
+	// probes without HTTP overhead. Zero disables the echo server.
+	TCPEchoPort int
+	// MaxWSConns caps the number of /ws connections open at once. Zero
+	// disables /ws.
+	MaxWSConns int
+	// MaxWSConnsPerClient caps the number of /ws connections one client
+	// may have open at once. Zero leaves clients uncapped.
+	MaxWSConnsPerClient int
+	// MaxURLBytes caps the length of a request's path and query string.
+	// Longer requests are refused with 414.
+	MaxURLBytes int
+	// DownloadFilename is the file name downloads are offered as in a
+	// Content-Disposition attachment header. Empty sends no such header.
+	DownloadFilename string
+	// PayloadFile is a file whose contents, repeated as needed, are served
+	// as the download payload instead of random data. Empty serves random
+	// data.
+	PayloadFile string
+	// MarkerIntervalBytes is the spacing of the progress markers written
+	// into downloads requested with ?markers=1.
+	MarkerIntervalBytes int
+	// ChunkBytes is the download write size for clients without an RTT
+	// hint.
+	ChunkBytes int
+	// MaxChunkBytes bounds the download write size chosen from a client's
+	// RTT hint.
+	MaxChunkBytes int
+	// WritePattern is a sequence of write sizes downloads cycle through
+	// instead of writing in equal chunks. Empty writes equal chunks.
+	WritePattern []int
+	// OTelEndpoint is the OTLP/HTTP collector URL that request traces are
+	// exported to. Empty disables tracing.
+	OTelEndpoint string
+	// BufferPoolSize is the number of idle download buffers retained for
+	// reuse. Buffers needed beyond it are allocated per request.
+	BufferPoolSize int
+	// WebhookURL receives a POST of every completed measurement. Empty
+	// disables the webhook.
+	WebhookURL string
+	// ClientMetrics is the number of clients whose latest measurements are
+	// exposed as gauges at /metrics, evicting the least recently measured
+	// beyond it. Zero disables the per-client gauges.
+	ClientMetrics int
+	// ClientMetricsLabel identifies the clients of ClientMetrics,
+	// clientLabelIP or clientLabelSession.
+	ClientMetricsLabel string
+	// DownloadTokenSecret is the HMAC key of the tokens /token issues. When
+	// set, downloads are refused without a valid token. Empty disables
+	// tokens.
+	DownloadTokenSecret string
+	// DownloadTokenTTL is how long an issued download token stays valid.
+	DownloadTokenTTL time.Duration
+	// DedupWindow is how long after a result an identical one from the same
+	// client is treated as a duplicate and not recorded. Zero disables
+	// deduplication.
+	DedupWindow time.Duration
+	// IdleTimeout is how long a keep-alive connection may sit idle before
+	// the server closes it.
+	IdleTimeout time.Duration
+	// WriteTimeout is how long a single write of a download may block on a
+	// client that stopped reading before the download is abandoned. Zero
+	// disables the deadline.
+	WriteTimeout time.Duration
+	// UploadTimeout caps the time an upload may take to arrive, so a client
+	// trickling its body can't hold the handler forever. Zero disables the
+	// cap.
+	UploadTimeout time.Duration
+	// ShutdownTimeout is how long shutdown waits for in-flight requests to
+	// finish before closing their connections.
+	ShutdownTimeout time.Duration
+	// InjectLatency is an artificial delay added before every request is
+	// handled, for testing client resilience. Zero disables it.
+	InjectLatency time.Duration
+	// TLSCert and TLSKey are the PEM certificate and private key files the
+	// server uses to serve HTTPS. Both must be set, or neither to serve
+	// plain HTTP.
+	TLSCert string
+	TLSKey  string
+	// ConfigFile is the JSON file the configuration was loaded from, with
+	// the environment and the other flags taking precedence over it. Empty
+	// uses the defaults.
+	ConfigFile string
+	// CheckConfig makes the server validate its configuration and exit
+	// instead of serving.
+	CheckConfig bool
+	// Replay is a replay profile to send to ReplayTarget instead of
+	// serving. Empty serves as usual.
+	Replay string
+	// ReplayTarget is the base URL of the server Replay is sent to.
+	ReplayTarget string
+}
+
+// defaultConfig returns the configuration used when no flags are given.
+func defaultConfig() *Config {
+	return &Config{
+		Port:                  8080,
+		OverloadRetryAfter:    5 * time.Second,
+		LoadTestDuration:      10 * time.Second,
+		SymmetricRatio:        1.5,
+		RatePrecision:         defaultRatePrecision,
+		Headers:               http.Header{},
+		AllowedOrigins:        []string{"http://localhost:5173"},
+		CORSMaxAge:            24 * time.Hour,
+		RateAlgorithm:         "sliding-window",
+		LogFormat:             logFormatText,
+		GatewayHeader:         "X-Gateway-Secret",
+		RateLimit:             defaultRateLimit,
+		RateWindow:            defaultRateWindow,
+		SubnetV4Prefix:        defaultSubnetV4Prefix,
+		SubnetV6Prefix:        defaultSubnetV6Prefix,
+		PingRateLimit:         defaultPingRateLimit,
+		ReliableDownloadBytes: 1024 * 1024,
+		DownloadBytes:         downloadSize,
+		MaxDownloadBytes:      defaultMaxDownloadBytes,
+		MaxUploadBytes:        defaultMaxUploadBytes,
+		MaxURLBytes:           4096,
+		MaxWSConns:            64,
+		MaxWSConnsPerClient:   4,
+		MarkerIntervalBytes:   1024 * 1024,
+		ChunkBytes:            defaultChunkSize,
+		MaxChunkBytes:         256 * 1024,
+		BufferPoolSize:        defaultBufferPoolSize,
+		DownloadTokenTTL:      time.Minute,
+		ReplayTarget:          "http://localhost:8080",
+		ClientMetricsLabel:    clientLabelIP,
+		IdleTimeout:           2 * time.Minute,
+		WriteTimeout:          30 * time.Second,
+		UploadTimeout:         60 * time.Second,
+		ShutdownTimeout:       30 * time.Second,
+	}
+}
+
+// tlsEnabled reports whether the server serves HTTPS.
+func (c *Config) tlsEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// rateBurst returns the burst for a limiter allowing limit requests, as
+// -rate-burst scaled from -rate-limit to that limit, or zero for the
+// limiter's default.
+func (c *Config) rateBurst(limit int) int {
+	if c.RateBurst == 0 {
+		return 0
+	}
+	return max(1, c.RateBurst*limit/c.RateLimit)
+}
+
+// addr returns the address the server listens on.
+func (c *Config) addr() string {
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+// tcpEchoAddr returns the address the TCP echo server listens on.
+func (c *Config) tcpEchoAddr() string {
+	return fmt.Sprintf(":%d", c.TCPEchoPort)
+}
+
+// activeConfig is the configuration consulted by handlers. main replaces it
+// with the parsed flags before the server starts.
+var activeConfig = defaultConfig()
+
+// applyEnv overrides the defaults in cfg with the settings given as
+// environment variables. Flags are parsed afterwards, so they take
+// precedence over the environment.
+func applyEnv(cfg *Config) error {
+	if value := os.Getenv("PORT"); value != "" {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid PORT %q: must be a port number", value)
+		}
+		cfg.Port = port
+	}
+	if value := os.Getenv("MAX_UPLOAD_BYTES"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid MAX_UPLOAD_BYTES %q: must be a number of bytes", value)
+		}
+		cfg.MaxUploadBytes = limit
+	}
+	if value := os.Getenv("LOG_FORMAT"); value != "" {
+		cfg.LogFormat = value
+	}
+	if value := os.Getenv("RATE_LIMIT"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid RATE_LIMIT %q: must be a number of requests", value)
+		}
+		cfg.RateLimit = limit
+	}
+	if value := os.Getenv("RATE_WINDOW"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid RATE_WINDOW %q: must be a duration such as 1m", value)
+		}
+		cfg.RateWindow = window
+	}
+	if value := os.Getenv("SERVER_LOCATION"); value != "" {
+		cfg.Location = value
+	}
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid SHUTDOWN_TIMEOUT %q: must be a duration such as 30s", value)
+		}
+		cfg.ShutdownTimeout = timeout
+	}
+	return nil
+}
+
+// configFile is the layout of a -config file. Each field is a pointer so
+// that settings missing from the file keep their defaults.
+type configFile struct {
+	Port             *int            `json:"port"`
+	DownloadBytes    *int            `json:"downloadBytes"`
+	MaxDownloadBytes *int            `json:"maxDownloadBytes"`
+	MaxUploadBytes   *int64          `json:"maxUploadBytes"`
+	RateLimit        *int            `json:"rateLimit"`
+	RateWindow       *configDuration `json:"rateWindow"`
+	AllowedOrigins   []string        `json:"allowedOrigins"`
+	TLSCert          *string         `json:"tlsCert"`
+	TLSKey           *string         `json:"tlsKey"`
+}
+
+// configDuration is a duration written in a config file as a string such
+// as "1m", rather than as a number of nanoseconds.
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"1m\", got %s", data)
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: must be a duration such as \"1m\"", value)
+	}
+	*d = configDuration(duration)
+	return nil
+}
+
+// LoadConfig reads the configuration from the JSON file at path. Settings
+// missing from the file keep their defaults, and unknown ones are refused
+// so a misspelt setting isn't silently ignored. The result is not validated,
+// as the environment and flags may still complete or override it; see
+// parseFlags.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	var file configFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	cfg := defaultConfig()
+	cfg.ConfigFile = path
+	if file.Port != nil {
+		cfg.Port = *file.Port
+	}
+	if file.DownloadBytes != nil {
+		cfg.DownloadBytes = *file.DownloadBytes
+	}
+	if file.MaxDownloadBytes != nil {
+		cfg.MaxDownloadBytes = *file.MaxDownloadBytes
+	}
+	if file.MaxUploadBytes != nil {
+		cfg.MaxUploadBytes = *file.MaxUploadBytes
+	}
+	if file.RateLimit != nil {
+		cfg.RateLimit = *file.RateLimit
+	}
+	if file.RateWindow != nil {
+		cfg.RateWindow = time.Duration(*file.RateWindow)
+	}
+	if file.AllowedOrigins != nil {
+		cfg.AllowedOrigins = file.AllowedOrigins
+	}
+	if file.TLSCert != nil {
+		cfg.TLSCert = *file.TLSCert
+	}
+	if file.TLSKey != nil {
+		cfg.TLSKey = *file.TLSKey
+	}
+	return cfg, nil
+}
+
+// parseFlags builds a Config from the given command-line arguments,
+// starting from the defaults, or the file named by -config, and the
+// environment. The merged result is validated once all three are applied.
+func parseFlags(args []string) (*Config, error) {
+	// A first pass finds -config, so the file can be loaded underneath the
+	// environment and the other flags
+	probe := defaultConfig()
+	if err := newFlagSet(probe).Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("pinguen", flag.ContinueOnError)
+	if probe.ConfigFile != "" {
+		loaded, err := LoadConfig(probe.ConfigFile)
+		if err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+		cfg = loaded
+	}
+	if err := applyEnv(cfg); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	fs = newFlagSet(cfg)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if cfg.InstanceID == "" {
+		cfg.InstanceID = newInstanceID()
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// newFlagSet returns the command-line flags, which set the fields of cfg
+// and default to their current values.
+func newFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("pinguen", flag.ContinueOnError)
+	fs.StringVar(&cfg.ConfigFile, "config", cfg.ConfigFile,
+		"JSON file to load the configuration from; the environment and other flags override it")
+	fs.IntVar(&cfg.Port, "port", cfg.Port,
+		"TCP port to listen on (overrides $PORT)")
+	fs.IntVar(&cfg.MaxInFlight, "max-inflight", cfg.MaxInFlight,
+		"shed speed-test requests above this many in flight (0 disables)")
+	fs.Float64Var(&cfg.MaxEgressMbps, "max-egress-mbps", cfg.MaxEgressMbps,
+		"shed speed-test requests above this outgoing bandwidth in Mbps (0 disables)")
+	fs.DurationVar(&cfg.OverloadRetryAfter, "overload-retry-after", cfg.OverloadRetryAfter,
+		"Retry-After advertised to clients shed due to overload")
+	fs.BoolVar(&cfg.RequireUploadOrigin, "require-upload-origin", cfg.RequireUploadOrigin,
+		"reject uploads without an allowed Origin header (blocks non-browser clients)")
+	fs.DurationVar(&cfg.LoadTestDuration, "loadtest-duration", cfg.LoadTestDuration,
+		"how long /loadtest streams data while sampling latency")
+	fs.Float64Var(&cfg.DailyDownloadCapGB, "daily-download-cap-gb", cfg.DailyDownloadCapGB,
+		"refuse downloads with 503 once this many GB were served today (0 disables)")
+	fs.Float64Var(&cfg.SymmetricRatio, "symmetric-ratio", cfg.SymmetricRatio,
+		"download/upload ratio beyond which a session's link is reported as asymmetric")
+	fs.IntVar(&cfg.RatePrecision, "rate-precision", cfg.RatePrecision,
+		fmt.Sprintf("decimal places reported rates are rounded to (0-%d)", maxRatePrecision))
+	fs.StringVar(&cfg.InstanceID, "instance-id", cfg.InstanceID,
+		"ID of this instance in X-Instance-ID and /status, e.g. the host name (empty generates one)")
+	fs.StringVar(&cfg.Location, "server-location", cfg.Location,
+		`where this server runs, e.g. "us-east-1", reported in /status (overrides $SERVER_LOCATION)`)
+	fs.Var(headerFlag(cfg.Headers), "header",
+		`static "Name: Value" header added to every response (repeatable)`)
+	fs.Func("allowed-origins", `comma-separated CORS origin allowlist, e.g. "https://speed.example.com" (default "`+strings.Join(cfg.AllowedOrigins, ",")+`")`, func(value string) error {
+		cfg.AllowedOrigins = strings.Split(value, ",")
+		for i := range cfg.AllowedOrigins {
+			cfg.AllowedOrigins[i] = strings.TrimSpace(cfg.AllowedOrigins[i])
+		}
+		return nil
+	})
+	fs.DurationVar(&cfg.CORSMaxAge, "cors-max-age", cfg.CORSMaxAge,
+		"how long browsers may cache a CORS preflight, rounded down to whole seconds (0 leaves it to the browser)")
+	fs.StringVar(&cfg.RateAlgorithm, "rate-algorithm", cfg.RateAlgorithm,
+		"rate-limiting algorithm: sliding-window, fixed-window or token-bucket")
+	fs.IntVar(&cfg.RateLimit, "rate-limit", cfg.RateLimit,
+		"requests each client may make per -rate-window to the rate-limited routes (overrides $RATE_LIMIT)")
+	fs.DurationVar(&cfg.RateWindow, "rate-window", cfg.RateWindow,
+		"period over which -rate-limit is counted (overrides $RATE_WINDOW)")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", cfg.RateBurst,
+		"requests a client may burst with -rate-algorithm token-bucket, refilled at -rate-limit per -rate-window; the subnet and ping limits burst in proportion (0 uses -rate-limit)")
+	fs.IntVar(&cfg.SubnetRateLimit, "subnet-rate-limit", cfg.SubnetRateLimit,
+		"requests all clients of one network may make per -rate-window to the rate-limited routes (0 disables)")
+	fs.IntVar(&cfg.SubnetMaxInFlight, "subnet-max-inflight", cfg.SubnetMaxInFlight,
+		"speed tests one network may run at once (0 disables)")
+	fs.IntVar(&cfg.SubnetV4Prefix, "subnet-v4-prefix", cfg.SubnetV4Prefix,
+		"prefix length grouping IPv4 clients into networks for the subnet limits")
+	fs.IntVar(&cfg.SubnetV6Prefix, "subnet-v6-prefix", cfg.SubnetV6Prefix,
+		"prefix length grouping IPv6 clients into networks for the subnet limits")
+	fs.StringVar(&cfg.DebugToken, "debug-token", cfg.DebugToken,
+		"enable /debug/vars and /debug/ratelimit/top for requests with \"Authorization: Bearer <token>\" (empty disables)")
+	fs.StringVar(&cfg.GatewaySecret, "gateway-secret", cfg.GatewaySecret,
+		"refuse requests with 403 unless -gateway-header carries this value (empty disables)")
+	fs.StringVar(&cfg.GatewayHeader, "gateway-header", cfg.GatewayHeader,
+		"header that must carry -gateway-secret")
+	fs.BoolVar(&cfg.TrustProxy, "trust-proxy", cfg.TrustProxy,
+		"identify clients by the last X-Forwarded-For address, or X-Real-IP; only enable behind a single proxy that sets them")
+	fs.IntVar(&cfg.PingRateLimit, "ping-rate-limit", cfg.PingRateLimit,
+		"requests per minute each client may send to /ping, /ping/burst, /multiping and /rtt")
+	fs.IntVar(&cfg.ReliableDownloadBytes, "reliable-download-bytes", cfg.ReliableDownloadBytes,
+		"downloads smaller than this are flagged with X-Measurement-Reliable: false")
+	fs.IntVar(&cfg.DownloadSizeJitter, "download-size-jitter", cfg.DownloadSizeJitter,
+		"pad each download by up to this many random bytes to defeat caching (0 disables)")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat,
+		"request log format: text, or json for one JSON object per request (overrides $LOG_FORMAT)")
+	fs.IntVar(&cfg.LogSlowMs, "log-slow-ms", cfg.LogSlowMs,
+		"only log requests slower than this many milliseconds, or that failed (0 logs all)")
+	fs.BoolVar(&cfg.TCPInfo, "tcp-info", cfg.TCPInfo,
+		"report kernel TCP retransmits and RTT in download trailers and upload headers (Linux only)")
+	fs.IntVar(&cfg.DownloadBytes, "download-bytes", cfg.DownloadBytes,
+		"size of a download that doesn't ask for one with ?bytes=")
+	fs.IntVar(&cfg.MaxDownloadBytes, "max-download-bytes", cfg.MaxDownloadBytes,
+		"largest download size a client may request with ?bytes=; larger requests are clamped")
+	fs.Int64Var(&cfg.MaxUploadBytes, "max-upload-bytes", cfg.MaxUploadBytes,
+		"refuse uploads larger than this many bytes with 413 (overrides $MAX_UPLOAD_BYTES)")
+	fs.IntVar(&cfg.TCPEchoPort, "tcp-echo-port", cfg.TCPEchoPort,
+		"TCP port of a raw echo server answering latency probes with a server timestamp (0 disables)")
+	fs.IntVar(&cfg.MaxWSConns, "max-ws-conns", cfg.MaxWSConns,
+		"refuse /ws connections above this many open at once with 503 (0 disables /ws)")
+	fs.IntVar(&cfg.MaxWSConnsPerClient, "max-ws-conns-per-client", cfg.MaxWSConnsPerClient,
+		"refuse /ws connections above this many open at once from one client with 503 (0 for no limit)")
+	fs.IntVar(&cfg.MaxURLBytes, "max-url-bytes", cfg.MaxURLBytes,
+		"refuse requests whose path and query string are longer than this many bytes with 414")
+	fs.StringVar(&cfg.DownloadFilename, "download-filename", cfg.DownloadFilename,
+		`serve downloads as a named attachment, e.g. "speedtest.bin" (empty disables)`)
+	fs.StringVar(&cfg.PayloadFile, "payload-file", cfg.PayloadFile,
+		"serve the contents of this file, repeated as needed, as the download payload instead of random data")
+	fs.IntVar(&cfg.MarkerIntervalBytes, "marker-interval-bytes", cfg.MarkerIntervalBytes,
+		"spacing of the progress markers in downloads requested with ?markers=1")
+	fs.IntVar(&cfg.ChunkBytes, "chunk-bytes", cfg.ChunkBytes,
+		"download write size for clients without an RTT hint")
+	fs.IntVar(&cfg.MaxChunkBytes, "max-chunk-bytes", cfg.MaxChunkBytes,
+		"largest download write size chosen for high-RTT clients")
+	fs.Func("write-pattern", `comma-separated download write sizes to cycle through, e.g. "1500,9000"`, func(value string) error {
+		pattern, err := parseWritePattern(value)
+		cfg.WritePattern = pattern
+		return err
+	})
+	fs.StringVar(&cfg.OTelEndpoint, "otel-endpoint", cfg.OTelEndpoint,
+		`export OpenTelemetry request traces to this OTLP/HTTP collector URL, e.g. "http://localhost:4318"`)
+	fs.IntVar(&cfg.BufferPoolSize, "buffer-pool-size", cfg.BufferPoolSize,
+		"idle download buffers kept for reuse; more are allocated per request under load")
+	fs.StringVar(&cfg.WebhookURL, "webhook-url", cfg.WebhookURL,
+		"POST each completed download and upload result as JSON to this URL")
+	fs.IntVar(&cfg.ClientMetrics, "client-metrics", cfg.ClientMetrics,
+		"expose the latest speeds of up to this many clients as labeled gauges at /metrics (0 disables)")
+	fs.StringVar(&cfg.ClientMetricsLabel, "client-metrics-label", cfg.ClientMetricsLabel,
+		"identify the clients of -client-metrics by ip, or by session, falling back to the ip")
+	fs.StringVar(&cfg.DownloadTokenSecret, "download-token-secret", cfg.DownloadTokenSecret,
+		"require downloads to carry a ?token= from /token, signed with this secret (empty disables)")
+	fs.DurationVar(&cfg.DownloadTokenTTL, "download-token-ttl", cfg.DownloadTokenTTL,
+		"how long a token issued by /token stays valid")
+	fs.DurationVar(&cfg.DedupWindow, "dedup-window", cfg.DedupWindow,
+		"record only one of several same-sized results from a client within this window (0 disables)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout,
+		"close keep-alive connections idle for this long, logging each one")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout,
+		"abandon a download when one write blocks this long on a client that stopped reading (0 disables)")
+	fs.DurationVar(&cfg.UploadTimeout, "upload-timeout", cfg.UploadTimeout,
+		"refuse an upload with 408 once its body has taken this long to arrive (0 disables)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout,
+		"on shutdown, wait this long for in-flight requests before closing them (overrides $SHUTDOWN_TIMEOUT)")
+	fs.DurationVar(&cfg.InjectLatency, "inject-latency", cfg.InjectLatency,
+		"testing only: delay every request by this long to simulate a distant server (0 disables)")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert,
+		"PEM certificate file to serve HTTPS with; requires -tls-key")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey,
+		"PEM private key file of -tls-cert")
+	fs.BoolVar(&cfg.CheckConfig, "check-config", cfg.CheckConfig,
+		"validate the configuration and check the port is free, then exit without serving")
+	fs.StringVar(&cfg.Replay, "replay", cfg.Replay,
+		"replay the requests of this JSON profile against -replay-target and report the results, instead of serving")
+	fs.StringVar(&cfg.ReplayTarget, "replay-target", cfg.ReplayTarget,
+		"base URL of the server -replay sends its requests to")
+	return fs
+}
+
+// parseWritePattern parses a comma-separated list of write sizes. The sizes
+// are checked against the other settings by validate.
+func parseWritePattern(value string) ([]int, error) {
+	var pattern []int
+	for _, field := range strings.Split(value, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid write size %q", field)
+		}
+		pattern = append(pattern, size)
+	}
+	return pattern, nil
+}
+
+// headerFlag is a repeatable flag collecting "Name: Value" headers.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var entries []string
+	for name, values := range h {
+		for _, value := range values {
+			entries = append(entries, name+": "+value)
+		}
+	}
+	return strings.Join(entries, ", ")
+}
+
+func (h headerFlag) Set(entry string) error {
+	name, value, ok := strings.Cut(entry, ":")
+	if !ok {
+		return fmt.Errorf("header %q must be in \"Name: Value\" form", entry)
+	}
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !validHeaderName(name) {
+		return fmt.Errorf("header %q has an invalid name", entry)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("header %q value must not contain line breaks", entry)
+	}
+	http.Header(h).Add(name, value)
+	return nil
+}
+
+// validHeaderName reports whether name is a valid HTTP header field name
+// (an RFC 9110 token).
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > 0x7e || !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validFilename reports whether name is safe to quote in a
+// Content-Disposition header: a plain file name of letters, digits, dots,
+// hyphens and underscores, with no path or quoting characters.
+func validFilename(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > 255 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.ContainsRune("._-", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks that the configuration values are usable.
+func (c *Config) validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.TCPEchoPort < 0 || c.TCPEchoPort > 65535 || c.TCPEchoPort == c.Port {
+		return fmt.Errorf("tcp-echo-port must be 0 or a port between 1 and 65535 other than port %d, got %d", c.Port, c.TCPEchoPort)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+	if len(c.AllowedOrigins) == 0 {
+		return errors.New("allowed-origins must list at least one origin")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || origin != u.Scheme+"://"+u.Host {
+			return fmt.Errorf("allowed-origins entry %q must be a scheme and host such as https://speed.example.com", origin)
+		}
+	}
+	if c.Replay != "" {
+		if u, err := url.Parse(c.ReplayTarget); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("replay-target must be an http or https URL such as http://localhost:8080, got %q", c.ReplayTarget)
+		}
+	}
+	if c.CORSMaxAge < 0 {
+		return fmt.Errorf("cors-max-age must not be negative, got %v", c.CORSMaxAge)
+	}
+	if c.GatewaySecret != "" && c.GatewayHeader == "" {
+		return errors.New("gateway-header must not be empty when gateway-secret is set")
+	}
+	if c.SymmetricRatio < 1 {
+		return fmt.Errorf("symmetric-ratio must be at least 1, got %v", c.SymmetricRatio)
+	}
+	if c.RatePrecision < 0 || c.RatePrecision > maxRatePrecision {
+		return fmt.Errorf("rate-precision must be between 0 and %d, got %d", maxRatePrecision, c.RatePrecision)
+	}
+	if c.DownloadSizeJitter < 0 {
+		return fmt.Errorf("download-size-jitter must not be negative, got %d", c.DownloadSizeJitter)
+	}
+	if c.LogFormat != logFormatText && c.LogFormat != logFormatJSON {
+		return fmt.Errorf("log-format must be %s or %s, got %q", logFormatText, logFormatJSON, c.LogFormat)
+	}
+	if c.LogSlowMs < 0 {
+		return fmt.Errorf("log-slow-ms must not be negative, got %d", c.LogSlowMs)
+	}
+	if c.MaxDownloadBytes < minDownloadBytes {
+		return fmt.Errorf("max-download-bytes must be at least %d, got %d", minDownloadBytes, c.MaxDownloadBytes)
+	}
+	if c.DownloadBytes < minDownloadBytes || c.DownloadBytes > c.MaxDownloadBytes {
+		return fmt.Errorf("download-bytes must be between %d and max-download-bytes (%d), got %d", minDownloadBytes, c.MaxDownloadBytes, c.DownloadBytes)
+	}
+	if c.MaxUploadBytes <= 0 {
+		return fmt.Errorf("max-upload-bytes must be positive, got %d", c.MaxUploadBytes)
+	}
+	if c.MaxWSConns < 0 {
+		return fmt.Errorf("max-ws-conns must not be negative, got %d", c.MaxWSConns)
+	}
+	if c.MaxWSConnsPerClient < 0 {
+		return fmt.Errorf("max-ws-conns-per-client must not be negative, got %d", c.MaxWSConnsPerClient)
+	}
+	if c.MaxURLBytes <= 0 {
+		return fmt.Errorf("max-url-bytes must be positive, got %d", c.MaxURLBytes)
+	}
+	if c.InstanceID != "" && (len(c.InstanceID) > maxInstanceIDLen || !validFilename(c.InstanceID)) {
+		return fmt.Errorf("instance-id %q must be at most %d letters, digits, '.', '-' and '_'", c.InstanceID, maxInstanceIDLen)
+	}
+	if c.DownloadFilename != "" && !validFilename(c.DownloadFilename) {
+		return fmt.Errorf("download-filename %q must contain only letters, digits, '.', '-' and '_'", c.DownloadFilename)
+	}
+	if c.MarkerIntervalBytes < 2*progressMarkerLen {
+		return fmt.Errorf("marker-interval-bytes must be at least %d, got %d", 2*progressMarkerLen, c.MarkerIntervalBytes)
+	}
+	if c.ChunkBytes <= 0 {
+		return fmt.Errorf("chunk-bytes must be positive, got %d", c.ChunkBytes)
+	}
+	if c.MaxChunkBytes < c.ChunkBytes {
+		return fmt.Errorf("max-chunk-bytes must be at least chunk-bytes (%d), got %d", c.ChunkBytes, c.MaxChunkBytes)
+	}
+	if len(c.WritePattern) > maxWritePatternLen {
+		return fmt.Errorf("write-pattern must have at most %d sizes, got %d", maxWritePatternLen, len(c.WritePattern))
+	}
+	for _, size := range c.WritePattern {
+		if size < minWriteSize || size > c.MaxChunkBytes {
+			return fmt.Errorf("write-pattern sizes must be between %d and max-chunk-bytes (%d), got %d", minWriteSize, c.MaxChunkBytes, size)
+		}
+	}
+	if c.BufferPoolSize < 0 {
+		return fmt.Errorf("buffer-pool-size must not be negative, got %d", c.BufferPoolSize)
+	}
+	if c.DedupWindow < 0 {
+		return fmt.Errorf("dedup-window must not be negative, got %v", c.DedupWindow)
+	}
+	if c.IdleTimeout <= 0 {
+		return fmt.Errorf("idle-timeout must be positive, got %v", c.IdleTimeout)
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("write-timeout must not be negative, got %v", c.WriteTimeout)
+	}
+	if c.UploadTimeout < 0 {
+		return fmt.Errorf("upload-timeout must not be negative, got %v", c.UploadTimeout)
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown-timeout must be positive, got %v", c.ShutdownTimeout)
+	}
+	if c.InjectLatency < 0 {
+		return fmt.Errorf("inject-latency must not be negative, got %v", c.InjectLatency)
+	}
+	if c.ClientMetrics < 0 {
+		return fmt.Errorf("client-metrics must not be negative, got %d", c.ClientMetrics)
+	}
+	if c.ClientMetricsLabel != clientLabelIP && c.ClientMetricsLabel != clientLabelSession {
+		return fmt.Errorf("client-metrics-label must be %s or %s, got %q", clientLabelIP, clientLabelSession, c.ClientMetricsLabel)
+	}
+	if c.DownloadTokenTTL <= 0 {
+		return fmt.Errorf("download-token-ttl must be positive, got %v", c.DownloadTokenTTL)
+	}
+	if c.RateLimit <= 0 {
+		return fmt.Errorf("rate-limit must be positive, got %d", c.RateLimit)
+	}
+	if c.RateWindow <= 0 {
+		return fmt.Errorf("rate-window must be positive, got %v", c.RateWindow)
+	}
+	if c.RateBurst < 0 {
+		return fmt.Errorf("rate-burst must not be negative, got %d", c.RateBurst)
+	}
+	if c.RateBurst > 0 && c.RateAlgorithm != "token-bucket" {
+		return fmt.Errorf("rate-burst only applies to -rate-algorithm token-bucket, got %q", c.RateAlgorithm)
+	}
+	if c.SubnetRateLimit < 0 {
+		return fmt.Errorf("subnet-rate-limit must not be negative, got %d", c.SubnetRateLimit)
+	}
+	if c.SubnetMaxInFlight < 0 {
+		return fmt.Errorf("subnet-max-inflight must not be negative, got %d", c.SubnetMaxInFlight)
+	}
+	if c.SubnetV4Prefix < 1 || c.SubnetV4Prefix > 32 {
+		return fmt.Errorf("subnet-v4-prefix must be between 1 and 32, got %d", c.SubnetV4Prefix)
+	}
+	if c.SubnetV6Prefix < 1 || c.SubnetV6Prefix > 128 {
+		return fmt.Errorf("subnet-v6-prefix must be between 1 and 128, got %d", c.SubnetV6Prefix)
+	}
+	if c.PingRateLimit <= 0 {
+		return fmt.Errorf("ping-rate-limit must be positive, got %d", c.PingRateLimit)
+	}
+	if _, ok := rateLimitAlgorithms[c.RateAlgorithm]; !ok {
+		return fmt.Errorf("unknown rate-algorithm %q", c.RateAlgorithm)
+	}
+	return nil
+}
+
+// validateConfig runs the checks of -check-config: the configuration must
+// be valid and the server must be able to listen on addr. It goes beyond
+// validate by touching the environment, so it is not run on every start.
+func validateConfig(cfg *Config, addr string) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	for name, value := range map[string]string{"otel-endpoint": cfg.OTelEndpoint, "webhook-url": cfg.WebhookURL} {
+		if value == "" {
+			continue
+		}
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%s %q is not an absolute URL", name, value)
+		}
+	}
+
+	if cfg.PayloadFile != "" {
+		if _, err := loadPayloadFile(cfg.PayloadFile); err != nil {
+			return err
+		}
+	}
+	if cfg.tlsEnabled() {
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey); err != nil {
+			return fmt.Errorf("cannot load TLS certificate: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %w", addr, err)
+	}
+	defer listener.Close()
+	if cfg.TCPEchoPort > 0 {
+		echoListener, err := net.Listen("tcp", cfg.tcpEchoAddr())
+		if err != nil {
+			return fmt.Errorf("cannot listen on %s for tcp-echo-port: %w", cfg.tcpEchoAddr(), err)
+		}
+		echoListener.Close()
+	}
+	return nil
+}
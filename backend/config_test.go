@@ -0,0 +1,410 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useConfig applies change to a copy of the active configuration for the
+// duration of the test.
+func useConfig(t *testing.T, change func(cfg *Config)) {
+	previous := activeConfig
+	cfg := *previous
+	change(&cfg)
+	activeConfig = &cfg
+	t.Cleanup(func() { activeConfig = previous })
+}
+
+func TestHeaderFlag(t *testing.T) {
+	cfg, err := parseFlags([]string{"-header", "X-Deployment: blue", "-header", "Cache-Bypass:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	withHeaders(cfg.Headers, pingHandler)(w, httptest.NewRequest("GET", "/ping", nil))
+
+	if h := w.Header().Get("X-Deployment"); h != "blue" {
+		t.Errorf("expected X-Deployment blue, got %q", h)
+	}
+	if h := w.Header().Get("Cache-Bypass"); h != "1" {
+		t.Errorf("expected Cache-Bypass 1, got %q", h)
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestHeaderFlagMalformed(t *testing.T) {
+	for _, entry := range []string{"NoColon", ": empty-name", "Bad Name: value", "X-Split: a\r\nInjected: b"} {
+		t.Run(entry, func(t *testing.T) {
+			if _, err := parseFlags([]string{"-header", entry}); err == nil {
+				t.Errorf("expected malformed header %q to be rejected", entry)
+			}
+		})
+	}
+}
+
+func TestDownloadFilenameInjection(t *testing.T) {
+	for _, name := range []string{`a"b.bin`, "a\r\nX-Injected: b", "../etc/passwd", "a;b", ".."} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseFlags([]string{"-download-filename", name}); err == nil {
+				t.Errorf("expected download filename %q to be rejected", name)
+			}
+		})
+	}
+	if _, err := parseFlags([]string{"-download-filename", "speedtest.bin"}); err != nil {
+		t.Errorf("expected a plain file name to be accepted, got %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	tests := []struct {
+		name   string
+		args   []string
+		addr   string
+		wantOK bool
+	}{
+		{"Valid", []string{"-check-config"}, "127.0.0.1:0", true},
+		{"Port In Use", []string{"-check-config"}, occupied.Addr().String(), false},
+		{"Relative OTel Endpoint", []string{"-check-config", "-otel-endpoint", "collector:4318"}, "127.0.0.1:0", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseFlags(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cfg.CheckConfig {
+				t.Error("expected -check-config to be set")
+			}
+			if err := validateConfig(cfg, tt.addr); (err == nil) != tt.wantOK {
+				t.Errorf("expected valid=%v, got error %v", tt.wantOK, err)
+			}
+		})
+	}
+
+	cfg := defaultConfig()
+	cfg.SymmetricRatio = 0.5
+	if err := validateConfig(cfg, "127.0.0.1:0"); err == nil {
+		t.Error("expected an invalid configuration to be rejected")
+	}
+}
+
+func TestPortPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      string
+		args     []string
+		expected int
+		wantErr  bool
+	}{
+		{"Default", "", nil, 8080, false},
+		{"Environment", "9000", nil, 9000, false},
+		{"Flag Overrides Environment", "9000", []string{"-port", "9100"}, 9100, false},
+		{"Invalid Environment", "http", nil, 0, true},
+		{"Out Of Range Environment", "70000", nil, 0, true},
+		{"Out Of Range Flag", "", []string{"-port", "0"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PORT", tt.env)
+			cfg, err := parseFlags(tt.args)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got port %d", cfg.Port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Port != tt.expected {
+				t.Errorf("expected port %d, got %d", tt.expected, cfg.Port)
+			}
+		})
+	}
+}
+
+func TestMaxUploadBytesEnv(t *testing.T) {
+	t.Setenv("MAX_UPLOAD_BYTES", "2048")
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxUploadBytes != 2048 {
+		t.Errorf("expected MaxUploadBytes 2048 from the environment, got %d", cfg.MaxUploadBytes)
+	}
+
+	cfg, err = parseFlags([]string{"-max-upload-bytes", "4096"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxUploadBytes != 4096 {
+		t.Errorf("expected -max-upload-bytes to override the environment, got %d", cfg.MaxUploadBytes)
+	}
+
+	t.Setenv("MAX_UPLOAD_BYTES", "lots")
+	if _, err := parseFlags(nil); err == nil {
+		t.Error("expected an invalid MAX_UPLOAD_BYTES to be rejected")
+	}
+}
+
+func TestRateLimitEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "120")
+	t.Setenv("RATE_WINDOW", "30s")
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RateLimit != 120 || cfg.RateWindow != 30*time.Second {
+		t.Errorf("expected 120 requests per 30s from the environment, got %d per %v", cfg.RateLimit, cfg.RateWindow)
+	}
+
+	cfg, err = parseFlags([]string{"-rate-limit", "10", "-rate-window", "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RateLimit != 10 || cfg.RateWindow != time.Hour {
+		t.Errorf("expected the flags to override the environment, got %d per %v", cfg.RateLimit, cfg.RateWindow)
+	}
+
+	t.Setenv("RATE_WINDOW", "soon")
+	if _, err := parseFlags(nil); err == nil {
+		t.Error("expected an invalid RATE_WINDOW to be rejected")
+	}
+}
+
+func TestShutdownTimeoutEnv(t *testing.T) {
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ShutdownTimeout != 30*time.Second {
+		t.Errorf("expected a default shutdown timeout of 30s, got %v", cfg.ShutdownTimeout)
+	}
+
+	t.Setenv("SHUTDOWN_TIMEOUT", "2m")
+	if cfg, err = parseFlags(nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ShutdownTimeout != 2*time.Minute {
+		t.Errorf("expected a shutdown timeout of 2m from the environment, got %v", cfg.ShutdownTimeout)
+	}
+
+	for _, value := range []string{"soon", "0s"} {
+		t.Setenv("SHUTDOWN_TIMEOUT", value)
+		if _, err := parseFlags(nil); err == nil {
+			t.Errorf("expected SHUTDOWN_TIMEOUT=%s to be rejected", value)
+		}
+	}
+}
+
+func TestServerLocationEnv(t *testing.T) {
+	t.Setenv("SERVER_LOCATION", "eu-west-1")
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Location != "eu-west-1" {
+		t.Errorf("expected the location from the environment, got %q", cfg.Location)
+	}
+	if cfg, err = parseFlags([]string{"-server-location", "fra"}); err != nil || cfg.Location != "fra" {
+		t.Errorf("expected -server-location to override the environment, got %v", err)
+	}
+}
+
+func TestWritePatternFlag(t *testing.T) {
+	cfg, err := parseFlags([]string{"-write-pattern", "1500, 9000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.WritePattern) != 2 || cfg.WritePattern[0] != 1500 || cfg.WritePattern[1] != 9000 {
+		t.Errorf("expected the pattern [1500 9000], got %v", cfg.WritePattern)
+	}
+
+	for _, pattern := range []string{"1500,", "jumbo", "100", "1500,1048576"} {
+		if _, err := parseFlags([]string{"-write-pattern", pattern}); err == nil {
+			t.Errorf("expected write pattern %q to be rejected", pattern)
+		}
+	}
+}
+
+func TestTLSFlagsTogether(t *testing.T) {
+	for _, args := range [][]string{{"-tls-cert", "cert.pem"}, {"-tls-key", "key.pem"}} {
+		if _, err := parseFlags(args); err == nil {
+			t.Errorf("expected %v without its pair to be rejected", args)
+		}
+	}
+
+	cfg, err := parseFlags([]string{"-tls-cert", "cert.pem", "-tls-key", "key.pem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.tlsEnabled() {
+		t.Error("expected TLS to be enabled with both flags")
+	}
+	if err := validateConfig(cfg, "127.0.0.1:0"); err == nil {
+		t.Error("expected -check-config to reject missing certificate files")
+	}
+}
+
+func TestRateBurstFlag(t *testing.T) {
+	if _, err := parseFlags([]string{"-rate-burst", "10"}); err == nil {
+		t.Error("expected -rate-burst to be rejected with the sliding-window algorithm")
+	}
+
+	cfg, err := parseFlags([]string{"-rate-algorithm", "token-bucket", "-rate-limit", "60", "-rate-burst", "10", "-ping-rate-limit", "600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.rateBurst(cfg.RateLimit); got != 10 {
+		t.Errorf("expected a burst of 10, got %d", got)
+	}
+	if got := cfg.rateBurst(cfg.PingRateLimit); got != 100 {
+		t.Errorf("expected the ping burst scaled to 100, got %d", got)
+	}
+}
+
+func TestLogFormatEnv(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "json")
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogFormat != logFormatJSON {
+		t.Errorf("expected LOG_FORMAT to select %q, got %q", logFormatJSON, cfg.LogFormat)
+	}
+
+	t.Setenv("LOG_FORMAT", "xml")
+	if _, err := parseFlags(nil); err == nil {
+		t.Error("expected an unknown LOG_FORMAT to be rejected")
+	}
+}
+
+// writeConfigFile writes contents to a config file in a temporary
+// directory and returns its path.
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pinguen.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig(writeConfigFile(t, `{
+		"port": 9090,
+		"downloadBytes": 2048,
+		"rateLimit": 30,
+		"rateWindow": "30s",
+		"allowedOrigins": ["https://speed.example.com", "http://localhost:5173"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 9090 || cfg.DownloadBytes != 2048 || cfg.RateLimit != 30 || cfg.RateWindow != 30*time.Second {
+		t.Errorf("expected the file's settings, got port %d, %d download bytes and %d per %v", cfg.Port, cfg.DownloadBytes, cfg.RateLimit, cfg.RateWindow)
+	}
+	if len(cfg.AllowedOrigins) != 2 || cfg.AllowedOrigins[0] != "https://speed.example.com" {
+		t.Errorf("expected the file's origins, got %v", cfg.AllowedOrigins)
+	}
+	if defaults := defaultConfig(); cfg.MaxUploadBytes != defaults.MaxUploadBytes || cfg.MaxDownloadBytes != defaults.MaxDownloadBytes {
+		t.Error("expected settings missing from the file to keep their defaults")
+	}
+
+	tests := map[string]string{
+		"port":            `{"port": 0}`,
+		"numeric window":  `{"rateWindow": 60}`,
+		"bad window":      `{"rateWindow": "soon"}`,
+		"unknown setting": `{"rateLimt": 30}`,
+		"origin path":     `{"allowedOrigins": ["https://speed.example.com/app"]}`,
+		"no origins":      `{"allowedOrigins": []}`,
+		"download bytes":  `{"downloadBytes": 100}`,
+		"tls pair":        `{"tlsCert": "cert.pem"}`,
+		"not json":        `port = 9090`,
+	}
+	for name, contents := range tests {
+		if _, err := parseFlags([]string{"-config", writeConfigFile(t, contents)}); err == nil {
+			t.Errorf("%s: expected %s to be rejected", name, contents)
+		}
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected a missing config file to be rejected")
+	}
+}
+
+func TestConfigFlag(t *testing.T) {
+	path := writeConfigFile(t, `{"port": 9090, "rateLimit": 30, "maxUploadBytes": 2048}`)
+	t.Setenv("RATE_LIMIT", "45")
+
+	cfg, err := parseFlags([]string{"-max-upload-bytes", "4096", "-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 9090 {
+		t.Errorf("expected the port from the file, got %d", cfg.Port)
+	}
+	if cfg.RateLimit != 45 {
+		t.Errorf("expected the environment to override the file, got a rate limit of %d", cfg.RateLimit)
+	}
+	if cfg.MaxUploadBytes != 4096 {
+		t.Errorf("expected the flag to override the file, got %d", cfg.MaxUploadBytes)
+	}
+
+	if _, err := parseFlags([]string{"-config", writeConfigFile(t, `{"port": 70000}`)}); err == nil {
+		t.Error("expected an invalid config file to be rejected")
+	}
+
+	// Settings are only validated once merged, so the flags can complete
+	// or correct the file
+	merged := map[string][]string{
+		"tls pair":       {"-config", writeConfigFile(t, `{"tlsCert": "cert.pem"}`), "-tls-key", "key.pem"},
+		"download bytes": {"-config", writeConfigFile(t, `{"downloadBytes": 209715200}`), "-max-download-bytes", "209715200"},
+	}
+	for name, args := range merged {
+		if _, err := parseFlags(args); err != nil {
+			t.Errorf("%s: expected the flags to complete the file, got %v", name, err)
+		}
+	}
+}
+
+func TestAllowedOriginsFlag(t *testing.T) {
+	cfg, err := parseFlags([]string{"-allowed-origins", "https://speed.example.com, https://www.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.AllowedOrigins) != 2 || cfg.AllowedOrigins[1] != "https://www.example.com" {
+		t.Errorf("expected two origins, got %v", cfg.AllowedOrigins)
+	}
+
+	if _, err := parseFlags([]string{"-allowed-origins", "speed.example.com"}); err == nil {
+		t.Error("expected an origin without a scheme to be rejected")
+	}
+}
+
+func TestReplayTargetFlag(t *testing.T) {
+	cfg, err := parseFlags([]string{"-replay", "profile.json", "-replay-target", "https://speed.example.com"})
+	if err != nil || cfg.Replay != "profile.json" || cfg.ReplayTarget != "https://speed.example.com" {
+		t.Errorf("expected the replay flags to be parsed, got %q, %q and %v", cfg.Replay, cfg.ReplayTarget, err)
+	}
+	for _, target := range []string{"localhost:8080", "ftp://speed.example.com", "http://"} {
+		if _, err := parseFlags([]string{"-replay", "profile.json", "-replay-target", target}); err == nil {
+			t.Errorf("expected replay target %q to be rejected", target)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Package main provides protocol overhead estimates for the speed test server.
+// This file contains the on-wire byte estimate that distinguishes
+// application goodput from raw throughput.
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	// tcpSegmentPayload is the TCP payload per segment on a 1500-byte MTU
+	// path with the timestamp option, the common case on the internet
+	tcpSegmentPayload = 1448
+	// tcpIPHeaderBytes is the IPv4 and TCP header size of each segment,
+	// including the 12-byte timestamp option
+	tcpIPHeaderBytes = 52
+	// chunkTerminatorBytes is the "0\r\n\r\n" ending a chunked body
+	chunkTerminatorBytes = 5
+	// dateHeaderBytes is the Date header net/http adds to every response
+	dateHeaderBytes = len("Date: Mon, 02 Jan 2006 15:04:05 GMT\r\n")
+)
+
+// wantsOverhead reports whether the client asked for on-wire estimates
+// with ?overhead=1.
+func wantsOverhead(r *http.Request) bool {
+	return r.URL.Query().Get("overhead") == "1"
+}
+
+// headerBytes returns the size of an HTTP/1.1 header block: start line,
+// one "Name: value" line per field and the blank line ending it.
+func headerBytes(startLine string, h http.Header) int64 {
+	n := int64(len(startLine)) + 2
+	for name, values := range h {
+		for _, value := range values {
+			n += int64(len(name)+len(value)) + 4
+		}
+	}
+	return n + 2
+}
+
+// chunkFramingBytes returns the chunked transfer-coding overhead of sending
+// payload bytes in the given number of chunks: each chunk's hex size line
+// and trailing CRLF, plus the terminating chunk.
+func chunkFramingBytes(payload, chunks int64) int64 {
+	if chunks <= 0 {
+		return 0
+	}
+	sizeLine := int64(len(strconv.FormatInt(payload/chunks, 16)))
+	return chunks*(sizeLine+4) + chunkTerminatorBytes
+}
+
+// estimateWireBytes estimates the bytes an HTTP message occupies on the
+// wire: its header block, payload and chunk framing, split into TCP
+// segments that each carry IP and TCP headers. TLS records, ACKs and
+// retransmissions are not counted.
+func estimateWireBytes(headers, payload, framing int64) int64 {
+	stream := headers + payload + framing
+	segments := (stream + tcpSegmentPayload - 1) / tcpSegmentPayload
+	return stream + segments*tcpIPHeaderBytes
+}
+
+// setWireEstimate reports a download's payload size in X-Payload-Bytes and
+// its estimated size on the wire in X-Wire-Bytes-Estimate. It must be
+// called once the other response headers are set. Chunked responses are
+// assumed to be framed once per chunkSize write.
+func setWireEstimate(h http.Header, r *http.Request, size, chunkSize int) {
+	payload := int64(size)
+	h.Set("X-Payload-Bytes", strconv.FormatInt(payload, 10))
+	// Count the estimate's own header at roughly its final length
+	h.Set("X-Wire-Bytes-Estimate", strconv.FormatInt(payload, 10))
+
+	var framing int64
+	if h.Get("Content-Length") == "" {
+		framing = chunkFramingBytes(payload, (payload+int64(chunkSize)-1)/int64(chunkSize))
+	}
+	headers := headerBytes(r.Proto+" 200 OK", h) + int64(dateHeaderBytes)
+	h.Set("X-Wire-Bytes-Estimate", strconv.FormatInt(estimateWireBytes(headers, payload, framing), 10))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// plausibleOverhead checks that wire exceeds payload by the TCP/IP header
+// share of a full-size segment, plus a little for HTTP headers and framing.
+func plausibleOverhead(t *testing.T, payload, wire int64) {
+	t.Helper()
+	low := payload + payload*tcpIPHeaderBytes/tcpSegmentPayload
+	high := payload + payload/10
+	if wire <= low || wire > high {
+		t.Errorf("expected wire estimate in (%d, %d] for %d payload bytes, got %d", low, high, payload, wire)
+	}
+}
+
+func TestDownloadWireEstimate(t *testing.T) {
+	for _, target := range []string{"/download?bytes=1048576&overhead=1", "/download?bytes=1048576&overhead=1&gzip=1"} {
+		t.Run(target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			downloadHandler(w, httptest.NewRequest("GET", target, nil))
+
+			if strings.Contains(target, "gzip") {
+				if h := w.Header().Get("X-Wire-Bytes-Estimate"); h != "" {
+					t.Errorf("expected no estimate for compressed downloads, got %q", h)
+				}
+				return
+			}
+
+			payload, err := strconv.ParseInt(w.Header().Get("X-Payload-Bytes"), 10, 64)
+			if err != nil || payload != 1048576 {
+				t.Fatalf("expected X-Payload-Bytes 1048576, got %q", w.Header().Get("X-Payload-Bytes"))
+			}
+			wire, err := strconv.ParseInt(w.Header().Get("X-Wire-Bytes-Estimate"), 10, 64)
+			if err != nil {
+				t.Fatalf("expected X-Wire-Bytes-Estimate, got %q", w.Header().Get("X-Wire-Bytes-Estimate"))
+			}
+			plausibleOverhead(t, payload, wire)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	downloadHandler(w, httptest.NewRequest("GET", "/download?bytes=1024", nil))
+	if h := w.Header().Get("X-Wire-Bytes-Estimate"); h != "" {
+		t.Errorf("expected no estimate without ?overhead=1, got %q", h)
+	}
+}
+
+func TestUploadWireEstimate(t *testing.T) {
+	const size = 1024 * 1024
+	tests := []struct {
+		name    string
+		chunked bool
+	}{
+		{"Content-Length", false},
+		{"Chunked", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(strings.Repeat("a", size))
+			if tt.chunked {
+				// Hide the length so the request is sent chunked
+				body = io.MultiReader(body)
+			}
+			req := httptest.NewRequest("POST", "/upload?overhead=1", body)
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			uploadHandler(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			var response UploadResponse
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.PayloadBytes != size {
+				t.Errorf("expected payloadBytes %d, got %d", size, response.PayloadBytes)
+			}
+			plausibleOverhead(t, response.PayloadBytes, response.WireBytesEstimate)
+		})
+	}
+}
+
+func TestChunkFramingBytes(t *testing.T) {
+	// Four 4096-byte chunks: "1000\r\n" + data + "\r\n" each, then "0\r\n\r\n"
+	if got := chunkFramingBytes(16384, 4); got != 4*8+5 {
+		t.Errorf("expected 37 framing bytes, got %d", got)
+	}
+	if got := chunkFramingBytes(1024, 0); got != 0 {
+		t.Errorf("expected no framing without chunks, got %d", got)
+	}
+}
@@ -1,36 +1,68 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
-	"io"
+	"time"
 )
 
 func TestDownloadHandlerErrors(t *testing.T) {
 	tests := []struct {
 		name           string
 		method         string
+		target         string
 		expectedStatus int
 	}{
 		{
 			name:           "Invalid Method",
 			method:         "POST",
+			target:         "/download",
 			expectedStatus: http.StatusMethodNotAllowed,
 		},
+		{
+			name:           "Invalid Size",
+			method:         "GET",
+			target:         "/download?bytes=lots",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Invalid Gzip Level",
+			method:         "GET",
+			target:         "/download?gzip=12",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Invalid Write Size",
+			method:         "GET",
+			target:         "/download?writeSize=1",
+			expectedStatus: http.StatusBadRequest,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest(tt.method, "/download", nil)
+			req := httptest.NewRequest(tt.method, tt.target, nil)
 			w := httptest.NewRecorder()
-			
+
 			downloadHandler(w, req)
 
 			if w.Code != tt.expectedStatus {
 				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
 			}
+			// Every invalid parameter gets the same JSON error body
+			if tt.expectedStatus == http.StatusBadRequest && w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("expected a JSON error, got Content-Type %q", w.Header().Get("Content-Type"))
+			}
 		})
 	}
 }
@@ -38,26 +70,41 @@ func TestDownloadHandlerErrors(t *testing.T) {
 func TestUploadHandlerErrors(t *testing.T) {
 	tests := []struct {
 		name           string
+		target         string
 		body           io.Reader
 		expectedStatus int
 	}{
 		{
 			name:           "Empty Body",
+			target:         "/upload",
 			body:           strings.NewReader(""),
 			expectedStatus: http.StatusBadRequest,
 		},
 		{
 			name:           "Invalid Body",
+			target:         "/upload",
 			body:           &errorReader{},
 			expectedStatus: http.StatusInternalServerError,
 		},
+		{
+			name:           "Invalid Target",
+			target:         "/upload?target=abc",
+			body:           strings.NewReader("data"),
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Target Above Cap",
+			target:         fmt.Sprintf("/upload?target=%d", defaultMaxUploadBytes+1),
+			body:           strings.NewReader("data"),
+			expectedStatus: http.StatusBadRequest,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest("POST", "/upload", tt.body)
+			req := httptest.NewRequest("POST", tt.target, tt.body)
 			w := httptest.NewRecorder()
-			
+
 			uploadHandler(w, req)
 
 			if w.Code != tt.expectedStatus {
@@ -67,9 +114,303 @@ func TestUploadHandlerErrors(t *testing.T) {
 	}
 }
 
+func TestUploadTooLarge(t *testing.T) {
+	const limit = 1024
+	useConfig(t, func(cfg *Config) { cfg.MaxUploadBytes = limit })
+
+	tests := []struct {
+		name string
+		body io.Reader
+	}{
+		// The declared length is refused before the body is read
+		{"Content-Length", strings.NewReader(strings.Repeat("a", limit+1))},
+		// A body of unknown length is cut off once it passes the limit
+		{"Chunked", io.MultiReader(strings.NewReader(strings.Repeat("a", limit+1)))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			uploadHandler(w, httptest.NewRequest("POST", "/upload", tt.body))
+
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+			}
+		})
+	}
+
+	// Uploads at the limit are still measured
+	w := httptest.NewRecorder()
+	uploadHandler(w, httptest.NewRequest("POST", "/upload", io.MultiReader(strings.NewReader(strings.Repeat("a", limit)))))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d at the limit, got %d", http.StatusOK, w.Code)
+	}
+}
+
 // errorReader is a helper that always returns an error
 type errorReader struct{}
 
 func (e *errorReader) Read(p []byte) (n int, err error) {
 	return 0, io.ErrUnexpectedEOF
 }
+
+func TestFaviconHandler(t *testing.T) {
+	limiter := newRateLimiter(defaultRateLimit, defaultRateWindow)
+	mux := newMux(defaultConfig(), limiter, newLoadMonitor(0, 0, 0))
+
+	req := httptest.NewRequest("GET", "/favicon.ico", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if n := len(limiter.requests[addrHost(req.RemoteAddr)]); n != 0 {
+		t.Errorf("expected favicon to leave the rate budget untouched, got %d recorded requests", n)
+	}
+}
+
+func TestStreamPayloadProgress(t *testing.T) {
+	// partialFill fills at most limit bytes per call, like a short read
+	partialFill := func(limit int) func([]byte) (int, error) {
+		return func(p []byte) (int, error) {
+			return min(len(p), limit), nil
+		}
+	}
+
+	tests := []struct {
+		name   string
+		size   int
+		buffer int
+		fill   func([]byte) (int, error)
+	}{
+		{"Exact Multiple", 4096, 1024, partialFill(1024)},
+		{"Remainder", 4097, 1024, partialFill(1024)},
+		{"Smaller Than Buffer", 10, 1024, partialFill(1024)},
+		{"Short Fills", 1000, 64, partialFill(7)},
+		{"Single Byte Fills", 300, 64, partialFill(1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			n, err := streamPayload(context.Background(), &out, make([]byte, tt.buffer), tt.size, tt.fill)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.size || out.Len() != tt.size {
+				t.Errorf("expected %d bytes, wrote %d (reported %d)", tt.size, out.Len(), n)
+			}
+		})
+	}
+}
+
+func TestStreamPayloadStopsWithoutProgress(t *testing.T) {
+	calls := 0
+	stalled := func(p []byte) (int, error) {
+		calls++
+		if calls > 2 {
+			return 0, nil
+		}
+		return len(p), nil
+	}
+
+	var out bytes.Buffer
+	n, err := streamPayload(context.Background(), &out, make([]byte, 16), 1024, stalled)
+	if !errors.Is(err, errPayloadSource) {
+		t.Fatalf("expected errPayloadSource, got %v", err)
+	}
+	if n != 32 || calls != 3 {
+		t.Errorf("expected to stop after 32 bytes and 3 fills, got %d bytes and %d fills", n, calls)
+	}
+}
+
+func TestDownloadAbortsOnPayloadSourceFailure(t *testing.T) {
+	previous := payloadSource
+	t.Cleanup(func() { payloadSource = previous })
+	calls := 0
+	payloadSource = func(p []byte) (int, error) {
+		calls++
+		if calls > 64 {
+			return 0, errors.New("entropy exhausted")
+		}
+		return len(p), nil
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(downloadHandler))
+	defer server.Close()
+
+	for _, target := range []string{"/download", "/download?gzip=1"} {
+		t.Run(target, func(t *testing.T) {
+			calls = 0
+			resp, err := http.Get(server.URL + target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected the original status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err == nil {
+				t.Errorf("expected the truncated stream to fail, read %d bytes cleanly", len(body))
+			}
+			if bytes.Contains(body, []byte("Internal Server Error")) {
+				t.Error("error response was written into the stream")
+			}
+		})
+	}
+}
+
+func TestUnusualMethodsRejected(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DebugToken = "secret"
+	mux := newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	routes := []struct {
+		path  string
+		allow string
+	}{
+		{"/ping", "GET, HEAD, OPTIONS"},
+		{"/ping/burst", "GET, OPTIONS"},
+		{"/multiping", "GET, OPTIONS"},
+		{"/rtt", "GET, OPTIONS"},
+		{"/download", "GET, OPTIONS"},
+		{"/download/adaptive", "GET, OPTIONS"},
+		{"/upload", "POST, OPTIONS"},
+		{"/loadtest", "GET, OPTIONS"},
+		{"/session/abc", "GET, OPTIONS"},
+		{"/session/abc/verdict", "GET, OPTIONS"},
+		{"/capabilities", "GET, OPTIONS"},
+		{"/history", "GET, OPTIONS"},
+		{"/status", "GET, HEAD, OPTIONS"},
+		{"/debug/vars", "GET, OPTIONS"},
+		{"/favicon.ico", "GET, OPTIONS"},
+	}
+
+	for _, route := range routes {
+		for _, method := range []string{http.MethodTrace, http.MethodConnect} {
+			t.Run(method+" "+route.path, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, httptest.NewRequest(method, route.path, nil))
+
+				if w.Code != http.StatusMethodNotAllowed {
+					t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+				}
+				if got := w.Header().Get("Allow"); got != route.allow {
+					t.Errorf("expected Allow %q, got %q", route.allow, got)
+				}
+			})
+		}
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	for _, path := range []string{"/ping", "/status"} {
+		t.Run(path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodHead, path, nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected Content-Type application/json, got %q", ct)
+			}
+			if n, err := strconv.Atoi(w.Header().Get("Content-Length")); err != nil || n <= 0 {
+				t.Errorf("expected the Content-Length of the GET body, got %q", w.Header().Get("Content-Length"))
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("expected an empty body, got %d bytes", w.Body.Len())
+			}
+		})
+	}
+}
+
+// slowWriter is a ResponseRecorder for a client reading slowly: each write
+// takes delay, and one that would still be pending at the write deadline
+// fails with os.ErrDeadlineExceeded once it passes, as on a real
+// connection.
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	delay    time.Duration
+	deadline time.Time
+	writes   int
+}
+
+func (w *slowWriter) SetWriteDeadline(deadline time.Time) error {
+	w.deadline = deadline
+	return nil
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	if !w.deadline.IsZero() && time.Now().Add(w.delay).After(w.deadline) {
+		time.Sleep(time.Until(w.deadline))
+		return 0, os.ErrDeadlineExceeded
+	}
+	time.Sleep(w.delay)
+	w.writes++
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestDownloadSlowClient(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.WriteTimeout = 100 * time.Millisecond })
+	previous := payloadSource
+	t.Cleanup(func() { payloadSource = previous })
+	fills := 0
+	payloadSource = func(p []byte) (int, error) {
+		fills++
+		return len(p), nil
+	}
+
+	// A slow client gets the whole download, generated write by write
+	w := &slowWriter{ResponseRecorder: httptest.NewRecorder(), delay: 5 * time.Millisecond}
+	downloadHandler(w, httptest.NewRequest("GET", "/download?bytes=10240&writeSize=1024", nil))
+	if w.Body.Len() != 10240 {
+		t.Fatalf("expected the slow client to receive 10240 bytes, got %d", w.Body.Len())
+	}
+	if fills != w.writes {
+		t.Errorf("expected one fill per write, got %d fills for %d writes", fills, w.writes)
+	}
+	if !w.deadline.IsZero() {
+		t.Error("expected the write deadline to be cleared after the download")
+	}
+
+	// A client that stops reading is given up on at the deadline
+	fills = 0
+	w = &slowWriter{ResponseRecorder: httptest.NewRecorder(), delay: time.Hour}
+	start := time.Now()
+	downloadHandler(w, httptest.NewRequest("GET", "/download?bytes=10240&writeSize=1024", nil))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the download to end at the 100ms write deadline, took %v", elapsed)
+	}
+	if fills != 1 || w.Body.Len() != 0 {
+		t.Errorf("expected a single fill for the stuck write, got %d fills and %d bytes written", fills, w.Body.Len())
+	}
+}
+
+func TestStatusServerMetadata(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.Location = "us-east-1" })
+	previous := startTime
+	startTime = time.Now().Add(-time.Minute)
+	t.Cleanup(func() { startTime = previous })
+
+	w := httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/status", nil))
+	var response StatusResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Location != "us-east-1" {
+		t.Errorf("expected location us-east-1, got %q", response.Location)
+	}
+	if hostname, err := os.Hostname(); err == nil && response.Hostname != hostname {
+		t.Errorf("expected hostname %q, got %q", hostname, response.Hostname)
+	}
+	if response.UptimeSeconds < 60 || response.UptimeSeconds > 120 {
+		t.Errorf("expected about a minute of uptime, got %vs", response.UptimeSeconds)
+	}
+}
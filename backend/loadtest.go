@@ -0,0 +1,167 @@
+// Package main provides the latency-under-load test for the speed test server.
+// This file contains the /loadtest handler and its latency sampler.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	// loadTestChunkSize is the size of each write while generating load
+	loadTestChunkSize = 32 * 1024
+	// loadTestSampleInterval is how often responsiveness is sampled while
+	// the download is running
+	loadTestSampleInterval = 10 * time.Millisecond
+)
+
+// LoadTestSummary reports the result of a latency-under-load test. It is
+// sent in the X-Loadtest-Summary trailer once the download has finished.
+type LoadTestSummary struct {
+	// BytesSent is the number of payload bytes streamed to the client
+	BytesSent int64 `json:"bytesSent"`
+	// DurationMs is how long the download ran in milliseconds
+	DurationMs int64 `json:"durationMs"`
+	// Mbps is the achieved throughput in megabits per second, or 0 if
+	// ?units=bytes was requested
+	Mbps float64 `json:"mbps"`
+	// MBps is the achieved throughput in megabytes per second, or 0
+	// unless ?units=bytes was requested
+	MBps float64 `json:"MBps"`
+	// Latency is the distribution of responsiveness delays observed while
+	// the download was running
+	Latency LatencySummary `json:"latency"`
+}
+
+// LatencySummary describes a distribution of latency samples in milliseconds.
+type LatencySummary struct {
+	Samples int     `json:"samples"`
+	MinMs   float64 `json:"minMs"`
+	P50Ms   float64 `json:"p50Ms"`
+	P90Ms   float64 `json:"p90Ms"`
+	MaxMs   float64 `json:"maxMs"`
+}
+
+// summarizeLatency computes the distribution of the given samples.
+func summarizeLatency(samples []time.Duration) LatencySummary {
+	if len(samples) == 0 {
+		return LatencySummary{}
+	}
+
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	percentile := func(p float64) float64 { return ms(sorted[int(p*float64(len(sorted)-1))]) }
+
+	return LatencySummary{
+		Samples: len(sorted),
+		MinMs:   ms(sorted[0]),
+		P50Ms:   percentile(0.5),
+		P90Ms:   percentile(0.9),
+		MaxMs:   ms(sorted[len(sorted)-1]),
+	}
+}
+
+// sampleResponsiveness measures how late a periodic wake-up fires compared
+// to its schedule until stop is closed. Under load, the extra delay reflects
+// queueing in the server while it is busy pushing data.
+func sampleResponsiveness(stop <-chan struct{}, results chan<- []time.Duration) {
+	var samples []time.Duration
+	timer := time.NewTimer(loadTestSampleInterval)
+	defer timer.Stop()
+
+	scheduled := time.Now().Add(loadTestSampleInterval)
+	for {
+		select {
+		case <-stop:
+			results <- samples
+			return
+		case <-timer.C:
+			samples = append(samples, time.Since(scheduled))
+			scheduled = time.Now().Add(loadTestSampleInterval)
+			timer.Reset(loadTestSampleInterval)
+		}
+	}
+}
+
+// loadTestHandler returns a handler that streams random data for the given
+// duration while sampling responsiveness, giving a one-call bufferbloat
+// measurement. The summary is delivered in the X-Loadtest-Summary trailer.
+func loadTestHandler(duration time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		units, err := parseUnits(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		buffer := downloadBuffers.get(loadTestChunkSize)
+		defer downloadBuffers.put(buffer)
+		if _, err := payloadSource(buffer); err != nil {
+			log.Printf("Error generating random data: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Trailer", "X-Loadtest-Summary")
+		flusher, _ := w.(http.Flusher)
+
+		stop := make(chan struct{})
+		results := make(chan []time.Duration, 1)
+		go sampleResponsiveness(stop, results)
+
+		startTime := time.Now()
+		deadline := startTime.Add(duration)
+		var bytesSent int64
+
+	stream:
+		for time.Now().Before(deadline) {
+			select {
+			case <-r.Context().Done():
+				break stream
+			case <-shuttingDown(r):
+				// End early with the summary of what was measured
+				break stream
+			default:
+			}
+
+			n, err := w.Write(buffer)
+			bytesSent += int64(n)
+			if err != nil {
+				log.Printf("Error writing response: %v", err)
+				break
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		elapsed := time.Since(startTime)
+		close(stop)
+		transferTotals.downloadBytes.Add(bytesSent)
+
+		summary := LoadTestSummary{
+			BytesSent:  bytesSent,
+			DurationMs: elapsed.Milliseconds(),
+			Latency:    summarizeLatency(<-results),
+		}
+		rate := roundRate(transferRate(bytesSent, elapsed, units))
+		if units == unitsBytes {
+			summary.MBps = rate
+		} else {
+			summary.Mbps = rate
+		}
+
+		encoded, _ := json.Marshal(summary)
+		w.Header().Set("X-Loadtest-Summary", string(encoded))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoadTestHandler(t *testing.T) {
+	req := httptest.NewRequest("GET", "/loadtest", nil)
+	w := httptest.NewRecorder()
+	downloaded := transferTotals.downloadBytes.Load()
+
+	loadTestHandler(200*time.Millisecond)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	trailer := w.Result().Trailer.Get("X-Loadtest-Summary")
+	if trailer == "" {
+		t.Fatal("expected X-Loadtest-Summary trailer")
+	}
+
+	var summary LoadTestSummary
+	if err := json.Unmarshal([]byte(trailer), &summary); err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.BytesSent != int64(w.Body.Len()) {
+		t.Errorf("expected BytesSent %d, got %d", w.Body.Len(), summary.BytesSent)
+	}
+	if got := transferTotals.downloadBytes.Load() - downloaded; got != summary.BytesSent {
+		t.Errorf("expected the %d bytes sent to count towards the download total, got %d", summary.BytesSent, got)
+	}
+	if summary.Mbps <= 0 {
+		t.Error("expected non-zero throughput")
+	}
+	if summary.Latency.Samples == 0 {
+		t.Error("expected latency-under-load samples")
+	}
+	if summary.Latency.P50Ms > summary.Latency.MaxMs || summary.Latency.MinMs > summary.Latency.P50Ms {
+		t.Errorf("latency distribution out of order: %+v", summary.Latency)
+	}
+}
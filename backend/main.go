@@ -4,23 +4,55 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
-	"crypto/rand"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	mathrand "math/rand/v2"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel"
 )
 
 const (
 	// downloadSize defines the size of the data stream for download speed testing
-	// Currently set to 10MB (10 * 1024 * 1024 bytes)
+	// Currently set to 10MB (10 * 1024 * 1024 bytes), unless overridden with
+	// -download-bytes
 	downloadSize = 10 * 1024 * 1024
+	// minDownloadBytes is the smallest download size accepted via ?bytes=
+	minDownloadBytes = 1024
+	// maxTestDuration caps the time window requested via ?duration= on
+	// downloads and uploads
+	maxTestDuration = 30 * time.Second
+	// defaultMaxDownloadBytes is the default cap on the size requested via ?bytes=
+	defaultMaxDownloadBytes = 100 * 1024 * 1024
+	// defaultMaxUploadBytes is the default cap on the size of an upload body
+	defaultMaxUploadBytes = 100 * 1024 * 1024
+	// defaultChunkSize is the default download write size for clients without an RTT hint
+	defaultChunkSize = 32 * 1024
+	// minWriteSize is the smallest download write size accepted via
+	// ?writeSize= or -write-pattern
+	minWriteSize = 512
+	// maxWritePatternLen bounds the number of sizes in -write-pattern
+	maxWritePatternLen = 64
+	// downloadFlushBytes is how much a download writes between flushes, so
+	// the client sees steady progress
+	downloadFlushBytes = 256 * 1024
+	// rttChunkStep is the increase in client RTT that doubles the download write size
+	rttChunkStep = 50 * time.Millisecond
 )
 
 // PingResponse represents the response structure for the ping endpoint.
@@ -28,6 +60,9 @@ const (
 type PingResponse struct {
 	// Timestamp is a Unix timestamp in nanoseconds
 	Timestamp int64 `json:"timestamp"`
+	// Warmup marks a /ping/burst sample sent only to warm up the
+	// connection, which the client should leave out of its statistics
+	Warmup bool `json:"warmup,omitempty"`
 }
 
 // UploadResponse represents the response structure for the upload endpoint.
@@ -36,12 +71,92 @@ type UploadResponse struct {
 	// BytesUploaded is the total number of bytes received
 	BytesUploaded int64 `json:"bytesUploaded"`
 	// Duration is the time taken for the upload in milliseconds
-	Duration      int64 `json:"duration"`
+	Duration int64 `json:"duration"`
+	// FirstByteMs is the time spent waiting for the first byte of the body
+	FirstByteMs int64 `json:"firstByteMs"`
+	// TransferMs is the time from the first byte to the end of the body
+	TransferMs int64 `json:"transferMs"`
+	// Mbps is the upload rate in megabits per second, computed from the
+	// full-precision duration. It is 0 if ?units=bytes was requested.
+	Mbps float64 `json:"mbps"`
+	// MBps is the upload rate in megabytes per second, or 0 unless
+	// ?units=bytes was requested
+	MBps float64 `json:"MBps"`
+	// ConnectionReused is true if the upload arrived on a keep-alive
+	// connection that had already served a request. Warm connections
+	// typically yield higher throughput.
+	ConnectionReused bool `json:"connectionReused"`
+	// WindowMs is the longest the server reads the body for, requested
+	// with ?duration=
+	WindowMs int64 `json:"windowMs,omitempty"`
+	// WindowExpired is true if the client was still sending when the
+	// window ended, so only the bytes received within it were counted
+	WindowExpired bool `json:"windowExpired,omitempty"`
+	// PayloadBytes is the body size excluding protocol overhead, reported
+	// with ?overhead=1
+	PayloadBytes int64 `json:"payloadBytes,omitempty"`
+	// WireBytesEstimate estimates the bytes the request occupied on the
+	// wire, including HTTP headers, chunk framing and TCP/IP headers,
+	// reported with ?overhead=1
+	WireBytesEstimate int64 `json:"wireBytesEstimate,omitempty"`
+	// Samples is the progress of the body after each chunk, reported with
+	// ?detailed=true
+	Samples []UploadSample `json:"samples,omitempty"`
+	// ContentEncoding is "gzip" for a compressed body, in which case
+	// BytesUploaded and the rate count the compressed bytes as sent
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	// DecompressedBytes is the logical size of a compressed body
+	DecompressedBytes int64 `json:"decompressedBytes,omitempty"`
+}
+
+// ErrorResponse represents the JSON body returned for rejected requests.
+type ErrorResponse struct {
+	// Error is a human-readable description of why the request failed
+	Error string `json:"error"`
+	// RetryAfter is the suggested back-off in seconds, when applicable
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// writeJSON responds with v encoded as JSON. HEAD requests get the same
+// headers, including the Content-Length of the body, but no body, so
+// monitoring tools can check liveness cheaply.
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(body)
+}
+
+// writeError responds with status and an ErrorResponse carrying message.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+}
+
+// originAllowed reports whether origin is in the CORS allowlist.
+func originAllowed(origin string) bool {
+	for _, allowed := range activeConfig.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
 }
 
 // enableCORS is a middleware that adds CORS headers to responses.
-// It allows cross-origin requests from the frontend development server
-// and sets appropriate cache and connection headers.
+// It allows cross-origin requests from the origins in -allowed-origins
+// and sets appropriate cache headers.
 //
 // Parameters:
 //   - next: The next handler in the middleware chain
@@ -50,15 +165,25 @@ type UploadResponse struct {
 //   - An http.HandlerFunc that handles CORS and forwards to the next handler
 func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		origin := activeConfig.AllowedOrigins[0]
+		if o := r.Header.Get("Origin"); originAllowed(o) {
+			origin = o
+		}
+
 		// Set common headers
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Client-RTT")
+		w.Header().Set("Access-Control-Expose-Headers", "X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After, "+rejectedByHeader+", "+instanceIDHeader+", "+downloadPushHeader+", "+tlsResumedHeader)
 		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
 
-		// Handle preflight requests
+		// Handle preflight requests, which browsers may cache for the max
+		// age rather than repeat before every cross-origin upload
 		if r.Method == "OPTIONS" {
+			if maxAge := int(activeConfig.CORSMaxAge.Seconds()); maxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -67,6 +192,38 @@ func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// requireOrigin is a middleware that rejects requests whose Origin header
+// is missing or not in the CORS allowlist with 403 Forbidden. Browsers
+// always send Origin on cross-origin uploads, so this restricts an endpoint
+// to the configured frontends at the cost of blocking non-browser clients.
+func requireOrigin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !originAllowed(r.Header.Get("Origin")) {
+			w.Header().Set(rejectedByHeader, "origin")
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireGatewaySecret is a middleware that rejects requests with 403
+// Forbidden unless their header carries secret. A CDN or gateway that adds
+// the header to the requests it forwards thereby becomes the only way to
+// reach the server; the comparison takes constant time so the secret can't
+// be guessed from response timings.
+func requireGatewaySecret(header, secret string, next http.HandlerFunc) http.HandlerFunc {
+	expected := []byte(secret)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(header)), expected) != 1 {
+			w.Header().Set(rejectedByHeader, "gateway")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
 // pingHandler responds with the current server timestamp in nanoseconds.
 // This endpoint is used to measure network latency between client and server.
 //
@@ -76,50 +233,434 @@ func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 // 3. Recording local time T3 after the response
 // 4. Latency = (T3 - T1) - (T3 - T2)
 func pingHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
 	response := PingResponse{
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: clock().UnixNano(),
 	}
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, r, response)
 }
 
-// downloadHandler streams a fixed-size (10MB) random data file to the client.
-// This endpoint is used to measure download speed by timing how long it takes
-// to receive the complete file.
+// downloadHandler streams a random data file to the client, 10MB unless
+// the client asks for a different size with ?bytes=. This endpoint is used
+// to measure download speed by timing how long it takes to receive the
+// complete file.
 //
 // The handler:
 // 1. Sets appropriate headers for streaming binary data
 // 2. Generates random data in chunks to simulate a real file download
-// 3. Streams the data to the client in an efficient manner
+// 3. Streams the data to the client in an efficient manner, flushing the
+// headers early and hinting proxies not to buffer the response
+//
+// As a diagnostic, clients may pass ?gzip=<1-9> to have the payload gzipped
+// at that level. This deliberately transforms the body, so the response is
+// marked with an X-Diagnostic header and must not be used as a normal
+// speed measurement.
+//
+// When size jitter is configured, a small random amount is added to the
+// requested size and the actual size is reported in X-Download-Bytes.
+//
+// Downloads smaller than the configured reliability threshold finish too
+// quickly to give a meaningful rate, so they are marked with
+// X-Measurement-Reliable: false.
 func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	size, err := parseDownloadSize(r, activeConfig.MaxDownloadBytes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	duration, err := parseTestDuration(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sendDownload(w, r, size, duration)
+}
+
+// sendDownload streams a size-byte payload, applying the diagnostic and
+// size-jitter options of the request, and records the result. A non-zero
+// duration streams for that long instead, whatever the size. It reports
+// the bytes sent and the time taken, and false if the transfer failed.
+func sendDownload(w http.ResponseWriter, r *http.Request, size int, duration time.Duration) (transferStats, bool) {
+	timed := duration > 0
+	if timed {
+		// The stream ends when the duration is up, not at a byte count
+		size = math.MaxInt
+	} else if jitter := activeConfig.DownloadSizeJitter; jitter > 0 {
+		// Pad the size so repeated identical requests are byte-distinct and
+		// can't be served from a cache keyed on URL and Content-Length.
+		size += mathrand.IntN(jitter + 1)
+		w.Header().Set("X-Download-Bytes", fmt.Sprintf("%d", size))
+	}
+
+	gzipLevel, err := parseGzipLevel(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return transferStats{}, false
+	}
+	fillMode, err := parseFill(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return transferStats{}, false
+	}
+	if fillMode == fillRandom && payloadFile != nil {
+		fillMode = fillFile
+	}
+	chunkSize, ok, err := parseWriteSize(r, activeConfig.MaxChunkBytes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return transferStats{}, false
+	}
+	// An explicit ?writeSize= takes precedence over -write-pattern
+	var pattern []int
+	if !ok {
+		if pattern = activeConfig.WritePattern; len(pattern) > 0 {
+			chunkSize = slices.Max(pattern)
+		} else {
+			chunkSize = downloadChunkSize(r, activeConfig.ChunkBytes, activeConfig.MaxChunkBytes)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", downloadSize))
+	w.Header().Set(downloadFillHeader, fillMode)
+	if name := activeConfig.DownloadFilename; name != "" {
+		// Diagnostic: some proxies and scanners treat named attachments
+		// differently from anonymous streams. The name was validated at
+		// startup, so it needs no escaping.
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	// Ask reverse proxies such as nginx not to buffer the stream, so the
+	// client measures the path to this server rather than to the proxy.
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	if timed {
+		// The size is only known once the duration is up
+	} else if size < activeConfig.ReliableDownloadBytes {
+		w.Header().Set("X-Measurement-Reliable", "false")
+		w.Header().Set("X-Recommended-Min-Bytes", fmt.Sprintf("%d", activeConfig.ReliableDownloadBytes))
+	} else {
+		w.Header().Set("X-Measurement-Reliable", "true")
+	}
+
+	sustained := wantsSustained(r)
+	var out io.Writer = w
+	if flusher, ok := w.(http.Flusher); ok {
+		out = &flushWriter{w: w, flusher: flusher, every: downloadFlushBytes}
+		if r.URL.Query().Get("nobuffer") == "1" {
+			// Trade throughput for latency by pushing every write to the
+			// client instead of letting net/http batch them
+			out = &flushWriter{w: w, flusher: flusher}
+		}
+	}
+	if gzipLevel != 0 {
+		// The compressed length is unknown up front, so the response is chunked.
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("X-Diagnostic", fmt.Sprintf("gzip level %d", gzipLevel))
+		gz, _ := gzip.NewWriterLevel(out, gzipLevel)
+		defer gz.Close()
+		out = gz
+	} else if !activeConfig.TCPInfo && !sustained && !timed {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+	}
+	if activeConfig.TCPInfo {
+		// The kernel's figures are only meaningful once the payload is
+		// sent, so they go in trailers, which require a chunked response.
+		w.Header().Add("Trailer", tcpRetransmitsHeader+", "+tcpRTTHeader)
+	}
+	if sustained {
+		w.Header().Add("Trailer", sustainedMbpsHeader)
+	}
+	if timed {
+		// Without a Content-Length the response is chunked, so the client
+		// still learns the size it should have received
+		w.Header().Add("Trailer", "X-Download-Bytes")
+	}
+
+	buffer := downloadBuffers.get(chunkSize)
+	defer downloadBuffers.put(buffer)
+	if wantsOverhead(r) && gzipLevel == 0 && !timed {
+		setWireEstimate(w.Header(), r, size, len(buffer))
+	}
+
+	if timeout := activeConfig.WriteTimeout; timeout > 0 {
+		// Clear the deadline afterwards, so it doesn't cut off the next
+		// response on a keep-alive connection
+		controller := http.NewResponseController(w)
+		defer controller.SetWriteDeadline(time.Time{})
+		out = &deadlineWriter{w: out, controller: controller, timeout: timeout}
+		controller.SetWriteDeadline(time.Now().Add(timeout))
+	}
+
+	// Send the headers right away so proxies start forwarding immediately
+	if flusher, ok := w.(http.Flusher); ok {
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+	}
+
+	startTime := clock()
 
-	buffer := make([]byte, 1024)
+	if wantsMarkers(r) {
+		out = &markerWriter{w: out, interval: activeConfig.MarkerIntervalBytes, size: size}
+	}
+	var progress *progressRecorder
+	if sustained {
+		milestoneSize := size
+		if timed {
+			// Space the milestones as for the largest fixed-size download
+			milestoneSize = activeConfig.MaxDownloadBytes
+		}
+		progress = newProgressRecorder(out, milestoneSize, startTime)
+		out = progress
+	}
+	fill := payloadSource
+	switch fillMode {
+	case fillZero:
+		fill = zeroFill
+	case fillFile:
+		fill = payloadFile.stream()
+	}
+	if len(pattern) > 0 {
+		fill = cycleWriteSizes(fill, pattern)
+	}
+	ctx := r.Context()
+	if timed {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+		// End the stream early, with its trailers, when the server shuts
+		// down rather than hold up the drain for the whole duration
+		go func() {
+			select {
+			case <-shuttingDown(r):
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	bytesWritten, err := streamPayload(ctx, out, buffer, size, fill)
+	transferTotals.downloadBytes.Add(int64(bytesWritten))
+	if timed && ctx.Err() != nil && errors.Is(err, ctx.Err()) && r.Context().Err() == nil {
+		// Running out of time, or the server shutting down, is how a timed
+		// download finishes
+		err = nil
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("Client stopped reading for %v after %d download bytes", activeConfig.WriteTimeout, bytesWritten)
+		} else if r.Context().Err() != nil && timed {
+			log.Printf("Client disconnected after %d bytes of a %v download", bytesWritten, duration)
+		} else if r.Context().Err() != nil {
+			log.Printf("Client disconnected after %d of %d download bytes", bytesWritten, size)
+		} else if errors.Is(err, errPayloadSource) {
+			// The status line is already sent, so an error response would
+			// corrupt the stream. Abort the connection instead, so the client
+			// sees a truncated download rather than a complete-looking one.
+			log.Printf("Error generating random data after %d bytes: %v", bytesWritten, err)
+			panic(http.ErrAbortHandler)
+		} else {
+			log.Printf("Error writing response: %v", err)
+		}
+		return transferStats{}, false
+	}
+
+	stats := transferStats{Bytes: int64(bytesWritten), Duration: clock().Sub(startTime)}
+	if activeConfig.TCPInfo {
+		setTCPInfo(w.Header(), r)
+	}
+	if timed {
+		w.Header().Set("X-Download-Bytes", fmt.Sprintf("%d", bytesWritten))
+	}
+	if progress != nil {
+		w.Header().Set(sustainedMbpsHeader, formatRate(progress.sustainedMbps()))
+	}
+	recordResult(r, "download", stats.Bytes, stats.Duration)
+	return stats, true
+}
+
+// flushWriter flushes the response once every bytes have been written
+// since the last flush, or after every write if every is zero.
+type flushWriter struct {
+	w         io.Writer
+	flusher   http.Flusher
+	every     int
+	unflushed int
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.unflushed += n
+	if f.unflushed >= f.every {
+		f.flusher.Flush()
+		f.unflushed = 0
+	}
+	return n, err
+}
+
+// deadlineWriter gives each write to the client timeout to complete. A
+// client that stops reading then ends its download with
+// os.ErrDeadlineExceeded instead of holding the handler forever, while a
+// merely slow client keeps going, as each write pushes the deadline back.
+type deadlineWriter struct {
+	w          io.Writer
+	controller *http.ResponseController
+	timeout    time.Duration
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.controller.SetWriteDeadline(time.Now().Add(d.timeout))
+	return d.w.Write(p)
+}
+
+// payloadSource fills download payloads with random data, cut from a
+// pattern generated once at startup. Tests replace it to simulate
+// generation failures.
+var payloadSource = newRandomPattern(payloadPatternSize).fill
+
+// errPayloadSource wraps failures to produce payload data, as opposed to
+// failures writing it to the client.
+var errPayloadSource = errors.New("payload source failed")
+
+// streamPayload writes exactly size bytes to out, refilling buffer from
+// fill for each chunk, and returns the number of bytes written.
+//
+// Data is generated lazily, one buffer at a time and only once out has
+// taken the previous one, so a slow client never makes the server generate
+// or buffer data ahead of it.
+//
+// Every iteration must make forward progress: if fill yields no data, the
+// stream ends with an error rather than spinning forever. It also stops
+// early with ctx's error once ctx is done, so a client that disconnects
+// does not keep the server producing data nobody receives.
+func streamPayload(ctx context.Context, out io.Writer, buffer []byte, size int, fill func([]byte) (int, error)) (int, error) {
 	bytesWritten := 0
 
-	for bytesWritten < downloadSize {
-		n, err := rand.Read(buffer)
+	for bytesWritten < size {
+		if err := ctx.Err(); err != nil {
+			return bytesWritten, err
+		}
+
+		n, err := fill(buffer)
 		if err != nil {
-			log.Printf("Error generating random data: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+			return bytesWritten, fmt.Errorf("%w: %v", errPayloadSource, err)
+		}
+
+		writeLen := min(n, size-bytesWritten)
+		if writeLen <= 0 {
+			return bytesWritten, fmt.Errorf("%w: no data produced after %d bytes", errPayloadSource, bytesWritten)
 		}
 
-		writeLen := min(n, downloadSize-bytesWritten)
-		_, err = w.Write(buffer[:writeLen])
+		written, err := out.Write(buffer[:writeLen])
+		bytesWritten += written
 		if err != nil {
-			log.Printf("Error writing response: %v", err)
-			return
+			return bytesWritten, err
 		}
+	}
 
-		bytesWritten += writeLen
+	return bytesWritten, nil
+}
+
+// cycleWriteSizes wraps fill so that successive fills produce the sizes of
+// pattern in turn, starting over at its end. streamPayload writes each
+// fill as one write, so the stream's writes follow the pattern. The buffer
+// passed to the fills must hold the largest size.
+func cycleWriteSizes(fill func([]byte) (int, error), pattern []int) func([]byte) (int, error) {
+	next := 0
+	return func(p []byte) (int, error) {
+		size := pattern[next]
+		next = (next + 1) % len(pattern)
+		return fill(p[:size])
+	}
+}
+
+// parseDownloadSize returns the payload size requested via ?bytes=,
+// clamped to between minDownloadBytes and maxBytes, or -download-bytes if
+// the client did not specify one.
+func parseDownloadSize(r *http.Request, maxBytes int) (int, error) {
+	value := r.URL.Query().Get("bytes")
+	if value == "" {
+		return activeConfig.DownloadBytes, nil
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("bytes must be a positive integer")
+	}
+	return min(max(size, minDownloadBytes), maxBytes), nil
+}
+
+// parseTestDuration returns the time window requested via ?duration=, in
+// seconds up to maxTestDuration, or 0 if the client asked for a transfer
+// of fixed size.
+func parseTestDuration(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("duration")
+	if value == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds <= 0 || seconds > maxTestDuration.Seconds() {
+		return 0, fmt.Errorf("duration must be a number of seconds greater than 0 and at most %d", int(maxTestDuration.Seconds()))
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// parseGzipLevel returns the diagnostic gzip level requested via ?gzip=,
+// or 0 if the client did not ask for compression.
+func parseGzipLevel(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("gzip")
+	if value == "" {
+		return 0, nil
+	}
+
+	level, err := strconv.Atoi(value)
+	if err != nil || level < gzip.BestSpeed || level > gzip.BestCompression {
+		return 0, fmt.Errorf("gzip level must be between %d and %d", gzip.BestSpeed, gzip.BestCompression)
+	}
+	return level, nil
+}
+
+// clientRTT returns the round-trip time the client reported in its
+// X-Client-RTT header or, failing that, its RTT client hint, both in
+// milliseconds.
+func clientRTT(r *http.Request) (time.Duration, bool) {
+	for _, header := range []string{"X-Client-RTT", "RTT"} {
+		ms, err := strconv.Atoi(r.Header.Get(header))
+		if err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+	}
+	return 0, false
+}
+
+// parseWriteSize returns the download write size requested via
+// ?writeSize=, which must be between minWriteSize and maxChunk, and false
+// if the client did not specify one.
+func parseWriteSize(r *http.Request, maxChunk int) (int, bool, error) {
+	value := r.URL.Query().Get("writeSize")
+	if value == "" {
+		return 0, false, nil
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size < minWriteSize || size > maxChunk {
+		return 0, false, fmt.Errorf("writeSize must be between %d and %d", minWriteSize, maxChunk)
 	}
+	return size, true, nil
+}
+
+// downloadChunkSize picks the download write size from the client's RTT
+// hint. High-latency links keep more data in flight, so the size doubles
+// from chunk for every rttChunkStep of RTT, up to maxChunk.
+func downloadChunkSize(r *http.Request, chunk, maxChunk int) int {
+	rtt, ok := clientRTT(r)
+	if !ok {
+		return chunk
+	}
+	doublings := min(int(rtt/rttChunkStep), 30)
+	return max(chunk, min(chunk<<doublings, maxChunk))
 }
 
 // uploadHandler receives and measures an upload stream from the client.
@@ -128,8 +669,8 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 //
 // The handler:
 // 1. Records the start time
-// 2. Efficiently reads and discards the uploaded data
-// 3. Calculates total bytes received and duration
+// 2. Efficiently reads and discards the uploaded data, stopping at ?target= bytes if given
+// 3. Calculates total bytes, time to first byte, transfer and total duration
 // 4. Returns timing information to the client
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -142,25 +683,332 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	startTime := time.Now()
+	units, err := parseUnits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	bytesUploaded, err := io.Copy(io.Discard, r.Body)
+	limit := activeConfig.MaxUploadBytes
+	target, err := parseUploadTarget(r, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	window, err := parseTestDuration(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > limit {
+		w.Header().Set(rejectedByHeader, "upload-limit")
+		http.Error(w, fmt.Sprintf("Upload exceeds the %d byte limit", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	startTime := clock()
+
+	// Bodies of unknown length are cut off at the limit as they are read
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	body := &timingReader{r: r.Body}
+	var measured io.Reader = body
+	// The read deadline unblocks a read from a client that stalls past the
+	// upload timeout, and the context stops one that trickles past it
+	var deadline time.Time
+	if timeout := activeConfig.UploadTimeout; timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		measured = &contextReader{ctx: ctx, r: measured}
+		http.NewResponseController(w).SetReadDeadline(deadline)
+	}
+	if target > 0 {
+		measured = io.LimitReader(measured, target)
+	}
+	var windowed *windowReader
+	if window > 0 {
+		// The client decides how long to send for; the window only caps it.
+		// The read deadline unblocks a read from a client that stalls.
+		windowed = &windowReader{r: measured, end: startTime.Add(window)}
+		measured = windowed
+		if end := time.Now().Add(window); deadline.IsZero() || end.Before(deadline) {
+			http.NewResponseController(w).SetReadDeadline(end)
+		}
+	}
+	var gunzip *gunzipCounter
+	if isGzipUpload(r) {
+		// The data is measured as sent, compressed, and decoded on the side
+		// for its logical size
+		gunzip = newGunzipCounter(limit)
+		measured = io.TeeReader(measured, gunzip)
+	}
+	var bytesUploaded int64
+	var samples []UploadSample
+	if wantsDetailed(r) {
+		bytesUploaded, samples, err = copySampled(measured, startTime)
+	} else {
+		bytesUploaded, err = io.Copy(io.Discard, measured)
+	}
+	transferTotals.uploadBytes.Add(bytesUploaded)
+	// A deadline hit at the upload timeout is a timeout; one hit before it
+	// can only be the end of the window
+	timedOut := errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, os.ErrDeadlineExceeded) && !deadline.IsZero() && !time.Now().Before(deadline)
+	if windowed != nil || !deadline.IsZero() {
+		http.NewResponseController(w).SetReadDeadline(time.Time{})
+	}
+	if windowed != nil && !timedOut && errors.Is(err, os.ErrDeadlineExceeded) {
+		windowed.expired, err = true, nil
+	}
+	var decompressedBytes int64
+	var decodeErr error
+	if gunzip != nil {
+		truncated := (target > 0 && bytesUploaded == target) || (windowed != nil && windowed.expired)
+		decompressedBytes, decodeErr = gunzip.finish(truncated)
+	}
+	if timedOut {
+		// Close the connection rather than wait for the rest of the body
+		w.Header().Set("Connection", "close")
+		w.Header().Set(rejectedByHeader, "upload-timeout")
+		http.Error(w, fmt.Sprintf("Upload did not finish within %v", activeConfig.UploadTimeout), http.StatusRequestTimeout)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.Header().Set(rejectedByHeader, "upload-limit")
+		http.Error(w, fmt.Sprintf("Upload exceeds the %d byte limit", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		log.Printf("Error reading upload data: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	if errors.Is(decodeErr, errDecompressedTooLarge) {
+		w.Header().Set(rejectedByHeader, "upload-limit")
+		http.Error(w, fmt.Sprintf("Decompressed upload exceeds the %d byte limit", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if decodeErr != nil {
+		http.Error(w, "Request body is not valid gzip", http.StatusBadRequest)
+		return
+	}
 
-	duration := time.Since(startTime).Milliseconds()
+	endTime := clock()
+	if target > 0 || (windowed != nil && windowed.expired) {
+		// Stop reading at the target or the end of the window; any excess
+		// the client sends is ignored
+		r.Body.Close()
+	}
 
-	w.Header().Set("Content-Type", "application/json")
 	response := UploadResponse{
-		BytesUploaded: bytesUploaded,
-		Duration:      duration,
+		BytesUploaded:    bytesUploaded,
+		Duration:         endTime.Sub(startTime).Milliseconds(),
+		ConnectionReused: connReused(r),
+		Samples:          samples,
+	}
+	if windowed != nil {
+		response.WindowMs = window.Milliseconds()
+		response.WindowExpired = windowed.expired
+	}
+	if gunzip != nil {
+		response.ContentEncoding = "gzip"
+		response.DecompressedBytes = decompressedBytes
+	}
+	if !body.firstByte.IsZero() {
+		response.FirstByteMs = body.firstByte.Sub(startTime).Milliseconds()
+		response.TransferMs = endTime.Sub(body.firstByte).Milliseconds()
 	}
+	if wantsOverhead(r) {
+		var framing int64
+		if r.ContentLength < 0 {
+			framing = chunkFramingBytes(bytesUploaded, body.reads)
+		}
+		headers := headerBytes(r.Method+" "+r.RequestURI+" "+r.Proto, r.Header)
+		response.PayloadBytes = bytesUploaded
+		response.WireBytesEstimate = estimateWireBytes(headers, bytesUploaded, framing)
+	}
+	rate := roundRate(transferRate(bytesUploaded, endTime.Sub(startTime), units))
+	if units == unitsBytes {
+		response.MBps = rate
+	} else {
+		response.Mbps = rate
+	}
+
+	recordResult(r, "upload", bytesUploaded, endTime.Sub(startTime))
+
+	if activeConfig.TCPInfo {
+		setTCPInfo(w.Header(), r)
+	}
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// parseUploadTarget returns the number of bytes the client asked the server
+// to measure via ?target=, up to limit, or 0 to measure the whole body.
+func parseUploadTarget(r *http.Request, limit int64) (int64, error) {
+	value := r.URL.Query().Get("target")
+	if value == "" {
+		return 0, nil
+	}
+
+	target, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || target <= 0 || target > limit {
+		return 0, fmt.Errorf("target must be between 1 and %d bytes", limit)
+	}
+	return target, nil
+}
+
+// Rate units accepted by the ?units= parameter
+const (
+	// unitsBits reports rates in megabits per second, as ISPs do
+	unitsBits = "bits"
+	// unitsBytes reports rates in megabytes per second
+	unitsBytes = "bytes"
+)
+
+// parseUnits returns the rate unit requested via ?units=, defaulting to bits.
+func parseUnits(r *http.Request) (string, error) {
+	switch units := r.URL.Query().Get("units"); units {
+	case "", unitsBits:
+		return unitsBits, nil
+	case unitsBytes:
+		return unitsBytes, nil
+	default:
+		return "", fmt.Errorf("units must be %q or %q", unitsBits, unitsBytes)
+	}
+}
+
+// transferRate converts bytes moved over duration into megabits per second
+// for unitsBits, or megabytes per second for unitsBytes. A zero duration
+// yields 0 rather than an infinite rate.
+func transferRate(bytes int64, duration time.Duration, units string) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	megabytes := float64(bytes) / 1e6 / duration.Seconds()
+	if units == unitsBytes {
+		return megabytes
+	}
+	return megabytes * 8
+}
+
+const (
+	// defaultRatePrecision is the decimal places of reported rates without
+	// -rate-precision, finer than any display needs
+	defaultRatePrecision = 2
+	// maxRatePrecision bounds -rate-precision
+	maxRatePrecision = 6
+)
+
+// roundRate rounds a rate to the -rate-precision decimal places it is
+// reported with. Rates are computed at full precision and only rounded
+// as they are written to a response.
+func roundRate(rate float64) float64 {
+	scale := math.Pow10(activeConfig.RatePrecision)
+	return math.Round(rate*scale) / scale
+}
+
+// formatRate formats a rate for a header with -rate-precision decimal
+// places.
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', activeConfig.RatePrecision, 64)
+}
+
+// recordResult saves a completed measurement to the result store, to the
+// client's session if the request named one with ?session=, to the
+// per-client gauges of -client-metrics, and queues it
+// for the webhook if one is configured.
+// Failures are logged rather than surfaced, as the test itself succeeded.
+//
+// With -dedup-window set, a result outside any session that duplicates a
+// recent one from the same client is dropped instead. Sessions are exempt,
+// as their parallel streams legitimately repeat each other.
+func recordResult(r *http.Request, kind string, bytes int64, duration time.Duration) {
+	result := Result{
+		Kind:       kind,
+		ClientIP:   clientIP(r),
+		Bytes:      bytes,
+		DurationMs: duration.Milliseconds(),
+		Timestamp:  clock(),
+	}
+	id, inSession := requestSession(r)
+	recorded, err := true, error(nil)
+	if window := activeConfig.DedupWindow; window > 0 && !inSession {
+		recorded, err = recordUnlessDuplicate(result, window)
+	} else {
+		err = store.Record(result)
+	}
+	if err != nil {
+		log.Printf("Error recording %s result: %v", kind, err)
+	}
+	if !recorded {
+		log.Printf("Dropping duplicate %s result from %s", kind, result.ClientIP)
+		return
+	}
+	if webhook != nil {
+		webhook.send(WebhookEvent{Result: result, Mbps: roundRate(transferRate(bytes, duration, unitsBits))})
+	}
+	if clientMetrics != nil {
+		clientMetrics.record(clientMetrics.client(r), kind, transferRate(bytes, duration, unitsBits))
+	}
+
+	if inSession {
+		sessions.record(id, kind, requestStream(r), bytes, duration)
+	}
+}
+
+// timingReader wraps an upload body and records when the first non-empty
+// read completed, so the upload can be split into waiting and transfer phases.
+type timingReader struct {
+	r         io.Reader
+	firstByte time.Time
+	// reads counts the non-empty reads, approximating the number of chunks
+	// of a chunked body
+	reads int64
+}
+
+func (t *timingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if t.firstByte.IsZero() {
+			t.firstByte = clock()
+		}
+		t.reads++
+	}
+	return n, err
+}
+
+// windowReader ends the body at end, measured on clock, so an upload is
+// counted only up to the end of its time window.
+type windowReader struct {
+	r       io.Reader
+	end     time.Time
+	expired bool
+}
+
+func (w *windowReader) Read(p []byte) (int, error) {
+	if !clock().Before(w.end) {
+		w.expired = true
+		return 0, io.EOF
+	}
+	return w.r.Read(p)
+}
+
+// contextReader fails every read with ctx's error once ctx is done, so a
+// copy from it stops between reads.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -168,40 +1016,292 @@ func min(a, b int) int {
 	return b
 }
 
-func main() {
+// faviconHandler answers the favicon request browsers make automatically
+// with an empty, cacheable response. It is registered without logging or
+// rate limiting so these requests don't add noise or use up a client's budget.
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StatusResponse represents the response structure for the status endpoint.
+type StatusResponse struct {
+	Status    string `json:"status"`
+	Version   string `json:"version"`
+	Timestamp string `json:"timestamp"`
+	// ClockDriftMs is how far the wall clock has moved relative to the
+	// monotonic clock since startup, in milliseconds
+	ClockDriftMs float64 `json:"clockDriftMs"`
+	// ClockMaxDriftMs is the largest drift observed since startup
+	ClockMaxDriftMs float64 `json:"clockMaxDriftMs"`
+	// ClockStable is false once the drift has exceeded clockSyncThreshold,
+	// meaning the wall clock was adjusted while the server was running and
+	// its timestamps may not be comparable
+	ClockStable bool `json:"clockStable"`
+	// InstanceID identifies the server instance that answered, as in the
+	// X-Instance-ID header
+	InstanceID string `json:"instanceId,omitempty"`
+	// Location is where the server runs, such as "us-east-1", from
+	// -server-location or SERVER_LOCATION
+	Location string `json:"location,omitempty"`
+	// Hostname is the host name reported by the operating system
+	Hostname string `json:"hostname,omitempty"`
+	// UptimeSeconds is the time since the server started
+	UptimeSeconds float64 `json:"uptimeSeconds"`
+}
+
+// startTime is when the server started, set in main, for the uptime in
+// /status.
+var startTime time.Time
+
+// statusHandler reports that the server is up, for health checks, along
+// with the drift of its clock and which server answered.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	drift, maxDrift := clockDrift.sample()
+	// An unknown host name is left out rather than failing the health check
+	hostname, _ := os.Hostname()
+
+	writeJSON(w, r, StatusResponse{
+		Status:          "ok",
+		Version:         "1.0.0",
+		Timestamp:       clock().Format(time.RFC3339),
+		ClockDriftMs:    float64(drift) / float64(time.Millisecond),
+		ClockMaxDriftMs: float64(maxDrift) / float64(time.Millisecond),
+		ClockStable:     maxDrift.Abs() < clockSyncThreshold,
+		InstanceID:      activeConfig.InstanceID,
+		Location:        activeConfig.Location,
+		Hostname:        hostname,
+		UptimeSeconds:   time.Since(startTime).Seconds(),
+	})
+}
+
+// newMux registers the server's routes with their middleware chains.
+func newMux(cfg *Config, limiter requestLimiter, load *loadMonitor) *http.ServeMux {
 	mux := http.NewServeMux()
-	limiter := newRateLimiter()
-	
+
+	// Methods each kind of route responds to, including CORS preflights
+	get := []string{http.MethodGet, http.MethodOptions}
+	getHead := []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	post := []string{http.MethodPost, http.MethodOptions}
+
+	// Middleware chains shared by the routes. API routes are rate limited,
+	// and speed tests are additionally shed when the server is overloaded.
+	// Latency probes are cheap and sent in quick succession, so they count
+	// against their own, more generous limit, and are neither shed nor
+	// counted as speed tests in flight.
+	route := func(pattern string, methods []string, handler http.HandlerFunc) {
+		handler = allowMethods(methods, handler)
+		if cfg.GatewaySecret != "" {
+			handler = requireGatewaySecret(cfg.GatewayHeader, cfg.GatewaySecret, handler)
+		}
+		handler = enableCORS(logRequest(withRecovery(withRouteStats(pattern, limitURLLength(cfg.MaxURLBytes, handler)))))
+		if cfg.OTelEndpoint != "" {
+			handler = withTracing(otel.GetTracerProvider(), pattern, handler)
+		}
+		mux.HandleFunc(pattern, handler)
+	}
+	// Networks are limited on top of their clients, so abuse spread over
+	// many addresses of one network is caught too
+	mask := subnetMask{v4Bits: cfg.SubnetV4Prefix, v6Bits: cfg.SubnetV6Prefix}
+	var subnetLimiter requestLimiter
+	if cfg.SubnetRateLimit > 0 {
+		subnetLimiter = rateLimitAlgorithms[cfg.RateAlgorithm](cfg.SubnetRateLimit, cfg.RateWindow, cfg.rateBurst(cfg.SubnetRateLimit))
+	}
+	var concurrency *subnetConcurrency
+	if cfg.SubnetMaxInFlight > 0 {
+		concurrency = newSubnetConcurrency(cfg.SubnetMaxInFlight)
+	}
+	perSubnet := func(handler http.HandlerFunc) http.HandlerFunc {
+		if subnetLimiter != nil {
+			handler = withSubnetRateLimit(mask, subnetLimiter, handler)
+		}
+		return handler
+	}
+	subnetTest := func(handler http.HandlerFunc) http.HandlerFunc {
+		if concurrency != nil {
+			handler = withSubnetConcurrency(mask, concurrency, handler)
+		}
+		return perSubnet(handler)
+	}
+	limited := func(pattern string, methods []string, handler http.HandlerFunc) {
+		route(pattern, methods, withRateLimit(limiter, perSubnet(handler)))
+	}
+	speedTest := func(pattern string, methods []string, handler http.HandlerFunc) {
+		route(pattern, methods, withLoadShedding(load, withRateLimit(limiter, subnetTest(handler))))
+	}
+	pingLimiter := rateLimitAlgorithms[cfg.RateAlgorithm](cfg.PingRateLimit, defaultRateWindow, cfg.rateBurst(cfg.PingRateLimit))
+	probe := func(pattern string, methods []string, handler http.HandlerFunc) {
+		route(pattern, methods, withRateLimit(pingLimiter, handler))
+	}
+
+	download, adaptiveDownload, pushDownload := downloadHandler, adaptiveDownloadHandler, downloadPushHandler
+	var budget *dailyBudget
+	if cfg.DailyDownloadCapGB > 0 {
+		budget = newDailyBudget(int64(cfg.DailyDownloadCapGB * 1e9))
+		download = withDailyCap(budget, download)
+		adaptiveDownload = withDailyCap(budget, adaptiveDownload)
+		pushDownload = withDailyCap(budget, pushDownload)
+	}
+	if cfg.DownloadTokenSecret != "" {
+		secret := []byte(cfg.DownloadTokenSecret)
+		download = requireToken(secret, download)
+		adaptiveDownload = requireToken(secret, adaptiveDownload)
+		pushDownload = requireToken(secret, pushDownload)
+		limited("/token", get, tokenHandler(secret, cfg.DownloadTokenTTL))
+	}
+	upload := uploadHandler
+	if cfg.RequireUploadOrigin {
+		upload = requireOrigin(upload)
+	}
+
 	// Register routes with middleware chain
-	mux.HandleFunc("/ping", enableCORS(logRequest(withRateLimit(limiter, pingHandler))))
-	mux.HandleFunc("/download", enableCORS(logRequest(withRateLimit(limiter, downloadHandler))))
-	mux.HandleFunc("/upload", enableCORS(logRequest(withRateLimit(limiter, uploadHandler))))
+	probe("/ping", getHead, pingHandler)
+	probe("/ping/burst", get, burstPingHandler)
+	probe("/multiping", get, multiPingHandler)
+	probe("/rtt", get, rttHandler)
+	speedTest("/download", get, download)
+	speedTest("/download/adaptive", get, adaptiveDownload)
+	speedTest("/download/push", get, pushDownload)
+	speedTest("/upload", post, upload)
+	speedTest("/loadtest", get, loadTestHandler(cfg.LoadTestDuration))
+	if cfg.MaxWSConns > 0 {
+		// A WebSocket stays open for many measurements, so on top of the
+		// speed test limits on its handshake it is capped by open
+		// connections, and each download over it is limited like a request
+		ws := wsHandler(cfg.MaxWSConns, cfg.MaxWSConnsPerClient, limiter, load, budget)
+		if budget != nil {
+			ws = withDailyCap(budget, ws)
+		}
+		speedTest("/ws", get, ws)
+	}
+
+	limited("/session/{id}", get, sessionHandler)
+	limited("/session/{id}/verdict", get, verdictHandler(cfg.SymmetricRatio))
+	limited("/capabilities", get, capabilitiesHandler(cfg))
+	limited("/capacity", get, capacityHandler(load, cpuLoad))
+	limited("/history", get, historyHandler)
 
 	// Add a status endpoint for health checks
-	mux.HandleFunc("/status", enableCORS(logRequest(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "ok",
-			"version": "1.0.0",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	})))
-
-	port := ":8080"
-	server := &http.Server{
-		Addr:    port,
-		Handler: mux,
-	}
-
-	// Channel to handle shutdown signals
-	stop := make(chan os.Signal, 1)
+	route("/status", getHead, statusHandler)
+
+	// Operational endpoints are not rate limited, logged or traced, but
+	// like every other route they are only reachable through the gateway
+	operational := func(pattern string, handler http.HandlerFunc) {
+		handler = allowMethods(get, handler)
+		if cfg.GatewaySecret != "" {
+			handler = requireGatewaySecret(cfg.GatewayHeader, cfg.GatewaySecret, handler)
+		}
+		mux.HandleFunc(pattern, handler)
+	}
+	operational("/metrics", metricsHandler)
+	if cfg.DebugToken != "" {
+		operational("/debug/vars", requireDebugToken(cfg.DebugToken, expvarHandler))
+		operational("/debug/ratelimit/top", requireDebugToken(cfg.DebugToken, rejectionTopHandler(rateLimitRejections)))
+	}
+	operational("/favicon.ico", faviconHandler)
+
+	return mux
+}
+
+func main() {
+	startTime = time.Now()
+	cfg, err := parseFlags(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+	activeConfig = cfg
+	downloadBuffers = newBufferPool(cfg.BufferPoolSize)
+	if cfg.PayloadFile != "" {
+		if payloadFile, err = loadPayloadFile(cfg.PayloadFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.WebhookURL != "" {
+		webhook = newWebhookDispatcher(cfg.WebhookURL)
+	}
+	if cfg.ClientMetrics > 0 {
+		clientMetrics = newClientGauges(cfg.ClientMetrics, cfg.ClientMetricsLabel)
+	}
+
+	port := cfg.addr()
+	if cfg.CheckConfig {
+		if err := validateConfig(cfg, port); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		os.Exit(0)
+	}
+	if cfg.Replay != "" {
+		if err := replay(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Replay failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.OTelEndpoint != "" {
+		shutdownTracing, err := setupTracing(context.Background(), cfg.OTelEndpoint)
+		if err != nil {
+			log.Fatalf("Tracing setup failed: %v", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				log.Printf("Error flushing traces: %v", err)
+			}
+		}()
+	}
+
+	limiter := rateLimitAlgorithms[cfg.RateAlgorithm](cfg.RateLimit, cfg.RateWindow, cfg.RateBurst)
+	load := newLoadMonitor(cfg.MaxInFlight, cfg.MaxEgressMbps, cfg.OverloadRetryAfter)
+	mux := newMux(cfg, limiter, load)
+
+	handlers := &inFlight{}
+	if cfg.InjectLatency > 0 {
+		log.Printf("WARNING: delaying every request by %v (-inject-latency); do not use in production", cfg.InjectLatency)
+	}
+
+	server := newServer(port, handlers.track(withInstanceID(cfg.InstanceID, withTLSResumed(withHeaders(cfg.Headers, withInjectedLatency(cfg.InjectLatency, mux.ServeHTTP))))), cfg.IdleTimeout)
+
+	if cfg.TCPEchoPort > 0 {
+		listener, err := net.Listen("tcp", cfg.tcpEchoAddr())
+		if err != nil {
+			log.Fatalf("TCP echo server failed to start: %v", err)
+		}
+		echo := newTCPEchoServer(listener, cfg.IdleTimeout)
+		// Stop taking probes when the HTTP server starts shutting down
+		server.RegisterOnShutdown(echo.shutdown)
+		go func() {
+			log.Printf("TCP echo server listening on port %d", cfg.TCPEchoPort)
+			echo.serve()
+		}()
+	}
+
+	stopDrift := make(chan struct{})
+	defer close(stopDrift)
+	go clockDrift.run(clockDriftInterval, stopDrift)
+
+	// Channel to handle shutdown signals, with room for a repeated signal
+	stop := make(chan os.Signal, 2)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
 	// Start server in a goroutine
 	go func() {
 		log.Printf("Server starting on port %s", port)
-		log.Printf("Available endpoints: /ping, /download, /upload, /status")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Available endpoints: /ping, /ping/burst, /multiping, /rtt, /download, /download/adaptive, /upload, /loadtest, /ws, /history, /capabilities, /capacity, /status, /debug/vars, /metrics")
+		var err error
+		if cfg.tlsEnabled() {
+			log.Printf("Serving HTTPS with certificate %s", cfg.TLSCert)
+			err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
 	}()
@@ -210,14 +1310,24 @@ func main() {
 	<-stop
 	log.Println("Shutting down server...")
 
-	// Create shutdown context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	// Attempt graceful shutdown
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
+	// Attempt graceful shutdown, waiting for in-flight tests to drain. A
+	// second signal while draining cuts the wait short.
+	stopper := newStopper(server, handlers, cfg.ShutdownTimeout)
+	go func() {
+		<-stop
+		stopper.stop()
+	}()
+	if stopper.stop() {
+		log.Println("Server stopped gracefully")
+	} else {
+		log.Println("Server forced to shutdown")
 	}
 
-	log.Println("Server stopped gracefully")
+	if webhook != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !webhook.close(ctx) {
+			log.Println("Timed out delivering queued webhook results")
+		}
+	}
 }
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -46,6 +55,7 @@ func TestPingHandler(t *testing.T) {
 // - Returns 200 OK status
 // - Sets correct Content-Length header
 // - Returns exactly downloadSize bytes of data
+// - Hints reverse proxies not to buffer the stream
 func TestDownloadHandler(t *testing.T) {
 	req, err := http.NewRequest("GET", "/download", nil)
 	if err != nil {
@@ -72,6 +82,13 @@ func TestDownloadHandler(t *testing.T) {
 	if len(body) != downloadSize {
 		t.Errorf("expected body length %v, got %v", downloadSize, len(body))
 	}
+
+	if h := rr.Header().Get("X-Accel-Buffering"); h != "no" {
+		t.Errorf("expected X-Accel-Buffering no, got %q", h)
+	}
+	if !rr.Flushed {
+		t.Error("expected response headers to be flushed early")
+	}
 }
 
 // TestUploadHandler verifies that the upload endpoint:
@@ -94,6 +111,63 @@ func (r *slowReader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// tricklingReader sends one byte every interval and never finishes, as a
+// slowloris client does.
+type tricklingReader struct {
+	interval time.Duration
+}
+
+func (r *tricklingReader) Read(p []byte) (int, error) {
+	time.Sleep(r.interval)
+	p[0] = 'a'
+	return 1, nil
+}
+
+func TestUploadTimeout(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.UploadTimeout = 50 * time.Millisecond })
+	for _, target := range []string{"/upload", "/upload?duration=5", "/upload?detailed=true", "/upload?target=1000000"} {
+		t.Run(target, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			start := time.Now()
+			uploadHandler(rr, httptest.NewRequest("POST", target, &tricklingReader{interval: 5 * time.Millisecond}))
+
+			if rr.Code != http.StatusRequestTimeout {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusRequestTimeout, rr.Code, rr.Body.String())
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("expected the upload to be cut off at the timeout, took %v", elapsed)
+			}
+			if rr.Header().Get("Connection") != "close" || rr.Header().Get(rejectedByHeader) != "upload-timeout" {
+				t.Errorf("expected the connection to be closed as an upload timeout, got headers %v", rr.Header())
+			}
+		})
+	}
+}
+
+func TestUploadTimeoutStalledClient(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.UploadTimeout = 50 * time.Millisecond })
+	server := httptest.NewServer(http.HandlerFunc(uploadHandler))
+	defer server.Close()
+
+	// Promise a body, send part of it and stop without closing
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: test\r\nContent-Length: 1000\r\n\r\npartial")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("expected status %d for a stalled upload, got %d", http.StatusRequestTimeout, resp.StatusCode)
+	}
+}
+
 func TestUploadHandler(t *testing.T) {
 	payload := strings.Repeat("a", 1024*10) // 10KB for test speed
 	body := &slowReader{data: []byte(payload)}
@@ -102,7 +176,7 @@ func TestUploadHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(payload)))
-	req.ContentLength = int64(len(payload)) 
+	req.ContentLength = int64(len(payload))
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(uploadHandler)
@@ -128,6 +202,105 @@ func TestUploadHandler(t *testing.T) {
 	}
 }
 
+func TestLogSlowRequests(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.LogSlowMs = 50 })
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	tests := []struct {
+		name   string
+		delay  time.Duration
+		status int
+		logged bool
+	}{
+		{"Fast", 0, http.StatusOK, false},
+		{"Slow", 60 * time.Millisecond, http.StatusOK, true},
+		{"Fast Error", 0, http.StatusInternalServerError, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			handler := logRequest(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.delay)
+				w.WriteHeader(tt.status)
+			})
+			handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/ping", nil))
+
+			if logged := strings.Contains(logs.String(), "GET /ping"); logged != tt.logged {
+				t.Errorf("expected logged=%v, got log %q", tt.logged, logs.String())
+			}
+		})
+	}
+}
+
+func TestLogRequestStatus(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	w := httptest.NewRecorder()
+	logRequest(downloadHandler)(w, httptest.NewRequest("POST", "/download", nil))
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	expected := fmt.Sprintf("POST /download 405 %dB ", w.Body.Len())
+	if !strings.Contains(logs.String(), expected) {
+		t.Errorf("expected the log line to contain %q, got %q", expected, logs.String())
+	}
+}
+
+func TestLogRequestJSON(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.LogFormat = logFormatJSON })
+
+	var logs bytes.Buffer
+	jsonRequestLog.SetOutput(&logs)
+	t.Cleanup(func() { jsonRequestLog.SetOutput(os.Stderr) })
+
+	handler := logRequest(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/ping", nil))
+
+	var entry requestLogEntry
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one JSON object per line, got %q: %v", logs.String(), err)
+	}
+	if entry.RemoteAddr != "192.0.2.1:1234" || entry.Method != "POST" || entry.Path != "/ping" {
+		t.Errorf("unexpected request fields in %+v", entry)
+	}
+	if entry.Status != http.StatusTeapot || entry.Bytes != int64(len("short and stout")) {
+		t.Errorf("expected status %d and %d bytes, got %+v", http.StatusTeapot, len("short and stout"), entry)
+	}
+	if entry.DurationMs < 0 || entry.Time == "" {
+		t.Errorf("expected a timestamp and duration, got %+v", entry)
+	}
+}
+
+func TestUploadTarget(t *testing.T) {
+	const target = 4096
+	payload := strings.Repeat("a", 3*target)
+	req := httptest.NewRequest("POST", fmt.Sprintf("/upload?target=%d", target), strings.NewReader(payload))
+
+	rr := httptest.NewRecorder()
+	uploadHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	var response UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.BytesUploaded != target {
+		t.Errorf("expected BytesUploaded %d, got %d", target, response.BytesUploaded)
+	}
+}
+
 // TestCORS verifies that the CORS middleware:
 // - Handles OPTIONS requests correctly
 // - Sets proper CORS headers
@@ -135,10 +308,10 @@ func TestUploadHandler(t *testing.T) {
 // - Forwards requests to next handler when appropriate
 func TestCORS(t *testing.T) {
 	testCases := []struct {
-		method           string
-		expectedHeaders  bool
-		expectedStatus   int
-		shouldCallNext   bool
+		method          string
+		expectedHeaders bool
+		expectedStatus  int
+		shouldCallNext  bool
 	}{
 		{"OPTIONS", true, http.StatusOK, false},
 		{"GET", true, http.StatusOK, true},
@@ -179,3 +352,736 @@ func TestCORS(t *testing.T) {
 		})
 	}
 }
+
+func TestCORSMaxAge(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		method   string
+		expected string
+	}{
+		{"Preflight", 24 * time.Hour, "OPTIONS", "86400"},
+		{"Configured", 10 * time.Minute, "OPTIONS", "600"},
+		{"Disabled", 0, "OPTIONS", ""},
+		// Only the preflight is cached; the request itself is not
+		{"Actual Request", 24 * time.Hour, "POST", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(cfg *Config) { cfg.CORSMaxAge = tt.maxAge })
+			rr := httptest.NewRecorder()
+			enableCORS(pingHandler)(rr, httptest.NewRequest(tt.method, "/upload", nil))
+			if h := rr.Header().Get("Access-Control-Max-Age"); h != tt.expected {
+				t.Errorf("expected Access-Control-Max-Age %q, got %q", tt.expected, h)
+			}
+		})
+	}
+}
+
+// TestDownloadHandlerGzip verifies that the diagnostic gzip mode:
+// - Marks the response as gzip-encoded and diagnostic
+// - Compresses at the requested level
+// - Still decompresses to exactly downloadSize bytes
+func TestDownloadHandlerGzip(t *testing.T) {
+	testCases := []struct {
+		level string
+		xfl   byte // gzip header XFL byte identifying the compression level
+	}{
+		{"1", 4},
+		{"9", 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run("level "+tc.level, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/download?gzip="+tc.level, nil)
+			rr := httptest.NewRecorder()
+			downloadHandler(rr, req)
+
+			if enc := rr.Header().Get("Content-Encoding"); enc != "gzip" {
+				t.Fatalf("expected Content-Encoding gzip, got %q", enc)
+			}
+			if diag := rr.Header().Get("X-Diagnostic"); diag != "gzip level "+tc.level {
+				t.Errorf("expected X-Diagnostic header for level %s, got %q", tc.level, diag)
+			}
+
+			body := rr.Body.Bytes()
+			if len(body) < 10 || body[8] != tc.xfl {
+				t.Fatalf("expected gzip header for level %s", tc.level)
+			}
+
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := io.Copy(io.Discard, zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != downloadSize {
+				t.Errorf("expected %d decompressed bytes, got %d", downloadSize, n)
+			}
+		})
+	}
+}
+
+// delayedReader waits before producing its data, simulating a client that
+// is slow to start sending.
+type delayedReader struct {
+	delay   time.Duration
+	data    io.Reader
+	started bool
+}
+
+func (r *delayedReader) Read(p []byte) (int, error) {
+	if !r.started {
+		time.Sleep(r.delay)
+		r.started = true
+	}
+	return r.data.Read(p)
+}
+
+// TestUploadHandlerTimingBreakdown verifies that the upload response:
+// - Reports the wait for the first byte separately
+// - Splits the total duration into first-byte and transfer phases
+func TestUploadHandlerTimingBreakdown(t *testing.T) {
+	delay := 50 * time.Millisecond
+	payload := strings.Repeat("a", 1024*10)
+	body := &delayedReader{delay: delay, data: &slowReader{data: []byte(payload)}}
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.ContentLength = int64(len(payload))
+
+	rr := httptest.NewRecorder()
+	uploadHandler(rr, req)
+
+	var response UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.FirstByteMs < delay.Milliseconds() {
+		t.Errorf("expected FirstByteMs >= %d, got %d", delay.Milliseconds(), response.FirstByteMs)
+	}
+	if response.TransferMs <= 0 {
+		t.Error("expected non-zero TransferMs")
+	}
+	if sum := response.FirstByteMs + response.TransferMs; sum > response.Duration+1 {
+		t.Errorf("phases (%dms) exceed total duration (%dms)", sum, response.Duration)
+	}
+}
+
+// TestRequireOrigin verifies that the Origin requirement:
+// - Allows requests from an allowlisted origin
+// - Rejects requests from other origins with 403
+// - Rejects requests without an Origin header with 403
+func TestRequireOrigin(t *testing.T) {
+	testCases := []struct {
+		name           string
+		origin         string
+		expectedStatus int
+	}{
+		{"Allowed Origin", "http://localhost:5173", http.StatusOK},
+		{"Disallowed Origin", "http://evil.example", http.StatusForbidden},
+		{"Absent Origin", "", http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/upload", strings.NewReader("data"))
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+
+			rr := httptest.NewRecorder()
+			requireOrigin(uploadHandler)(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestRequireGatewaySecret(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.GatewaySecret = "s3cret"
+	mux := newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	testCases := []struct {
+		name           string
+		path           string
+		secret         string
+		expectedStatus int
+	}{
+		{"Correct Secret", "/ping", "s3cret", http.StatusOK},
+		{"Wrong Secret", "/ping", "guess", http.StatusForbidden},
+		{"Absent Header", "/ping", "", http.StatusForbidden},
+		{"Operational Endpoint", "/metrics", "", http.StatusForbidden},
+		{"Operational Endpoint With Secret", "/metrics", "s3cret", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.path, nil)
+			if tc.secret != "" {
+				req.Header.Set("X-Gateway-Secret", tc.secret)
+			}
+
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if tc.expectedStatus == http.StatusForbidden && rr.Header().Get(rejectedByHeader) != "gateway" {
+				t.Errorf("expected %s: gateway, got %q", rejectedByHeader, rr.Header().Get(rejectedByHeader))
+			}
+		})
+	}
+}
+
+// TestDownloadHandlerReliability verifies that downloads below the
+// reliability threshold still succeed but are flagged as unreliable.
+func TestDownloadHandlerReliability(t *testing.T) {
+	testCases := []struct {
+		target   string
+		size     int
+		reliable string
+	}{
+		{"/download?bytes=1", minDownloadBytes, "false"},
+		{"/download", downloadSize, "true"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.target, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			downloadHandler(rr, httptest.NewRequest("GET", tc.target, nil))
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+			}
+			if rr.Body.Len() != tc.size {
+				t.Errorf("expected %d bytes, got %d", tc.size, rr.Body.Len())
+			}
+			if h := rr.Header().Get("X-Measurement-Reliable"); h != tc.reliable {
+				t.Errorf("expected X-Measurement-Reliable %s, got %q", tc.reliable, h)
+			}
+		})
+	}
+}
+
+// TestDownloadSizeClamp verifies that requested sizes are clamped to the
+// accepted range and that malformed sizes get a JSON error.
+func TestDownloadSizeClamp(t *testing.T) {
+	const maxBytes = 64 * 1024
+	useConfig(t, func(cfg *Config) { cfg.MaxDownloadBytes = maxBytes })
+
+	testCases := []struct {
+		target string
+		size   int
+	}{
+		{"/download?bytes=10", minDownloadBytes},
+		{"/download?bytes=4096", 4096},
+		{fmt.Sprintf("/download?bytes=%d", maxBytes+1), maxBytes},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.target, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			downloadHandler(rr, httptest.NewRequest("GET", tc.target, nil))
+
+			if rr.Body.Len() != tc.size {
+				t.Errorf("expected %d bytes, got %d", tc.size, rr.Body.Len())
+			}
+			if h := rr.Header().Get("Content-Length"); h != fmt.Sprint(tc.size) {
+				t.Errorf("expected Content-Length %d, got %q", tc.size, h)
+			}
+		})
+	}
+
+	for _, value := range []string{"lots", "-5", "0"} {
+		t.Run("bytes="+value, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			downloadHandler(rr, httptest.NewRequest("GET", "/download?bytes="+value, nil))
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected JSON error, got Content-Type %q", ct)
+			}
+			var response ErrorResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || response.Error == "" {
+				t.Errorf("expected an error message, got %v", err)
+			}
+		})
+	}
+}
+
+// TestDownloadHandlerSizeJitter verifies that with jitter enabled the served
+// size stays within the requested size plus the jitter bound and is reported.
+func TestDownloadHandlerSizeJitter(t *testing.T) {
+	const requested, jitter = 4096, 512
+	useConfig(t, func(cfg *Config) { cfg.DownloadSizeJitter = jitter })
+
+	for i := 0; i < 20; i++ {
+		rr := httptest.NewRecorder()
+		downloadHandler(rr, httptest.NewRequest("GET", fmt.Sprintf("/download?bytes=%d", requested), nil))
+
+		served := rr.Body.Len()
+		if served < requested || served > requested+jitter {
+			t.Fatalf("served %d bytes, expected between %d and %d", served, requested, requested+jitter)
+		}
+		if h := rr.Header().Get("X-Download-Bytes"); h != fmt.Sprint(served) {
+			t.Errorf("expected X-Download-Bytes %d, got %q", served, h)
+		}
+		if h := rr.Header().Get("Content-Length"); h != fmt.Sprint(served) {
+			t.Errorf("expected Content-Length %d, got %q", served, h)
+		}
+	}
+}
+
+// TestTransferRate verifies the unit conversion for each supported unit.
+func TestTransferRate(t *testing.T) {
+	testCases := []struct {
+		units    string
+		expected float64
+	}{
+		{unitsBits, 80},
+		{unitsBytes, 10},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.units, func(t *testing.T) {
+			// 20MB over 2 seconds
+			if got := transferRate(20_000_000, 2*time.Second, tc.units); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+
+	if got := transferRate(1000, 0, unitsBits); got != 0 {
+		t.Errorf("expected 0 for zero duration, got %v", got)
+	}
+}
+
+// TestUploadHandlerUnits verifies that ?units= selects which rate field
+// the upload response reports.
+func TestUploadHandlerUnits(t *testing.T) {
+	testCases := []struct {
+		target    string
+		wantMbps  bool
+		wantMBps  bool
+		wantError bool
+	}{
+		{"/upload", true, false, false},
+		{"/upload?units=bits", true, false, false},
+		{"/upload?units=bytes", false, true, false},
+		{"/upload?units=furlongs", false, false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.target, func(t *testing.T) {
+			payload := strings.Repeat("a", 1024*10)
+			req := httptest.NewRequest("POST", tc.target, &slowReader{data: []byte(payload)})
+			req.ContentLength = int64(len(payload))
+
+			rr := httptest.NewRecorder()
+			uploadHandler(rr, req)
+
+			if tc.wantError {
+				if rr.Code != http.StatusBadRequest {
+					t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+				}
+				return
+			}
+
+			var response UploadResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if (response.Mbps > 0) != tc.wantMbps || (response.MBps > 0) != tc.wantMBps {
+				t.Errorf("unexpected rate fields: Mbps=%v MBps=%v", response.Mbps, response.MBps)
+			}
+		})
+	}
+}
+
+// advancingReader advances a fake clock by step on its first read, so an
+// upload of its data takes exactly step.
+type advancingReader struct {
+	data  *strings.Reader
+	clock *fakeClock
+	step  time.Duration
+	moved bool
+}
+
+func (a *advancingReader) Read(p []byte) (int, error) {
+	if !a.moved {
+		a.clock.advance(a.step)
+		a.moved = true
+	}
+	return a.data.Read(p)
+}
+
+// TestUploadMbpsPrecision verifies that the upload rate is computed from the
+// full-precision duration, not the whole milliseconds reported in Duration.
+func TestUploadMbpsPrecision(t *testing.T) {
+	fake := useFakeClock(t)
+	const size, elapsed = 64 * 1024, 250 * time.Microsecond
+
+	payload := strings.Repeat("a", size)
+	req := httptest.NewRequest("POST", "/upload", &advancingReader{data: strings.NewReader(payload), clock: fake, step: elapsed})
+	req.ContentLength = size
+
+	rr := httptest.NewRecorder()
+	uploadHandler(rr, req)
+
+	var response UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Duration != 0 {
+		t.Errorf("expected Duration to round down to 0ms, got %d", response.Duration)
+	}
+	if expected := roundRate(transferRate(size, elapsed, unitsBits)); response.Mbps != expected {
+		t.Errorf("expected %v Mbps, got %v", expected, response.Mbps)
+	}
+}
+
+func TestRatePrecision(t *testing.T) {
+	// 64KB in 250µs is 2097.152 Mbps
+	tests := []struct {
+		precision int
+		expected  string
+	}{
+		{0, `"mbps":2097,`},
+		{1, `"mbps":2097.2,`},
+		{2, `"mbps":2097.15,`},
+		{6, `"mbps":2097.152,`},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.precision), func(t *testing.T) {
+			useConfig(t, func(cfg *Config) { cfg.RatePrecision = tt.precision })
+			fake := useFakeClock(t)
+			payload := strings.Repeat("a", 64*1024)
+			req := httptest.NewRequest("POST", "/upload", &advancingReader{data: strings.NewReader(payload), clock: fake, step: 250 * time.Microsecond})
+
+			rr := httptest.NewRecorder()
+			uploadHandler(rr, req)
+			if !strings.Contains(rr.Body.String(), tt.expected) {
+				t.Errorf("expected %s in the response, got %s", tt.expected, rr.Body.String())
+			}
+		})
+	}
+}
+
+// timedSender imitates a client uploading for a set time: each read returns
+// readBytes and advances a fake clock by step, until reads are used up.
+type timedSender struct {
+	clock     *fakeClock
+	step      time.Duration
+	readBytes int
+	reads     int
+}
+
+func (s *timedSender) Read(p []byte) (int, error) {
+	if s.reads == 0 {
+		return 0, io.EOF
+	}
+	s.reads--
+	s.clock.advance(s.step)
+	return copy(p, strings.Repeat("a", s.readBytes)), nil
+}
+
+func TestUploadDuration(t *testing.T) {
+	tests := []struct {
+		name          string
+		reads         int
+		expectedBytes int64
+		expectedMs    int64
+		expired       bool
+	}{
+		// 10ms per 1000-byte read against a one-second window
+		{"Client Stops First", 30, 30000, 300, false},
+		{"Window Ends First", 500, 100000, 1000, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeClock(t)
+			sender := &timedSender{clock: fake, step: 10 * time.Millisecond, readBytes: 1000, reads: tt.reads}
+			rr := httptest.NewRecorder()
+			uploadHandler(rr, httptest.NewRequest("POST", "/upload?duration=1", sender))
+
+			var response UploadResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.BytesUploaded != tt.expectedBytes || response.Duration != tt.expectedMs {
+				t.Errorf("expected %d bytes in %dms, got %d in %dms", tt.expectedBytes, tt.expectedMs, response.BytesUploaded, response.Duration)
+			}
+			if response.WindowMs != 1000 || response.WindowExpired != tt.expired {
+				t.Errorf("expected a 1000ms window with expired %v, got %dms and %v", tt.expired, response.WindowMs, response.WindowExpired)
+			}
+			if expected := transferRate(tt.expectedBytes, time.Duration(tt.expectedMs)*time.Millisecond, unitsBits); response.Mbps != expected {
+				t.Errorf("expected %v Mbps over the actual duration, got %v", expected, response.Mbps)
+			}
+		})
+	}
+}
+
+func TestDownloadFilename(t *testing.T) {
+	rr := httptest.NewRecorder()
+	downloadHandler(rr, httptest.NewRequest("GET", "/download?bytes=1024", nil))
+	if h := rr.Header().Get("Content-Disposition"); h != "" {
+		t.Errorf("expected no Content-Disposition by default, got %q", h)
+	}
+
+	useConfig(t, func(cfg *Config) { cfg.DownloadFilename = "speedtest.bin" })
+	rr = httptest.NewRecorder()
+	downloadHandler(rr, httptest.NewRequest("GET", "/download?bytes=1024", nil))
+	if h, expected := rr.Header().Get("Content-Disposition"), `attachment; filename="speedtest.bin"`; h != expected {
+		t.Errorf("expected Content-Disposition %q, got %q", expected, h)
+	}
+}
+
+// discardRecorder is a ResponseRecorder that counts the body instead of
+// keeping it, for downloads too long to hold in memory.
+type discardRecorder struct {
+	*httptest.ResponseRecorder
+	bodyBytes int
+}
+
+func (w *discardRecorder) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.bodyBytes += len(p)
+	return len(p), nil
+}
+
+func TestDownloadDuration(t *testing.T) {
+	w := &discardRecorder{ResponseRecorder: httptest.NewRecorder()}
+	start := time.Now()
+	downloadHandler(w, httptest.NewRequest("GET", "/download?duration=0.05&bytes=1024", nil))
+	elapsed := time.Since(start)
+
+	response := w.Result()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, response.StatusCode)
+	}
+	if response.Header.Get("Content-Length") != "" {
+		t.Error("expected no Content-Length on a timed download")
+	}
+	if elapsed < 50*time.Millisecond {
+		t.Errorf("expected the stream to last the requested duration, took %v", elapsed)
+	}
+	if w.bodyBytes <= 1024 {
+		t.Errorf("expected ?bytes= to be ignored, got %d bytes", w.bodyBytes)
+	}
+	if trailer, expected := response.Trailer.Get("X-Download-Bytes"), fmt.Sprintf("%d", w.bodyBytes); trailer != expected {
+		t.Errorf("expected an X-Download-Bytes trailer of %s, got %q", expected, trailer)
+	}
+
+	for _, value := range []string{"0", "-1", "31", "soon"} {
+		rr := httptest.NewRecorder()
+		downloadHandler(rr, httptest.NewRequest("GET", "/download?duration="+value, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("duration=%s: expected status %d, got %d", value, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestDownloadChunkSize(t *testing.T) {
+	const chunk, maxChunk = 1024, 64 * 1024
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		expected int
+	}{
+		{"No Hint", "", "", chunk},
+		{"Low RTT", "X-Client-RTT", "20", chunk},
+		{"Moderate RTT", "X-Client-RTT", "120", 4 * chunk},
+		{"Client Hint", "RTT", "250", 32 * chunk},
+		{"High RTT Capped", "X-Client-RTT", "900", maxChunk},
+		{"Malformed", "X-Client-RTT", "slow", chunk},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/download", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			if got := downloadChunkSize(req, chunk, maxChunk); got != tt.expected {
+				t.Errorf("expected chunk size %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+// writeSizeRecorder is a ResponseRecorder that remembers the size of each
+// write and the largest of them.
+type writeSizeRecorder struct {
+	*httptest.ResponseRecorder
+	sizes   []int
+	largest int
+}
+
+func (w *writeSizeRecorder) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+	w.largest = max(w.largest, len(p))
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestDownloadWriteSize(t *testing.T) {
+	const writeSize = 1024 * 1024
+	useConfig(t, func(cfg *Config) { cfg.MaxChunkBytes = writeSize })
+
+	// Totals that are not a multiple of the write size, or smaller than it,
+	// still come out exact
+	for _, size := range []int{5*writeSize/2 + 7, writeSize / 4} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			w := &writeSizeRecorder{ResponseRecorder: httptest.NewRecorder()}
+			downloadHandler(w, httptest.NewRequest("GET", fmt.Sprintf("/download?bytes=%d&writeSize=%d", size, writeSize), nil))
+
+			if w.Body.Len() != size {
+				t.Errorf("expected %d bytes, got %d", size, w.Body.Len())
+			}
+			if expected := min(size, writeSize); w.largest != expected {
+				t.Errorf("expected writes of up to %d bytes, got %d", expected, w.largest)
+			}
+		})
+	}
+
+	for _, value := range []string{"100", fmt.Sprint(writeSize + 1), "jumbo"} {
+		w := httptest.NewRecorder()
+		downloadHandler(w, httptest.NewRequest("GET", "/download?writeSize="+value, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("writeSize=%s: expected status %d, got %d", value, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+// flushCounter is a ResponseRecorder that counts Flush calls.
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushCounter) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+func TestDownloadWritePattern(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.WritePattern = []int{1500, 9000} })
+
+	const size = 25000
+	w := &writeSizeRecorder{ResponseRecorder: httptest.NewRecorder()}
+	downloadHandler(w, httptest.NewRequest("GET", fmt.Sprintf("/download?bytes=%d", size), nil))
+
+	if w.Body.Len() != size {
+		t.Fatalf("expected exactly %d bytes, got %d", size, w.Body.Len())
+	}
+	// 2 full cycles of 10500 bytes, then 1500 and the remaining 2500
+	expected := []int{1500, 9000, 1500, 9000, 1500, 2500}
+	if !slices.Equal(w.sizes, expected) {
+		t.Errorf("expected write sizes %v, got %v", expected, w.sizes)
+	}
+
+	// An explicit write size overrides the pattern
+	w = &writeSizeRecorder{ResponseRecorder: httptest.NewRecorder()}
+	downloadHandler(w, httptest.NewRequest("GET", "/download?bytes=4096&writeSize=1024", nil))
+	if !slices.Equal(w.sizes, []int{1024, 1024, 1024, 1024}) {
+		t.Errorf("expected ?writeSize= to override the pattern, got %v", w.sizes)
+	}
+}
+
+func TestDownloadNoBuffer(t *testing.T) {
+	const size = 64 * 1024
+
+	buffered := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	downloadHandler(buffered, httptest.NewRequest("GET", fmt.Sprintf("/download?bytes=%d", size), nil))
+
+	unbuffered := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	downloadHandler(unbuffered, httptest.NewRequest("GET", fmt.Sprintf("/download?bytes=%d&nobuffer=1", size), nil))
+
+	if buffered.flushes != 1 {
+		t.Errorf("expected only the header flush by default, got %d flushes", buffered.flushes)
+	}
+	if want := size / defaultChunkSize; unbuffered.flushes <= want {
+		t.Errorf("expected a flush per write (more than %d) with nobuffer=1, got %d", want, unbuffered.flushes)
+	}
+	if unbuffered.Body.Len() != size {
+		t.Errorf("expected %d bytes, got %d", size, unbuffered.Body.Len())
+	}
+}
+
+func TestDownloadPeriodicFlush(t *testing.T) {
+	const size = 4 * downloadFlushBytes
+
+	w := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	downloadHandler(w, httptest.NewRequest("GET", fmt.Sprintf("/download?bytes=%d", size), nil))
+
+	// The header flush, then one per downloadFlushBytes written
+	if expected := 1 + size/downloadFlushBytes; w.flushes != expected {
+		t.Errorf("expected %d flushes, got %d", expected, w.flushes)
+	}
+	if w.Body.Len() != size {
+		t.Errorf("expected %d bytes, got %d", size, w.Body.Len())
+	}
+	if h := w.Header().Get("Content-Length"); h != fmt.Sprint(size) {
+		t.Errorf("expected Content-Length %d, got %q", size, h)
+	}
+}
+
+// cancellingWriter is a ResponseRecorder that cancels the request once
+// after bytes have been written, as if the client disconnected.
+type cancellingWriter struct {
+	*httptest.ResponseRecorder
+	after  int
+	cancel context.CancelFunc
+}
+
+func (c *cancellingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseRecorder.Write(p)
+	if c.Body.Len() >= c.after {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestDownloadStopsOnClientDisconnect(t *testing.T) {
+	const size = 4 * 1024 * 1024
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &cancellingWriter{ResponseRecorder: httptest.NewRecorder(), after: 64 * 1024, cancel: cancel}
+	req := httptest.NewRequest("GET", fmt.Sprintf("/download?bytes=%d", size), nil).WithContext(ctx)
+	downloadHandler(w, req)
+
+	// The loop notices the cancellation before its next write
+	if got, limit := w.Body.Len(), w.after+defaultChunkSize; got >= limit {
+		t.Errorf("expected the download to stop within a chunk of the disconnect (%d bytes), wrote %d of %d", w.after, got, size)
+	}
+}
+
+// plainWriter is a ResponseWriter without Flush support.
+type plainWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (p *plainWriter) Header() http.Header         { return p.header }
+func (p *plainWriter) Write(b []byte) (int, error) { return p.body.Write(b) }
+func (p *plainWriter) WriteHeader(int)             {}
+
+func TestDownloadNoBufferWithoutFlusher(t *testing.T) {
+	w := &plainWriter{header: http.Header{}}
+	downloadHandler(w, httptest.NewRequest("GET", "/download?bytes=4096&nobuffer=1", nil))
+
+	if w.body.Len() != 4096 {
+		t.Errorf("expected 4096 bytes from a non-flushing writer, got %d", w.body.Len())
+	}
+}
@@ -0,0 +1,69 @@
+// Package main provides download progress markers for the speed test server.
+// This file contains the writer that interleaves them with the payload.
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// progressMarkerFormat is the text of a progress marker, formatted with
+// the stream offset of its first byte. The offset is zero-padded so every
+// marker has the same length.
+const progressMarkerFormat = "\nPINGUEN-OFFSET %016d\n"
+
+// progressMarkerLen is the length of every progress marker.
+var progressMarkerLen = len(fmt.Sprintf(progressMarkerFormat, 0))
+
+// wantsMarkers reports whether the client asked for progress markers with
+// ?markers=1.
+func wantsMarkers(r *http.Request) bool {
+	return r.URL.Query().Get("markers") == "1"
+}
+
+// markerWriter writes a progress marker at every multiple of interval in
+// the stream, in place of the payload bytes that would have been there.
+// The markers replace payload rather than adding to it, so a stream of
+// size bytes stays exactly size bytes long. A marker that would not fit
+// before the end of the stream is left out.
+type markerWriter struct {
+	w        io.Writer
+	interval int
+	size     int
+	offset   int
+	// pending is the rest of a marker cut short by the end of a write
+	pending []byte
+}
+
+func (m *markerWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(m.pending) == 0 && m.offset%m.interval == 0 && m.offset+progressMarkerLen <= m.size {
+			m.pending = fmt.Appendf(nil, progressMarkerFormat, m.offset)
+		}
+
+		// Write either the marker in progress or the payload up to the next
+		// marker, consuming as many bytes of p either way
+		var chunk []byte
+		marker := len(m.pending) > 0
+		if marker {
+			chunk = m.pending[:min(len(m.pending), len(p))]
+		} else {
+			next := (m.offset/m.interval + 1) * m.interval
+			chunk = p[:min(len(p), next-m.offset)]
+		}
+
+		n, err := m.w.Write(chunk)
+		if marker {
+			m.pending = m.pending[n:]
+		}
+		written += n
+		m.offset += n
+		p = p[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestDownloadProgressMarkers(t *testing.T) {
+	const interval, size = 4096, 10000
+	useConfig(t, func(cfg *Config) { cfg.MarkerIntervalBytes = interval })
+
+	rr := httptest.NewRecorder()
+	downloadHandler(rr, httptest.NewRequest("GET", fmt.Sprintf("/download?bytes=%d&markers=1", size), nil))
+	body := rr.Body.Bytes()
+
+	if len(body) != size {
+		t.Fatalf("expected %d bytes, got %d", size, len(body))
+	}
+	if h := rr.Header().Get("Content-Length"); h != strconv.Itoa(len(body)) {
+		t.Errorf("expected Content-Length %d, got %q", len(body), h)
+	}
+
+	for _, offset := range []int{0, interval, 2 * interval} {
+		expected := fmt.Sprintf(progressMarkerFormat, offset)
+		if got := string(body[offset : offset+progressMarkerLen]); got != expected {
+			t.Errorf("expected marker %q at offset %d, got %q", expected, offset, got)
+		}
+	}
+	if n := bytes.Count(body, []byte("PINGUEN-OFFSET")); n != 3 {
+		t.Errorf("expected 3 markers, got %d", n)
+	}
+}
+
+func TestMarkerWriterSplitWrites(t *testing.T) {
+	const interval, size = 128, 270
+	var out bytes.Buffer
+	m := &markerWriter{w: &out, interval: interval, size: size}
+
+	// Writes of awkward sizes split markers across calls
+	payload := bytes.Repeat([]byte("x"), size)
+	for len(payload) > 0 {
+		n := min(7, len(payload))
+		if written, err := m.Write(payload[:n]); written != n || err != nil {
+			t.Fatalf("expected %d bytes written, got %d, %v", n, written, err)
+		}
+		payload = payload[n:]
+	}
+
+	if out.Len() != size {
+		t.Fatalf("expected %d bytes, got %d", size, out.Len())
+	}
+	for _, offset := range []int{0, interval, 2 * interval} {
+		marker := []byte(fmt.Sprintf(progressMarkerFormat, offset))
+		fits := offset+len(marker) <= size
+		if got := bytes.HasPrefix(out.Bytes()[offset:], marker); got != fits {
+			t.Errorf("marker at offset %d: expected present=%v, got %v", offset, fits, got)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package main provides request metrics for the speed test server.
+// This file contains the response status recorder and per-route counters
+// published through expvar.
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// statusRecorder wraps a ResponseWriter to remember the status code and
+// number of body bytes written by the handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over to the handler, as a WebSocket upgrade
+// does. The handler then writes its own 101 Switching Protocols response.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Push forwards an HTTP/2 server push, which ResponseController can't.
+func (r *statusRecorder) Push(target string, opts *http.PushOptions) error {
+	if p, ok := r.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// statusCode returns the recorded status, defaulting to 200 if the
+// handler wrote nothing.
+func (r *statusRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// routeStats holds per-route counters, published at /debug/vars as
+// "routes": {"<pattern>": {"requests": n, "bytes": n, "errors": n}}.
+var routeStats = expvar.NewMap("routes")
+
+// routeCounters returns the counters for a route, creating them on first use.
+func routeCounters(route string) *expvar.Map {
+	if counters, ok := routeStats.Get(route).(*expvar.Map); ok {
+		return counters
+	}
+	counters := new(expvar.Map).Init()
+	routeStats.Set(route, counters)
+	return counters
+}
+
+// withRouteStats counts requests, response bytes and error responses
+// (status 400 and above) for the route. A handler that panics is counted
+// as an error, along with the bytes it sent before panicking.
+func withRouteStats(route string, handler http.HandlerFunc) http.HandlerFunc {
+	counters := routeCounters(route)
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			counters.Add("requests", 1)
+			counters.Add("bytes", rec.bytes)
+			if !completed || rec.statusCode() >= http.StatusBadRequest {
+				counters.Add("errors", 1)
+			}
+		}()
+
+		handler(rec, r)
+		completed = true
+	}
+}
+
+// expvarHandler serves the expvar variables like expvar.Handler, but
+// without "cmdline". The command line can carry secrets such as
+// -gateway-secret and -download-token-secret, which must not be published.
+func expvarHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprint(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprint(w, "\n}\n")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// routeCounter reads one counter of a route from expvar.
+func routeCounter(t *testing.T, route, name string) int64 {
+	t.Helper()
+	counters, ok := routeStats.Get(route).(*expvar.Map)
+	if !ok {
+		return 0
+	}
+	v, ok := counters.Get(name).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestRouteStatsExpvar(t *testing.T) {
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	requests := routeCounter(t, "/ping", "requests")
+	bytes := routeCounter(t, "/ping", "bytes")
+	errors := routeCounter(t, "/download", "errors")
+
+	for i := 0; i < 3; i++ {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ping", nil))
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/download", nil))
+
+	if got := routeCounter(t, "/ping", "requests") - requests; got != 3 {
+		t.Errorf("expected 3 more /ping requests, got %d", got)
+	}
+	if got := routeCounter(t, "/ping", "bytes") - bytes; got <= 0 {
+		t.Errorf("expected /ping bytes to increase, got %d", got)
+	}
+	if got := routeCounter(t, "/download", "errors") - errors; got != 1 {
+		t.Errorf("expected 1 more /download error, got %d", got)
+	}
+
+	// /debug/vars publishes the counters and is not rate limited
+	cfg := defaultConfig()
+	cfg.DebugToken = "secret"
+	limiter := newRateLimiter(defaultRateLimit, defaultRateWindow)
+	mux = newMux(cfg, limiter, newLoadMonitor(0, 0, 0))
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/debug/vars", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vars["routes"]; !ok {
+		t.Error("expected routes in /debug/vars")
+	}
+	if _, ok := vars["cmdline"]; ok {
+		t.Error("expected /debug/vars to leave out the command line")
+	}
+	if n := len(limiter.requests[addrHost(req.RemoteAddr)]); n != 0 {
+		t.Errorf("expected /debug/vars to bypass rate limiting, got %d recorded requests", n)
+	}
+}
+
+func TestDebugVarsRequiresToken(t *testing.T) {
+	cfg := defaultConfig()
+	mux := newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected /debug/vars to be disabled without a token, got status %d", w.Code)
+	}
+
+	cfg.DebugToken = "secret"
+	mux = newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d without the token, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
@@ -1,36 +1,129 @@
 // Package main provides middleware components for the speed test server.
-// This file contains implementations for rate limiting and request logging.
+// This file contains implementations for rate limiting, request logging,
+// panic recovery, method filtering, static response headers, instance
+// tagging and latency injection.
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	// defaultRateLimit is the number of requests allowed per client per
+	// window, unless overridden with -rate-limit or RATE_LIMIT
+	defaultRateLimit = 60
+	// defaultPingRateLimit is the per-client limit of the latency probes,
+	// which are cheap and sent in quick succession by jitter tests
+	defaultPingRateLimit = 600
+	// defaultRateWindow is the period over which requests are counted,
+	// unless overridden with -rate-window or RATE_WINDOW
+	defaultRateWindow = time.Minute
+	// rejectedByHeader names the stage that refused a request, one of
+	// method, rate-limit, subnet-rate-limit, subnet-concurrency, overload,
+	// daily-cap, origin, download-token, gateway, debug-token, ws-conns,
+	// upload-limit, upload-timeout or url-length, so a client can tell
+	// which check is blocking it
+	rejectedByHeader = "X-Rejected-By"
+)
+
+// requestLimiter decides whether a client may make another request.
+type requestLimiter interface {
+	isAllowed(ip string) bool
+	// usage reports the client's standing against the limit.
+	usage(ip string) rateLimitUsage
+}
+
+// rateLimitUsage is a client's standing against its rate limit.
+type rateLimitUsage struct {
+	// Limit is the number of requests allowed per window
+	Limit int
+	// Remaining is the number of requests the client can still make
+	Remaining int
+	// Reset is when the client's next request slot frees up
+	Reset time.Time
+}
+
+// rateLimitAlgorithms maps the names accepted by -rate-algorithm to their
+// limiter constructors.
+// Each constructor takes the number of requests allowed per client in each
+// window of the given length, and the burst a client may make at once,
+// where zero means limit. Only the token bucket can burst differently from
+// its limit, so the window algorithms ignore burst.
+var rateLimitAlgorithms = map[string]func(limit int, window time.Duration, burst int) requestLimiter{
+	"sliding-window": func(limit int, window time.Duration, _ int) requestLimiter {
+		return newRateLimiter(limit, window)
+	},
+	"fixed-window": func(limit int, window time.Duration, _ int) requestLimiter {
+		return newFixedWindowLimiter(limit, window)
+	},
+	"token-bucket": func(limit int, window time.Duration, burst int) requestLimiter {
+		if burst == 0 {
+			burst = limit
+		}
+		return newTokenBucketLimiter(limit, window, burst)
+	},
+}
+
+// rateLimiter is a sliding-window limiter that remembers the time of every
+// request made by a client within the window. Clients with no request left
+// in the window are forgotten, at most once per window.
 type rateLimiter struct {
 	requests map[string][]time.Time
+	limit    int
+	window   time.Duration
+	swept    time.Time
 	mu       sync.Mutex
 }
 
-func newRateLimiter() *rateLimiter {
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
 	return &rateLimiter{
 		requests: make(map[string][]time.Time),
+		limit:    limit,
+		window:   window,
+		swept:    clock(),
 	}
 }
 
+// sweep forgets the clients whose latest request has left the window, once
+// a window has passed since the last sweep. The caller holds rl.mu.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.swept) < rl.window {
+		return
+	}
+	cutoff := now.Add(-rl.window)
+	for ip, times := range rl.requests {
+		if !times[len(times)-1].After(cutoff) {
+			delete(rl.requests, ip)
+		}
+	}
+	rl.swept = now
+}
+
 func (rl *rateLimiter) clean(ip string) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
-	window := now.Add(-time.Minute)
+	now := clock()
+	cutoff := now.Add(-rl.window)
 
 	if times, exists := rl.requests[ip]; exists {
 		valid := times[:0]
 		for _, t := range times {
-			if t.After(window) {
+			if t.After(cutoff) {
 				valid = append(valid, t)
 			}
 		}
@@ -48,33 +141,461 @@ func (rl *rateLimiter) isAllowed(ip string) bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
+	now := clock()
+	rl.sweep(now)
 	rl.requests[ip] = append(rl.requests[ip], now)
 
-	return len(rl.requests[ip]) <= 60 // 60 requests per minute
+	return len(rl.requests[ip]) <= rl.limit
+}
+
+// usage counts the client's requests in the window. A slot frees up when
+// the oldest of them leaves the window. Rejected requests are counted too,
+// so a client over the limit must wait until enough of its requests have
+// left the window to bring it back under.
+func (rl *rateLimiter) usage(ip string) rateLimitUsage {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	times := rl.requests[ip]
+	usage := rateLimitUsage{
+		Limit:     rl.limit,
+		Remaining: max(0, rl.limit-len(times)),
+		Reset:     clock(),
+	}
+	if over := len(times) - rl.limit; over >= 0 && rl.limit > 0 {
+		usage.Reset = times[over].Add(rl.window)
+	} else if len(times) > 0 {
+		usage.Reset = times[0].Add(rl.window)
+	}
+	return usage
+}
+
+// fixedWindowLimiter counts requests per client in fixed windows. It uses
+// constant memory per client at the cost of allowing bursts of up to twice
+// the limit across a window boundary. Clients whose window has ended are
+// forgotten, at most once per window, so the map doesn't grow with every
+// client ever seen.
+type fixedWindowLimiter struct {
+	windows map[string]*fixedWindow
+	limit   int
+	window  time.Duration
+	swept   time.Time
+	mu      sync.Mutex
+}
+
+type fixedWindow struct {
+	start time.Time
+	count int
+}
+
+func newFixedWindowLimiter(limit int, window time.Duration) *fixedWindowLimiter {
+	return &fixedWindowLimiter{
+		windows: make(map[string]*fixedWindow),
+		limit:   limit,
+		window:  window,
+		swept:   clock(),
+	}
+}
+
+// sweep forgets the clients whose window has ended, once a window has
+// passed since the last sweep. The caller holds fl.mu.
+func (fl *fixedWindowLimiter) sweep(now time.Time) {
+	if now.Sub(fl.swept) < fl.window {
+		return
+	}
+	for ip, w := range fl.windows {
+		if now.Sub(w.start) >= fl.window {
+			delete(fl.windows, ip)
+		}
+	}
+	fl.swept = now
+}
+
+func (fl *fixedWindowLimiter) isAllowed(ip string) bool {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	now := clock()
+	fl.sweep(now)
+	w, exists := fl.windows[ip]
+	if !exists {
+		w = &fixedWindow{start: now}
+		fl.windows[ip] = w
+	} else if now.Sub(w.start) >= fl.window {
+		w.start, w.count = now, 0
+	}
+
+	w.count++
+	return w.count <= fl.limit
+}
+
+// usage reports the requests left in the client's current window, which
+// all become available again when the window ends.
+func (fl *fixedWindowLimiter) usage(ip string) rateLimitUsage {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	now := clock()
+	w, exists := fl.windows[ip]
+	if !exists || now.Sub(w.start) >= fl.window {
+		return rateLimitUsage{Limit: fl.limit, Remaining: fl.limit, Reset: now}
+	}
+	return rateLimitUsage{
+		Limit:     fl.limit,
+		Remaining: max(0, fl.limit-w.count),
+		Reset:     w.start.Add(fl.window),
+	}
+}
+
+// tokenBucketLimiter gives each client a bucket of capacity tokens that
+// refills at limit tokens per window, and spends one token per request. It
+// uses constant memory per client like fixedWindowLimiter, but replenishes
+// smoothly instead of all at once, so it allows no burst beyond capacity at
+// a window boundary.
+//
+// Token levels are kept in units of 1/window of a token, so that refilling
+// limit tokens per window adds exactly limit units per nanosecond and the
+// arithmetic stays exact.
+type tokenBucketLimiter struct {
+	buckets  map[string]*tokenBucket
+	limit    int
+	window   time.Duration
+	capacity int
+	mu       sync.Mutex
+}
+
+type tokenBucket struct {
+	level int64
+	last  time.Time
+}
+
+func newTokenBucketLimiter(limit int, window time.Duration, capacity int) *tokenBucketLimiter {
+	return &tokenBucketLimiter{
+		buckets:  make(map[string]*tokenBucket),
+		limit:    limit,
+		window:   window,
+		capacity: capacity,
+	}
+}
+
+// refill returns the client's bucket topped up for the time since it was
+// last used, creating a full one for a new client. The caller holds tl.mu.
+func (tl *tokenBucketLimiter) refill(ip string, now time.Time) *tokenBucket {
+	full := int64(tl.capacity) * int64(tl.window)
+	b, exists := tl.buckets[ip]
+	if !exists {
+		b = &tokenBucket{level: full, last: now}
+		tl.buckets[ip] = b
+		return b
+	}
+	if tl.limit > 0 {
+		// Cap the elapsed time at what fills the bucket, so the
+		// multiplication can't overflow after a long idle period
+		elapsed := max(0, int64(now.Sub(b.last)))
+		if toFull := (full-b.level)/int64(tl.limit) + 1; elapsed > toFull {
+			elapsed = toFull
+		}
+		if b.level += elapsed * int64(tl.limit); b.level > full {
+			b.level = full
+		}
+	}
+	b.last = now
+	return b
+}
+
+func (tl *tokenBucketLimiter) isAllowed(ip string) bool {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	b := tl.refill(ip, clock())
+	if b.level < int64(tl.window) {
+		return false
+	}
+	b.level -= int64(tl.window)
+	return true
+}
+
+// usage reports the whole tokens left in the client's bucket. The next
+// request slot frees up when the bucket next gains a whole token, so unlike
+// the window algorithms, rejected requests don't push it back.
+func (tl *tokenBucketLimiter) usage(ip string) rateLimitUsage {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	now := clock()
+	if _, exists := tl.buckets[ip]; !exists {
+		return rateLimitUsage{Limit: tl.limit, Remaining: tl.capacity, Reset: now}
+	}
+	b := tl.refill(ip, now)
+	usage := rateLimitUsage{
+		Limit:     tl.limit,
+		Remaining: int(b.level / int64(tl.window)),
+		Reset:     now,
+	}
+	if b.level < int64(tl.capacity)*int64(tl.window) && tl.limit > 0 {
+		// Units still missing from the next whole token, gained at limit
+		// per nanosecond, rounded up
+		missing := int64(tl.window) - b.level%int64(tl.window)
+		usage.Reset = now.Add(time.Duration((missing + int64(tl.limit) - 1) / int64(tl.limit)))
+	}
+	return usage
+}
+
+// requestLogEntry is a request log line in the JSON log format.
+type requestLogEntry struct {
+	Time       string  `json:"time"`
+	RemoteAddr string  `json:"remoteAddr"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"durationMs"`
+	RejectedBy string  `json:"rejectedBy,omitempty"`
 }
 
+// jsonRequestLog writes the request log lines of -log-format json, without
+// the standard logger's timestamp prefix so every line is a complete JSON
+// object. Its own mutex keeps concurrent lines from interleaving.
+var jsonRequestLog = log.New(os.Stderr, "", 0)
+
+// logRequest logs each request with its status, response bytes and
+// duration, and the stage that rejected it, if any. With -log-slow-ms set,
+// requests faster than the threshold are only logged if they failed, which
+// includes requests aborted by a panic.
+//
+// With -log-format json, each request is instead logged as one JSON
+// object, for log aggregators to parse.
 func logRequest(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		handler(w, r)
-		log.Printf(
-			"%s %s %s %s",
-			r.RemoteAddr,
-			r.Method,
-			r.URL.Path,
-			time.Since(start),
-		)
+		start := clock()
+		recorder := &statusRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			elapsed := clock().Sub(start)
+			slow := time.Duration(activeConfig.LogSlowMs) * time.Millisecond
+			if completed && elapsed < slow && recorder.statusCode() < http.StatusBadRequest {
+				return
+			}
+			stage := w.Header().Get(rejectedByHeader)
+			if activeConfig.LogFormat == logFormatJSON {
+				encoded, _ := json.Marshal(requestLogEntry{
+					Time:       clock().UTC().Format(time.RFC3339Nano),
+					RemoteAddr: clientIP(r),
+					Method:     r.Method,
+					Path:       r.URL.Path,
+					Status:     recorder.statusCode(),
+					Bytes:      recorder.bytes,
+					DurationMs: float64(elapsed.Microseconds()) / 1000,
+					RejectedBy: stage,
+				})
+				jsonRequestLog.Print(string(encoded))
+				return
+			}
+
+			line := fmt.Sprintf("%s %s %s %d %dB %s", clientIP(r), r.Method, r.URL.Path, recorder.statusCode(), recorder.bytes, elapsed)
+			if stage != "" {
+				line += " rejected by " + stage
+			}
+			log.Print(line)
+		}()
+
+		handler(recorder, r)
+		completed = true
+	}
+}
+
+// withRecovery turns a panic in handler into a 500 Internal Server Error,
+// logging it with its stack. If the response has already started, an
+// error can no longer be sent, so the connection is aborted instead and
+// the client sees a truncated response. Deliberate aborts with
+// http.ErrAbortHandler are passed on unchanged.
+//
+// Bookkeeping in the middleware wrapped by withRecovery must be deferred,
+// so it still runs while a panic unwinds through it.
+func withRecovery(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			if recorder.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(recorder, http.StatusInternalServerError, "Internal Server Error")
+		}()
+
+		handler(recorder, r)
 	}
 }
 
-func withRateLimit(limiter *rateLimiter, handler http.HandlerFunc) http.HandlerFunc {
+// withRateLimit rejects clients over their rate limit with 429. Every
+// response carries X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset (seconds until a request slot frees up).
+func withRateLimit(limiter requestLimiter, handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ip := r.RemoteAddr
-		if !limiter.isAllowed(ip) {
+		ip := addrHost(clientIP(r))
+		allowed := limiter.isAllowed(ip)
+
+		usage := limiter.usage(ip)
+		reset := max(0, int(math.Ceil(usage.Reset.Sub(clock()).Seconds())))
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(usage.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(usage.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(reset))
+
+		if !allowed {
+			transferTotals.rateLimited.Add(1)
+			rateLimitRejections.record(ip)
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, reset)))
+			w.Header().Set(rejectedByHeader, "rate-limit")
 			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			return
 		}
 		handler(w, r)
 	}
 }
+
+// clientIP identifies the client of a request. With -trust-proxy set, it is
+// the last address in X-Forwarded-For, or else X-Real-IP, as set by the
+// reverse proxy in front of the server. Otherwise, or if neither header
+// holds an IP address, it is r.RemoteAddr. The headers are ignored unless
+// trusted, as any client can send them to pose as someone else.
+//
+// A proxy appends the address it received the request from to any
+// X-Forwarded-For the client sent, so only the last address is the proxy's
+// own; the ones before it are whatever the client chose to send.
+func clientIP(r *http.Request) string {
+	if activeConfig.TrustProxy {
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		forwarded := hops[len(hops)-1]
+		for _, candidate := range []string{forwarded, r.Header.Get("X-Real-IP")} {
+			if ip := net.ParseIP(strings.TrimSpace(candidate)); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	return r.RemoteAddr
+}
+
+// addrHost returns the host part of a host:port address, or addr itself if
+// it has no port. Applied to clientIP, it drops the port of r.RemoteAddr,
+// which changes with every connection, so that it identifies the same
+// client across connections over IPv4 and IPv6 alike.
+func addrHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+const (
+	// instanceIDHeader names the server instance that served a response
+	instanceIDHeader = "X-Instance-ID"
+	// maxInstanceIDLen bounds the length of -instance-id
+	maxInstanceIDLen = 64
+)
+
+// newInstanceID returns a random ID for a server started without
+// -instance-id.
+func newInstanceID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withInstanceID tags every response with the ID of this server instance,
+// so clients behind a load balancer can check which instance served each
+// step of a multi-step test.
+func withInstanceID(id string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(instanceIDHeader, id)
+		handler(w, r)
+	}
+}
+
+// tlsResumedHeader reports whether a TLS connection resumed an earlier
+// session
+const tlsResumedHeader = "X-TLS-Resumed"
+
+// withTLSResumed tells clients over TLS whether their connection resumed
+// an earlier session from a session ticket, skipping the full handshake,
+// so connection setup times can be compared like for like. Plain HTTP
+// responses don't carry the header.
+func withTLSResumed(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set(tlsResumedHeader, strconv.FormatBool(r.TLS.DidResume))
+		}
+		handler(w, r)
+	}
+}
+
+// withHeaders adds the given static headers to every response.
+func withHeaders(headers http.Header, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range headers {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// withInjectedLatency delays every request by latency before handler runs,
+// simulating a distant server. A request cancelled during the delay returns
+// without reaching handler. A zero latency returns handler unchanged.
+func withInjectedLatency(latency time.Duration, handler http.HandlerFunc) http.HandlerFunc {
+	if latency <= 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			handler(w, r)
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// limitURLLength rejects requests whose URL (the path and query string
+// together) is longer than maxBytes with 414 URI Too Long. It wraps each
+// route ahead of everything that parses the query, so an absurdly long
+// query string costs the server no more than reading it.
+func limitURLLength(maxBytes int, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > maxBytes {
+			w.Header().Set(rejectedByHeader, "url-length")
+			http.Error(w, "URI too long", http.StatusRequestURITooLong)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// allowMethods rejects requests whose method is not one of methods with
+// 405 Method Not Allowed, listing the route's methods in the Allow header.
+// It wraps each route ahead of rate limiting and load shedding, so methods
+// such as TRACE (a cross-site tracing risk) and CONNECT never reach a
+// handler, while rejections are still logged and counted.
+func allowMethods(methods []string, handler http.HandlerFunc) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			w.Header().Set(rejectedByHeader, "method")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitHeaders(t *testing.T) {
+	for name, newLimiter := range rateLimitAlgorithms {
+		t.Run(name, func(t *testing.T) {
+			handler := withRateLimit(newLimiter(defaultRateLimit, defaultRateWindow, 0), pingHandler)
+
+			for i := 1; i <= defaultRateLimit+1; i++ {
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest("GET", "/ping", nil))
+
+				if got := w.Header().Get("X-RateLimit-Limit"); got != strconv.Itoa(defaultRateLimit) {
+					t.Fatalf("request %d: expected X-RateLimit-Limit %d, got %q", i, defaultRateLimit, got)
+				}
+				remaining := max(0, defaultRateLimit-i)
+				if got := w.Header().Get("X-RateLimit-Remaining"); got != strconv.Itoa(remaining) {
+					t.Fatalf("request %d: expected X-RateLimit-Remaining %d, got %q", i, remaining, got)
+				}
+				reset, err := strconv.Atoi(w.Header().Get("X-RateLimit-Reset"))
+				if err != nil || reset <= 0 || reset > int(defaultRateWindow.Seconds()) {
+					t.Fatalf("request %d: expected X-RateLimit-Reset within the window, got %q", i, w.Header().Get("X-RateLimit-Reset"))
+				}
+
+				expected := http.StatusOK
+				if i > defaultRateLimit {
+					expected = http.StatusTooManyRequests
+				}
+				if w.Code != expected {
+					t.Fatalf("request %d: expected status %d, got %d", i, expected, w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	for name, newLimiter := range rateLimitAlgorithms {
+		t.Run(name, func(t *testing.T) {
+			fake := useFakeClock(t)
+			handler := withRateLimit(newLimiter(2, time.Minute, 0), pingHandler)
+			request := func() *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest("GET", "/ping", nil))
+				return w
+			}
+
+			// Fill the limit, then exceed it
+			for i := 0; i < 2; i++ {
+				if w := request(); w.Code != http.StatusOK || w.Header().Get("Retry-After") != "" {
+					t.Fatalf("request %d: expected status %d without Retry-After, got %d", i+1, http.StatusOK, w.Code)
+				}
+				fake.advance(10 * time.Second)
+			}
+			w := request()
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("expected status %d over the limit, got %d", http.StatusTooManyRequests, w.Code)
+			}
+			retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+			if err != nil || retryAfter <= 0 {
+				t.Fatalf("expected a positive Retry-After, got %q", w.Header().Get("Retry-After"))
+			}
+
+			// Retrying when told to succeeds
+			fake.advance(time.Duration(retryAfter) * time.Second)
+			if w := request(); w.Code != http.StatusOK {
+				t.Errorf("expected a retry after %ds to succeed, got status %d", retryAfter, w.Code)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		trust      bool
+		forwarded  string
+		realIP     string
+		expectedIP string
+	}{
+		{"Untrusted Ignores Headers", false, "203.0.113.7", "203.0.113.8", "192.0.2.1:1234"},
+		{"Forwarded For", true, "203.0.113.7", "203.0.113.8", "203.0.113.7"},
+		{"Forged Forwarded For", true, "198.51.100.1, 203.0.113.7", "203.0.113.8", "203.0.113.7"},
+		{"Real IP", true, "", "2001:db8::1", "2001:db8::1"},
+		{"Malformed Header", true, "not-an-ip", "", "192.0.2.1:1234"},
+		{"No Headers", true, "", "", "192.0.2.1:1234"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(cfg *Config) { cfg.TrustProxy = tt.trust })
+			r := httptest.NewRequest("GET", "/ping", nil)
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r); got != tt.expectedIP {
+				t.Errorf("expected client %q, got %q", tt.expectedIP, got)
+			}
+		})
+	}
+}
+
+func TestAddrHost(t *testing.T) {
+	tests := []struct {
+		name         string
+		addr         string
+		expectedHost string
+	}{
+		{"IPv4", "192.0.2.1:1234", "192.0.2.1"},
+		{"IPv6", "[2001:db8::1]:54321", "2001:db8::1"},
+		{"IPv6 Zone", "[fe80::1%eth0]:54321", "fe80::1%eth0"},
+		{"No Port", "2001:db8::1", "2001:db8::1"},
+		{"Malformed", "not-an-address", "not-an-address"},
+		{"Empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addrHost(tt.addr); got != tt.expectedHost {
+				t.Errorf("expected host %q, got %q", tt.expectedHost, got)
+			}
+		})
+	}
+}
+
+func TestRateLimitAcrossConnections(t *testing.T) {
+	for _, addrs := range [][]string{
+		{"192.0.2.1:50001", "192.0.2.1:50002"},
+		{"[2001:db8::1]:50001", "[2001:db8::1]:50002"},
+	} {
+		handler := withRateLimit(newRateLimiter(1, defaultRateWindow), pingHandler)
+		// Each connection comes from a new ephemeral port of the same client
+		var codes []int
+		for _, addr := range addrs {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/ping", nil)
+			r.RemoteAddr = addr
+			handler(w, r)
+			codes = append(codes, w.Code)
+		}
+		if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+			t.Errorf("%v: expected the second connection to share the first's budget, got statuses %v", addrs, codes)
+		}
+	}
+}
+
+func TestRateLimitBehindProxy(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.TrustProxy = true })
+	handler := withRateLimit(newRateLimiter(1, defaultRateWindow), pingHandler)
+
+	// Every request arrives from the proxy's address, but for two clients
+	for _, client := range []string{"203.0.113.7", "203.0.113.8"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/ping", nil)
+		r.Header.Set("X-Forwarded-For", client)
+		handler(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected client %s to have its own budget, got status %d", client, w.Code)
+		}
+	}
+}
+
+func TestRejectedByHeader(t *testing.T) {
+	fake := useFakeClock(t)
+	overloaded := newLoadMonitor(0, 8, time.Second) // 1MB/s
+	// The rate is measured over the last complete second
+	overloaded.egress.add(2_000_000)
+	fake.advance(time.Second)
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		method     string
+		status     int
+		rejectedBy string
+	}{
+		{"Rate Limit", withRateLimit(newRateLimiter(0, defaultRateWindow), pingHandler), "GET", http.StatusTooManyRequests, "rate-limit"},
+		{"Overload", withLoadShedding(overloaded, pingHandler), "GET", http.StatusServiceUnavailable, "overload"},
+		{"Method", allowMethods([]string{http.MethodGet}, pingHandler), "TRACE", http.StatusMethodNotAllowed, "method"},
+		{"Accepted", withRateLimit(newRateLimiter(1, defaultRateWindow), pingHandler), "GET", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest(tt.method, "/ping", nil))
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, w.Code)
+			}
+			if got := w.Header().Get(rejectedByHeader); got != tt.rejectedBy {
+				t.Errorf("expected %s %q, got %q", rejectedByHeader, tt.rejectedBy, got)
+			}
+		})
+	}
+}
+
+func TestURLTooLong(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxURLBytes = 64
+	mux := newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/download?bytes=1024&units="+strings.Repeat("x", 64), nil))
+	if w.Code != http.StatusRequestURITooLong {
+		t.Errorf("expected status %d for an over-long query, got %d", http.StatusRequestURITooLong, w.Code)
+	}
+	if got := w.Header().Get(rejectedByHeader); got != "url-length" {
+		t.Errorf("expected %s url-length, got %q", rejectedByHeader, got)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/download?bytes=1024", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d within the limit, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.InstanceID == "" {
+		t.Fatal("expected an instance ID to be generated without -instance-id")
+	}
+	useConfig(t, func(c *Config) { c.InstanceID = cfg.InstanceID })
+	handler := withInstanceID(cfg.InstanceID, newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0)).ServeHTTP)
+
+	for _, path := range []string{"/ping", "/status", "/ping", "/missing"} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", path, nil))
+		if got := w.Header().Get(instanceIDHeader); got != cfg.InstanceID {
+			t.Errorf("%s: expected %s %q, got %q", path, instanceIDHeader, cfg.InstanceID, got)
+		}
+		if path == "/status" {
+			var status StatusResponse
+			if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.InstanceID != cfg.InstanceID {
+				t.Errorf("expected /status to report instance %q, got %q", cfg.InstanceID, status.InstanceID)
+			}
+		}
+	}
+
+	if cfg, err := parseFlags([]string{"-instance-id", "fra-1"}); err != nil || cfg.InstanceID != "fra-1" {
+		t.Errorf("expected -instance-id to be used as given, got %v", err)
+	}
+	if _, err := parseFlags([]string{"-instance-id", "bad\r\nid"}); err == nil {
+		t.Error("expected an instance ID unsafe in a header to be rejected")
+	}
+}
+
+func TestPingRateLimitSeparate(t *testing.T) {
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	for i := 1; i <= 2*defaultRateLimit; i++ {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/ping", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("ping %d: expected status %d, got %d", i, http.StatusOK, w.Code)
+		}
+		if got := w.Header().Get("X-RateLimit-Limit"); got != strconv.Itoa(defaultPingRateLimit) {
+			t.Fatalf("ping %d: expected X-RateLimit-Limit %d, got %q", i, defaultPingRateLimit, got)
+		}
+	}
+
+	for i := 1; i <= defaultRateLimit+1; i++ {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/download?bytes=1024", nil))
+
+		expected := http.StatusOK
+		if i > defaultRateLimit {
+			expected = http.StatusTooManyRequests
+		}
+		if w.Code != expected {
+			t.Fatalf("download %d: expected status %d, got %d", i, expected, w.Code)
+		}
+	}
+}
+
+func TestProbesNotShed(t *testing.T) {
+	load := newLoadMonitor(1, 0, 0)
+	// A speed test already fills the only slot
+	load.inFlight.Add(1)
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), load)
+
+	for _, path := range []string{"/ping", "/ping/burst?n=2&interval=5ms", "/multiping?n=2", "/rtt?t1=1"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected latency probes to be served while overloaded, got %d", path, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/download?bytes=1024", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a download to be shed with %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestInjectedLatency(t *testing.T) {
+	latency := 50 * time.Millisecond
+	handler := withInjectedLatency(latency, pingHandler)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/ping", nil))
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("expected a response after at least %v, got %v", latency, elapsed)
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	// A client giving up during the delay is released promptly and the
+	// handler never runs
+	handler = withInjectedLatency(time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler ran after the request was cancelled")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start = time.Now()
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/ping", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected cancellation to end the delay promptly, took %v", elapsed)
+	}
+}
+
+func TestPanicAccounting(t *testing.T) {
+	const written = 1000
+	monitor := newLoadMonitor(0, 0, 0)
+	handlers := &inFlight{}
+
+	chain := func(route string, handler http.HandlerFunc) http.HandlerFunc {
+		return handlers.track(logRequest(withRecovery(withRouteStats(route, withLoadShedding(monitor, handler)))))
+	}
+	midStream := chain("/test/panic-mid-stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, written))
+		panic("boom")
+	})
+	early := chain("/test/panic-early", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	// The counters are global, so only their change is checked
+	bytes := routeCounter(t, "/test/panic-mid-stream", "bytes")
+	errors := routeCounter(t, "/test/panic-mid-stream", "errors")
+	requests := routeCounter(t, "/test/panic-early", "requests")
+
+	// Once the response has started, the connection is aborted
+	func() {
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Errorf("expected http.ErrAbortHandler, got %v", err)
+			}
+		}()
+		midStream(httptest.NewRecorder(), httptest.NewRequest("GET", "/download", nil))
+	}()
+
+	if got := routeCounter(t, "/test/panic-mid-stream", "bytes") - bytes; got != written {
+		t.Errorf("expected the %d bytes sent before the panic to be counted, got %d", written, got)
+	}
+	if got := routeCounter(t, "/test/panic-mid-stream", "errors") - errors; got != 1 {
+		t.Errorf("expected the panic to count as an error, got %d", got)
+	}
+
+	// Before it has started, the client gets a 500
+	w := httptest.NewRecorder()
+	early(w, httptest.NewRequest("GET", "/download", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	if got := routeCounter(t, "/test/panic-early", "requests") - requests; got != 1 {
+		t.Errorf("expected 1 request counted, got %d", got)
+	}
+
+	if n := monitor.inFlight.Load(); n != 0 {
+		t.Errorf("expected no speed tests in flight, got %d", n)
+	}
+	if n := handlers.active.Load(); n != 0 {
+		t.Errorf("expected no active handlers, got %d", n)
+	}
+}
@@ -0,0 +1,143 @@
+// Package main provides overload protection for the speed test server.
+// This file contains the load gauges and the load-shedding middleware.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateMeter measures throughput in bytes per second, reported over the
+// most recent complete one-second interval.
+type rateMeter struct {
+	mu       sync.Mutex
+	second   int64
+	current  int64
+	previous int64
+}
+
+func (m *rateMeter) roll(now int64) {
+	switch {
+	case now == m.second:
+	case now == m.second+1:
+		m.previous, m.current = m.current, 0
+	default:
+		m.previous, m.current = 0, 0
+	}
+	m.second = now
+}
+
+func (m *rateMeter) add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.roll(clock().Unix())
+	m.current += int64(n)
+}
+
+func (m *rateMeter) rate() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.roll(clock().Unix())
+	return m.previous
+}
+
+// loadMonitor tracks the gauges used to decide whether the server is
+// overloaded: the number of in-flight speed-test requests and the egress
+// bandwidth they are producing.
+type loadMonitor struct {
+	inFlight atomic.Int64
+	egress   rateMeter
+
+	maxInFlight int64
+	maxEgress   int64 // bytes per second
+	retryAfter  time.Duration
+}
+
+func newLoadMonitor(maxInFlight int, maxEgressMbps float64, retryAfter time.Duration) *loadMonitor {
+	return &loadMonitor{
+		maxInFlight: int64(maxInFlight),
+		maxEgress:   int64(maxEgressMbps * 1e6 / 8),
+		retryAfter:  retryAfter,
+	}
+}
+
+// overloaded reports whether a request should be shed, and why, given the
+// number of in-flight requests including itself.
+func (m *loadMonitor) overloaded(inFlight int64) (string, bool) {
+	if m.maxInFlight > 0 && inFlight > m.maxInFlight {
+		return "too many tests in progress", true
+	}
+	if m.maxEgress > 0 && m.egress.rate() >= m.maxEgress {
+		return "egress bandwidth limit reached", true
+	}
+	return "", false
+}
+
+// meteredWriter reports the number of bytes written to the client to count.
+type meteredWriter struct {
+	http.ResponseWriter
+	count func(n int)
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.count(n)
+	return n, err
+}
+
+func (w *meteredWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *meteredWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Hijack hands over the connection, for WebSocket upgrades. Bytes written
+// to it afterwards are not counted.
+func (w *meteredWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *meteredWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withLoadShedding rejects new requests with 503 Service Unavailable while
+// the server is overloaded, rather than letting every in-progress test
+// degrade. Accepted requests are counted towards the load gauges.
+func withLoadShedding(monitor *loadMonitor, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inFlight := monitor.inFlight.Add(1)
+		defer monitor.inFlight.Add(-1)
+
+		if reason, busy := monitor.overloaded(inFlight); busy {
+			retryAfter := int(math.Ceil(monitor.retryAfter.Seconds()))
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+			w.Header().Set(rejectedByHeader, "overload")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Error:      "Server busy: " + reason,
+				RetryAfter: retryAfter,
+			})
+			return
+		}
+
+		handler(&meteredWriter{ResponseWriter: w, count: monitor.egress.add}, r)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadSheddingInFlight(t *testing.T) {
+	monitor := newLoadMonitor(2, 0, 7*time.Second)
+
+	release := make(chan struct{})
+	var entered sync.WaitGroup
+	entered.Add(2)
+	blocking := func(w http.ResponseWriter, r *http.Request) {
+		entered.Done()
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}
+	handler := withLoadShedding(monitor, blocking)
+
+	// Fill the server up to its in-flight threshold
+	var done sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/download", nil))
+		}()
+	}
+	entered.Wait()
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/download", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "7" {
+		t.Errorf("expected Retry-After 7, got %q", ra)
+	}
+
+	var response ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Error == "" || response.RetryAfter != 7 {
+		t.Errorf("unexpected error body: %+v", response)
+	}
+
+	close(release)
+	done.Wait()
+
+	// Once the load drops, requests are served again
+	w = httptest.NewRecorder()
+	withLoadShedding(monitor, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})(w, httptest.NewRequest("GET", "/download", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d after load dropped, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestLoadSheddingEgress(t *testing.T) {
+	fake := useFakeClock(t)
+	monitor := newLoadMonitor(0, 8, time.Second) // 1MB/s
+	// The rate is measured over the last complete second
+	monitor.egress.add(2_000_000)
+	fake.advance(time.Second)
+
+	w := httptest.NewRecorder()
+	withLoadShedding(monitor, pingHandler)(w, httptest.NewRequest("GET", "/ping", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
@@ -0,0 +1,130 @@
+// Package main provides download payload generation for the speed test server.
+// This file contains the precomputed random pattern downloads are cut from,
+// and the operator-supplied payload file that can replace it.
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// payloadPatternSize is the size of the random pattern repeated through
+// every download. It is larger than deflate's 32KB window, so neither the
+// diagnostic gzip mode nor any compressing middlebox can shrink the stream
+// by spotting the repetition.
+const payloadPatternSize = 64 * 1024
+
+// randomPattern serves download payloads from a block of random bytes
+// generated once, instead of drawing fresh randomness for every chunk.
+// Clients discard the data, so it only needs to be incompressible, not
+// unpredictable.
+type randomPattern struct {
+	data []byte
+	// next is the offset into data the next fill starts at, advanced by
+	// every fill so consecutive chunks differ
+	next atomic.Uint64
+}
+
+// newRandomPattern returns a pattern of size bytes from crypto/rand.
+func newRandomPattern(size int) *randomPattern {
+	data := make([]byte, size)
+	rand.Read(data)
+	return &randomPattern{data: data}
+}
+
+// fill copies the pattern into p, continuing where the previous fill
+// stopped and wrapping around at the end. It never fails.
+func (rp *randomPattern) fill(p []byte) (int, error) {
+	end := rp.next.Add(uint64(len(p)))
+	offset := int((end - uint64(len(p))) % uint64(len(rp.data)))
+
+	n := 0
+	for n < len(p) {
+		copied := copy(p[n:], rp.data[offset:])
+		n += copied
+		offset = 0
+	}
+	return n, nil
+}
+
+// filePayload serves download payloads from the contents of a file given
+// with -payload-file, for testing how the network treats particular
+// content. The file is read into memory once at startup.
+type filePayload struct {
+	data []byte
+}
+
+// loadPayloadFile reads the payload file at path. An empty file is an
+// error, as no download could be served from it.
+func loadPayloadFile(path string) (*filePayload, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read payload file: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("payload file " + path + " is empty")
+	}
+	return &filePayload{data: data}, nil
+}
+
+// stream returns a fill function for one download, which reads the file
+// from its beginning and starts over whenever it reaches the end, so a
+// download larger than the file repeats it rather than being cut short.
+func (fp *filePayload) stream() func([]byte) (int, error) {
+	offset := 0
+	return func(p []byte) (int, error) {
+		n := 0
+		for n < len(p) {
+			copied := copy(p[n:], fp.data[offset:])
+			n += copied
+			offset = (offset + copied) % len(fp.data)
+		}
+		return n, nil
+	}
+}
+
+// payloadFile is the payload file downloads are served from, or nil to
+// serve them from payloadSource.
+var payloadFile *filePayload
+
+// Payload fills accepted by the ?fill= parameter of the downloads, and
+// reported in downloadFillHeader, which also reports fillFile when
+// -payload-file replaces the random data
+const (
+	fillRandom = "random"
+	fillZero   = "zero"
+	fillFile   = "file"
+)
+
+// downloadFillHeader names the fill a download was served with
+const downloadFillHeader = "X-Download-Fill"
+
+// parseFill returns the payload fill requested via ?fill=, defaulting to
+// random data.
+func parseFill(r *http.Request) (string, error) {
+	switch fill := r.URL.Query().Get("fill"); fill {
+	case "", fillRandom:
+		return fillRandom, nil
+	case fillZero:
+		return fillZero, nil
+	default:
+		return "", fmt.Errorf("fill must be %s or %s, got %q", fillRandom, fillZero, fill)
+	}
+}
+
+// zeroFill fills p with zeros, the cheapest payload there is, for
+// measuring raw throughput on links fast enough that even copying the
+// random pattern shows up. Zeros compress to almost nothing, so the
+// result is only meaningful on a path that doesn't compress.
+//
+// It clears each chunk as it is filled rather than sending from a static
+// zero buffer, as the chunk comes from the shared buffer pool and may
+// still hold another download's payload.
+func zeroFill(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
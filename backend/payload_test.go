@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRandomPatternFill(t *testing.T) {
+	pattern := newRandomPattern(4096)
+
+	first, second := make([]byte, 1024), make([]byte, 1024)
+	pattern.fill(first)
+	pattern.fill(second)
+	if bytes.Equal(first, second) {
+		t.Error("expected consecutive chunks to differ")
+	}
+	if !bytes.Equal(second, pattern.data[1024:2048]) {
+		t.Error("expected the second chunk to continue where the first stopped")
+	}
+
+	// A fill running past the end wraps around to the start
+	wrapped := make([]byte, 4096)
+	if n, err := pattern.fill(wrapped); n != len(wrapped) || err != nil {
+		t.Fatalf("expected a full fill, got %d bytes, %v", n, err)
+	}
+	if !bytes.Equal(wrapped[:2048], pattern.data[2048:]) || !bytes.Equal(wrapped[2048:], pattern.data[:2048]) {
+		t.Error("expected the fill to wrap around the pattern")
+	}
+}
+
+func TestRandomPatternIncompressible(t *testing.T) {
+	pattern := newRandomPattern(payloadPatternSize)
+	payload := make([]byte, 4*payloadPatternSize)
+	pattern.fill(payload)
+
+	var compressed bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&compressed, gzip.BestCompression)
+	zw.Write(payload)
+	zw.Close()
+
+	if compressed.Len() < len(payload)*99/100 {
+		t.Errorf("expected the repeated pattern to stay incompressible, %d bytes compressed to %d", len(payload), compressed.Len())
+	}
+}
+
+func TestPayloadFileRepeats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payload.bin")
+	content := []byte(strings.Repeat("0123456789", 100))
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := loadPayloadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := payloadFile
+	payloadFile = file
+	t.Cleanup(func() { payloadFile = previous })
+
+	const size = 4500
+	rr := httptest.NewRecorder()
+	downloadHandler(rr, httptest.NewRequest("GET", fmt.Sprintf("/download?bytes=%d", size), nil))
+
+	expected := bytes.Repeat(content, size/len(content)+1)[:size]
+	if !bytes.Equal(rr.Body.Bytes(), expected) {
+		t.Errorf("expected %d bytes repeating the file, got %d bytes", size, rr.Body.Len())
+	}
+	if fill := rr.Header().Get(downloadFillHeader); fill != fillFile {
+		t.Errorf("expected the download to report the %s fill, got %q", fillFile, fill)
+	}
+}
+
+func TestDownloadFill(t *testing.T) {
+	const size = 64 * 1024
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		fill   string
+		zeros  bool
+	}{
+		{"Default", "", 200, fillRandom, false},
+		{"Random", "&fill=random", 200, fillRandom, false},
+		{"Zero", "&fill=zero", 200, fillZero, true},
+		{"Unknown", "&fill=ones", 400, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			downloadHandler(rr, httptest.NewRequest("GET", fmt.Sprintf("/download?bytes=%d%s", size, tt.query), nil))
+			if rr.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, rr.Code)
+			}
+			if tt.status != 200 {
+				return
+			}
+			if fill := rr.Header().Get(downloadFillHeader); fill != tt.fill {
+				t.Errorf("expected the %s fill to be reported, got %q", tt.fill, fill)
+			}
+			if rr.Body.Len() != size {
+				t.Fatalf("expected %d bytes, got %d", size, rr.Body.Len())
+			}
+			if zeros := bytes.Equal(rr.Body.Bytes(), make([]byte, size)); zeros != tt.zeros {
+				t.Errorf("expected an all-zero payload %v, got %v", tt.zeros, zeros)
+			}
+		})
+	}
+}
+
+func TestPayloadFileEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.bin")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPayloadFile(path); err == nil {
+		t.Error("expected an empty payload file to be rejected")
+	}
+	if _, err := loadPayloadFile(filepath.Join(t.TempDir(), "missing.bin")); err == nil {
+		t.Error("expected a missing payload file to be rejected")
+	}
+}
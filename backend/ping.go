@@ -0,0 +1,231 @@
+// Package main provides latency measurement extensions for the speed test server.
+// This file contains the burst-ping and multi-ping endpoints for jitter and
+// RTT variance and the directional /rtt endpoint.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultBurstCount is the number of samples sent when ?n= is omitted
+	defaultBurstCount = 10
+	// maxBurstCount bounds the number of samples in one burst
+	maxBurstCount = 100
+	// defaultBurstInterval is the sample spacing when ?interval= is omitted
+	defaultBurstInterval = 20 * time.Millisecond
+	// minBurstInterval and maxBurstInterval bound the sample spacing
+	minBurstInterval = 5 * time.Millisecond
+	maxBurstInterval = time.Second
+	// maxBurstWarmup bounds the number of warmup samples sent ahead of a burst
+	maxBurstWarmup = 10
+
+	// defaultMultiPingCount is the number of samples taken when ?count= is omitted
+	defaultMultiPingCount = 10
+	// maxMultiPingCount bounds the number of samples in one multi-ping
+	maxMultiPingCount = 100
+	// multiPingSpacing is the pause between multi-ping samples
+	multiPingSpacing = time.Millisecond
+)
+
+// parseBurst returns the sample count and interval requested via ?n= and
+// ?interval=, applying defaults and validating them against the bounds.
+func parseBurst(r *http.Request) (int, time.Duration, error) {
+	count, interval := defaultBurstCount, defaultBurstInterval
+
+	if value := r.URL.Query().Get("n"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxBurstCount {
+			return 0, 0, fmt.Errorf("n must be between 1 and %d", maxBurstCount)
+		}
+		count = n
+	}
+
+	if value := r.URL.Query().Get("interval"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < minBurstInterval || d > maxBurstInterval {
+			return 0, 0, fmt.Errorf("interval must be a duration between %v and %v", minBurstInterval, maxBurstInterval)
+		}
+		interval = d
+	}
+
+	return count, interval, nil
+}
+
+// parseBurstWarmup returns the number of warmup samples requested via
+// ?warmup=, or 0 if the client did not ask for any.
+func parseBurstWarmup(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("warmup")
+	if value == "" {
+		return 0, nil
+	}
+	warmup, err := strconv.Atoi(value)
+	if err != nil || warmup < 0 || warmup > maxBurstWarmup {
+		return 0, fmt.Errorf("warmup must be between 0 and %d", maxBurstWarmup)
+	}
+	return warmup, nil
+}
+
+// burstPingHandler streams n server timestamps spaced by interval within a
+// single chunked response, one JSON PingResponse per line, flushing each as
+// it is written. The client measures inter-arrival jitter to estimate RTT
+// variance from one request.
+//
+// With ?warmup=, that many extra samples are sent first, flagged as
+// warmup, so the cold-start latency of a new connection or proxy path
+// does not skew the measured samples.
+func burstPingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	count, interval, err := parseBurst(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	warmup, err := parseBurstWarmup(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	encoder := json.NewEncoder(w)
+	for i := 0; i < warmup+count; i++ {
+		if i > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-shuttingDown(r):
+				// Every sample sent so far is a complete line
+				return
+			case <-ticker.C:
+			}
+		}
+
+		if err := encoder.Encode(PingResponse{Timestamp: clock().UnixNano(), Warmup: i < warmup}); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// MultiPingResponse carries the samples of one /multiping request.
+type MultiPingResponse struct {
+	// Samples are the server timestamps, in the order they were taken
+	Samples []PingResponse `json:"samples"`
+	// DeltasNs are the monotonic-clock nanoseconds between consecutive
+	// samples, unaffected by wall-clock adjustments
+	DeltasNs []int64 `json:"deltasNs"`
+}
+
+// parseMultiPingCount returns the sample count requested via ?count=.
+func parseMultiPingCount(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("count")
+	if value == "" {
+		return defaultMultiPingCount, nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 || count > maxMultiPingCount {
+		return 0, fmt.Errorf("count must be between 1 and %d", maxMultiPingCount)
+	}
+	return count, nil
+}
+
+// multiPingHandler takes count server timestamps in a tight loop, pausing
+// multiPingSpacing between them, and returns them in one JSON response.
+// Unlike /ping/burst the samples are not streamed, so the client gets
+// them all at once.
+func multiPingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	count, err := parseMultiPingCount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := MultiPingResponse{
+		Samples:  make([]PingResponse, 0, count),
+		DeltasNs: make([]int64, 0, count-1),
+	}
+	var previous time.Time
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(multiPingSpacing):
+			}
+		}
+
+		now := clock()
+		response.Samples = append(response.Samples, PingResponse{Timestamp: now.UnixNano()})
+		if i > 0 {
+			response.DeltasNs = append(response.DeltasNs, now.Sub(previous).Nanoseconds())
+		}
+		previous = now
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RTTResponse carries the timestamps of one /rtt exchange, all Unix
+// timestamps in nanoseconds. With T4, the time the client received the
+// response, the client estimates the one-way delays T2-T1 (client to
+// server) and T4-T3 (server to client); these include the clock offset
+// between the hosts, which cancels out in their sum.
+type RTTResponse struct {
+	// T1 is the client's send time, echoed back
+	T1 int64 `json:"t1"`
+	// T2 is when the server received the request
+	T2 int64 `json:"t2"`
+	// T3 is when the server sent the response
+	T3 int64 `json:"t3"`
+}
+
+// rttHandler timestamps a request on arrival and again just before the
+// response is written, echoing the client's ?t1= send time.
+func rttHandler(w http.ResponseWriter, r *http.Request) {
+	received := clock()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t1, err := strconv.ParseInt(r.URL.Query().Get("t1"), 10, 64)
+	if err != nil {
+		http.Error(w, "t1 must be the client's send time as a Unix timestamp in nanoseconds", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RTTResponse{
+		T1: t1,
+		T2: received.UnixNano(),
+		T3: clock().UnixNano(),
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBurstPingHandler(t *testing.T) {
+	req := httptest.NewRequest("GET", "/ping/burst?n=5&interval=10ms", nil)
+	w := httptest.NewRecorder()
+
+	burstPingHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var timestamps []int64
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var sample PingResponse
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			t.Fatal(err)
+		}
+		timestamps = append(timestamps, sample.Timestamp)
+	}
+
+	if len(timestamps) != 5 {
+		t.Fatalf("expected 5 samples, got %d", len(timestamps))
+	}
+	for i := 1; i < len(timestamps); i++ {
+		if timestamps[i] <= timestamps[i-1] {
+			t.Errorf("timestamps not increasing at %d: %d <= %d", i, timestamps[i], timestamps[i-1])
+		}
+		if gap := time.Duration(timestamps[i] - timestamps[i-1]); gap < 5*time.Millisecond {
+			t.Errorf("samples %d and %d only %v apart", i-1, i, gap)
+		}
+	}
+}
+
+func TestBurstPingHandlerWarmup(t *testing.T) {
+	w := httptest.NewRecorder()
+	burstPingHandler(w, httptest.NewRequest("GET", "/ping/burst?n=4&warmup=3&interval=5ms", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var samples []PingResponse
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var sample PingResponse
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, sample)
+	}
+
+	if len(samples) != 7 {
+		t.Fatalf("expected 3 warmup and 4 measured samples, got %d", len(samples))
+	}
+	for i, sample := range samples {
+		if sample.Warmup != (i < 3) {
+			t.Errorf("sample %d: expected warmup=%v, got %v", i, i < 3, sample.Warmup)
+		}
+	}
+}
+
+func TestBurstPingHandlerCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/ping/burst?n=100&interval=1s", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	burstPingHandler(w, req)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("handler took %v to stop after cancellation", elapsed)
+	}
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 1 {
+		t.Errorf("expected 1 sample before cancellation, got %d", lines)
+	}
+}
+
+func TestBurstPingHandlerBounds(t *testing.T) {
+	for _, target := range []string{"/ping/burst?n=0", "/ping/burst?n=101", "/ping/burst?interval=1ms", "/ping/burst?interval=soon", "/ping/burst?warmup=-1", "/ping/burst?warmup=11"} {
+		w := httptest.NewRecorder()
+		burstPingHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", target, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestMultiPingHandler(t *testing.T) {
+	tests := []struct {
+		target string
+		count  int
+	}{
+		{"/multiping", defaultMultiPingCount},
+		{"/multiping?count=3", 3},
+		{fmt.Sprintf("/multiping?count=%d", maxMultiPingCount), maxMultiPingCount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			multiPingHandler(w, httptest.NewRequest("GET", tt.target, nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			var response MultiPingResponse
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Samples) != tt.count || len(response.DeltasNs) != tt.count-1 {
+				t.Fatalf("expected %d samples and %d deltas, got %d and %d", tt.count, tt.count-1, len(response.Samples), len(response.DeltasNs))
+			}
+			for i, delta := range response.DeltasNs {
+				if delta < int64(multiPingSpacing) {
+					t.Errorf("samples %d and %d only %dns apart", i, i+1, delta)
+				}
+				if response.Samples[i+1].Timestamp <= response.Samples[i].Timestamp {
+					t.Errorf("timestamps not increasing at %d", i+1)
+				}
+			}
+		})
+	}
+
+	for _, target := range []string{"/multiping?count=0", "/multiping?count=101", "/multiping?count=many"} {
+		w := httptest.NewRecorder()
+		multiPingHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", target, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestRTTHandler(t *testing.T) {
+	t1 := time.Now().UnixNano()
+	w := httptest.NewRecorder()
+	rttHandler(w, httptest.NewRequest("GET", fmt.Sprintf("/rtt?t1=%d", t1), nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var response RTTResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.T1 != t1 {
+		t.Errorf("expected t1 %d to be echoed, got %d", t1, response.T1)
+	}
+	if response.T2 == 0 || response.T3 == 0 {
+		t.Fatalf("expected both server timestamps, got t2=%d t3=%d", response.T2, response.T3)
+	}
+	if response.T2 < t1 || response.T3 < response.T2 {
+		t.Errorf("expected t1 <= t2 <= t3, got %d, %d, %d", t1, response.T2, response.T3)
+	}
+
+	w = httptest.NewRecorder()
+	rttHandler(w, httptest.NewRequest("GET", "/rtt", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d without t1, got %d", http.StatusBadRequest, w.Code)
+	}
+}
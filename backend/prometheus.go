@@ -0,0 +1,63 @@
+// Package main provides Prometheus metrics for the speed test server.
+// This file contains the transfer counters and the /metrics handler that
+// renders them, along with the per-route counters, in the Prometheus text
+// exposition format.
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// transferTotals counts the payload bytes moved by speed tests and the
+// requests refused by rate limiting since startup.
+var transferTotals struct {
+	downloadBytes atomic.Int64
+	uploadBytes   atomic.Int64
+	rateLimited   atomic.Int64
+}
+
+// labelEscaper escapes a Prometheus label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsHandler renders the server's counters for a Prometheus scraper.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	counter("pinguen_download_bytes_total", "Payload bytes sent by downloads.", transferTotals.downloadBytes.Load())
+	counter("pinguen_upload_bytes_total", "Payload bytes received by uploads.", transferTotals.uploadBytes.Load())
+	counter("pinguen_rate_limited_requests_total", "Requests refused with 429 by rate limiting.", transferTotals.rateLimited.Load())
+
+	// The per-route counters are the ones published at /debug/vars
+	var routes []string
+	routeStats.Do(func(kv expvar.KeyValue) { routes = append(routes, kv.Key) })
+	slices.Sort(routes)
+	for _, metric := range []struct{ name, counter, help string }{
+		{"pinguen_requests_total", "requests", "Requests served, by route."},
+		{"pinguen_response_bytes_total", "bytes", "Response body bytes written, by route."},
+		{"pinguen_request_errors_total", "errors", "Requests that failed with status 400 or above, by route."},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+		for _, route := range routes {
+			var value int64
+			if v, ok := routeCounters(route).Get(metric.counter).(*expvar.Int); ok {
+				value = v.Value()
+			}
+			fmt.Fprintf(&b, "%s{route=\"%s\"} %d\n", metric.name, labelEscaper.Replace(route), value)
+		}
+	}
+
+	if clientMetrics != nil {
+		clientMetrics.writeMetrics(&b)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
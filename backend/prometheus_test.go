@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics fetches /metrics from the mux and returns each sample's
+// value keyed by its name and labels.
+func scrapeMetrics(t *testing.T, mux *http.ServeMux) map[string]int64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected /metrics status %d, got %d", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected the Prometheus text format, got Content-Type %q", ct)
+	}
+
+	samples := make(map[string]int64)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, value, ok := strings.Cut(line, " ")
+		if !ok {
+			t.Fatalf("malformed sample line %q", line)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			t.Fatalf("malformed sample value in %q", line)
+		}
+		samples[series] = n
+	}
+	return samples
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	mux := newMux(defaultConfig(), newRateLimiter(1, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	before := scrapeMetrics(t, mux)
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/download?bytes=4096", nil))
+	upload := httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("a", 2048)))
+	mux.ServeHTTP(httptest.NewRecorder(), upload)
+
+	// The limit of one request was used by the download
+	if tooMany := scrapeMetrics(t, mux)["pinguen_rate_limited_requests_total"]; tooMany <= before["pinguen_rate_limited_requests_total"] {
+		t.Error("expected the rejected upload to be counted as rate limited")
+	}
+
+	mux = newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	upload = httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("a", 2048)))
+	mux.ServeHTTP(httptest.NewRecorder(), upload)
+	after := scrapeMetrics(t, mux)
+
+	tests := []struct {
+		series string
+		delta  int64
+	}{
+		{"pinguen_download_bytes_total", 4096},
+		{"pinguen_upload_bytes_total", 2048},
+		{`pinguen_requests_total{route="/download"}`, 1},
+		{`pinguen_requests_total{route="/upload"}`, 2},
+	}
+	for _, tt := range tests {
+		if got := after[tt.series] - before[tt.series]; got != tt.delta {
+			t.Errorf("expected %s to grow by %d, got %d", tt.series, tt.delta, got)
+		}
+	}
+}
+
+func TestMetricsNotRateLimited(t *testing.T) {
+	mux := newMux(defaultConfig(), newRateLimiter(1, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	for i := 0; i < 3; i++ {
+		scrapeMetrics(t, mux)
+	}
+}
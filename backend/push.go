@@ -0,0 +1,60 @@
+// Package main provides the experimental server-push download of the
+// speed test server. This file contains the /download/push endpoint, which
+// pushes the payload to HTTP/2 clients instead of waiting for their GET.
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// downloadPushHeader reports how /download/push delivered the payload:
+// "pushed" when it was promised as an HTTP/2 push of /download, or
+// "fallback" when it was sent in the response body.
+const downloadPushHeader = "X-Download-Push"
+
+// downloadPushHandler pushes /download with the same query to the client,
+// answering 204 No Content once the push is promised, so the payload
+// arrives on a stream the client never requested. The pushed request goes
+// through the /download route like any other, so it is rate limited and
+// logged on its own. Where push is unavailable, over HTTP/1.x or to a
+// client that disabled it, the payload is sent in the response body as
+// /download would.
+func downloadPushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	size, err := parseDownloadSize(r, activeConfig.MaxDownloadBytes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if pusher, ok := w.(http.Pusher); ok {
+		target := "/download"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		// The promised request carries no headers of its own, so pass on
+		// the gateway's proof that the client came through it
+		header := http.Header{}
+		if activeConfig.GatewaySecret != "" {
+			header.Set(activeConfig.GatewayHeader, r.Header.Get(activeConfig.GatewayHeader))
+		}
+		err := pusher.Push(target, &http.PushOptions{Header: header})
+		if err == nil {
+			w.Header().Set(downloadPushHeader, "pushed")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Error pushing %s to %s: %v", target, clientIP(r), err)
+		}
+	}
+
+	w.Header().Set(downloadPushHeader, "fallback")
+	sendDownload(w, r, size, 0)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// pushRecorder is a ResponseRecorder of a connection that supports HTTP/2
+// server push, remembering the targets pushed.
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	targets []string
+}
+
+func (w *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	w.targets = append(w.targets, target)
+	return nil
+}
+
+func TestDownloadPush(t *testing.T) {
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	w := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/download/push?bytes=1024", nil))
+
+	if len(w.targets) != 1 || w.targets[0] != "/download?bytes=1024" {
+		t.Fatalf("expected a push of /download?bytes=1024, got %v", w.targets)
+	}
+	if w.Code != http.StatusNoContent || w.Header().Get(downloadPushHeader) != "pushed" {
+		t.Errorf("expected status %d with %s pushed, got %d and %q", http.StatusNoContent, downloadPushHeader, w.Code, w.Header().Get(downloadPushHeader))
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expected the payload only on the pushed stream, got %d body bytes", w.Body.Len())
+	}
+}
+
+func TestDownloadPushFallback(t *testing.T) {
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/download/push?bytes=1024", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 1024 || w.Header().Get(downloadPushHeader) != "fallback" {
+		t.Errorf("expected the 1024-byte payload in the body without push support, got status %d, %d bytes and %q", w.Code, w.Body.Len(), w.Header().Get(downloadPushHeader))
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/download/push?bytes=-1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for a bad size, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestDownloadPushOverHTTP2(t *testing.T) {
+	// Record whether the handler was offered push on the h2 connection
+	var offered bool
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, offered = w.(http.Pusher)
+		mux.ServeHTTP(w, r)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/download/push?bytes=1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ProtoMajor != 2 || !offered {
+		t.Fatalf("expected an HTTP/2 connection offering push, got %s", resp.Proto)
+	}
+	// Go's client refuses pushes, so the server attempts one and falls
+	// back to the response body
+	if resp.StatusCode != http.StatusOK || len(body) != 1024 || resp.Header.Get(downloadPushHeader) != "fallback" {
+		t.Errorf("expected the 1024-byte payload in the body, got status %d, %d bytes and %q", resp.StatusCode, len(body), resp.Header.Get(downloadPushHeader))
+	}
+}
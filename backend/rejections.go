@@ -0,0 +1,159 @@
+// Package main provides rate-limit diagnostics for the speed test server.
+// This file contains the per-client rejection tracker behind
+// /debug/ratelimit/top.
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// rejectionWindow is how long a client's rejections are counted before
+	// its count starts over
+	rejectionWindow = time.Hour
+	// rejectionTrackerCap bounds the number of clients tracked; the client
+	// rejected least recently is forgotten to make room for a new one
+	rejectionTrackerCap = 1024
+	// defaultRejectionTop and maxRejectionTop bound ?n= of /debug/ratelimit/top
+	defaultRejectionTop = 10
+	maxRejectionTop     = 100
+)
+
+// rejectionCount is one client's rate-limit rejections in its current window.
+type rejectionCount struct {
+	ip    string
+	count int
+	start time.Time
+}
+
+// rejectionTracker counts the rate-limit rejections of each client, so
+// operators can tell a single broken client hammering the server from a
+// distributed attack. Memory is bounded by keeping only the maxClients
+// clients rejected most recently.
+type rejectionTracker struct {
+	mu         sync.Mutex
+	maxClients int
+	window     time.Duration
+	order      *list.List // of *rejectionCount, most recently rejected first
+	clients    map[string]*list.Element
+}
+
+func newRejectionTracker(maxClients int, window time.Duration) *rejectionTracker {
+	return &rejectionTracker{
+		maxClients: maxClients,
+		window:     window,
+		order:      list.New(),
+		clients:    make(map[string]*list.Element),
+	}
+}
+
+// record counts a rejection of ip.
+func (t *rejectionTracker) record(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := clock()
+	if element, ok := t.clients[ip]; ok {
+		entry := element.Value.(*rejectionCount)
+		if now.Sub(entry.start) >= t.window {
+			entry.count, entry.start = 0, now
+		}
+		entry.count++
+		t.order.MoveToFront(element)
+		return
+	}
+
+	if t.order.Len() >= t.maxClients {
+		oldest := t.order.Back()
+		delete(t.clients, oldest.Value.(*rejectionCount).ip)
+		t.order.Remove(oldest)
+	}
+	t.clients[ip] = t.order.PushFront(&rejectionCount{ip: ip, count: 1, start: now})
+}
+
+// top returns up to n clients with the most rejections in their current
+// window, most rejected first.
+func (t *rejectionTracker) top(n int) []RejectedClient {
+	t.mu.Lock()
+	now := clock()
+	clients := []RejectedClient{}
+	for element := t.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*rejectionCount)
+		if now.Sub(entry.start) < t.window {
+			clients = append(clients, RejectedClient{IP: entry.ip, Rejections: entry.count})
+		}
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(clients, func(a, b RejectedClient) int {
+		if c := cmp.Compare(b.Rejections, a.Rejections); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.IP, b.IP)
+	})
+	return clients[:min(n, len(clients))]
+}
+
+// rateLimitRejections tracks the clients refused by withRateLimit.
+var rateLimitRejections = newRejectionTracker(rejectionTrackerCap, rejectionWindow)
+
+// RejectedClient is one entry of /debug/ratelimit/top.
+type RejectedClient struct {
+	IP         string `json:"ip"`
+	Rejections int    `json:"rejections"`
+}
+
+// RejectionTopResponse is the JSON body of /debug/ratelimit/top.
+type RejectionTopResponse struct {
+	// WindowSeconds is how long each client's rejections are counted
+	// before starting over
+	WindowSeconds int64            `json:"windowSeconds"`
+	Clients       []RejectedClient `json:"clients"`
+}
+
+// rejectionTopHandler reports the clients rejected most by rate limiting,
+// as many as ?n= asks for.
+func rejectionTopHandler(tracker *rejectionTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := defaultRejectionTop
+		if value := r.URL.Query().Get("n"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > maxRejectionTop {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("n must be between 1 and %d", maxRejectionTop))
+				return
+			}
+			n = parsed
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(RejectionTopResponse{
+			WindowSeconds: int64(tracker.window.Seconds()),
+			Clients:       tracker.top(n),
+		})
+	}
+}
+
+// requireDebugToken refuses requests with 401 Unauthorized unless they
+// carry "Authorization: Bearer <token>".
+func requireDebugToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pinguen debug"`)
+			w.Header().Set(rejectedByHeader, "debug-token")
+			writeError(w, http.StatusUnauthorized, "debug token required")
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRejectionTopRanking(t *testing.T) {
+	useFakeClock(t)
+	tracker := newRejectionTracker(rejectionTrackerCap, rejectionWindow)
+	previous := rateLimitRejections
+	rateLimitRejections = tracker
+	t.Cleanup(func() { rateLimitRejections = previous })
+
+	// Each client is allowed one request; every further one is rejected
+	handler := withRateLimit(newRateLimiter(1, defaultRateWindow), pingHandler)
+	for client, requests := range map[string]int{"203.0.113.1": 2, "203.0.113.2": 5, "203.0.113.3": 3, "203.0.113.4": 1} {
+		for i := 0; i < requests; i++ {
+			r := httptest.NewRequest("GET", "/ping", nil)
+			r.RemoteAddr = client
+			handler(httptest.NewRecorder(), r)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.DebugToken = "secret"
+	mux := newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/debug/ratelimit/top?n=2", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	mux.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var response RejectionTopResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	expected := []RejectedClient{{"203.0.113.2", 4}, {"203.0.113.3", 2}}
+	if !reflect.DeepEqual(response.Clients, expected) {
+		t.Errorf("expected top clients %v, got %v", expected, response.Clients)
+	}
+}
+
+func TestRejectionTrackerBounds(t *testing.T) {
+	fake := useFakeClock(t)
+	tracker := newRejectionTracker(2, time.Minute)
+
+	tracker.record("a")
+	tracker.record("a")
+	tracker.record("b")
+	tracker.record("c") // evicts a, the client rejected least recently
+	if got := tracker.top(10); !reflect.DeepEqual(got, []RejectedClient{{"b", 1}, {"c", 1}}) {
+		t.Errorf("expected the least recently rejected client to be evicted, got %v", got)
+	}
+
+	fake.advance(time.Minute)
+	if got := tracker.top(10); len(got) != 0 {
+		t.Errorf("expected counts to expire with the window, got %v", got)
+	}
+	tracker.record("b")
+	if got := tracker.top(10); !reflect.DeepEqual(got, []RejectedClient{{"b", 1}}) {
+		t.Errorf("expected a new window to start from zero, got %v", got)
+	}
+}
+
+func TestRejectionTopAuthentication(t *testing.T) {
+	cfg := defaultConfig()
+	mux := newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/ratelimit/top", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d without -debug-token, got %d", http.StatusNotFound, w.Code)
+	}
+
+	cfg.DebugToken = "secret"
+	mux = newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	for _, authorization := range []string{"", "Bearer wrong", "secret"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/debug/ratelimit/top", nil)
+		r.Header.Set("Authorization", authorization)
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: expected status %d, got %d", authorization, http.StatusUnauthorized, w.Code)
+		}
+	}
+}
+
+func TestRejectionTopGateway(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DebugToken = "secret"
+	cfg.GatewaySecret = "s3cret"
+	mux := newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	for gateway, status := range map[string]int{"": http.StatusForbidden, "s3cret": http.StatusOK} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/debug/ratelimit/top", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		if gateway != "" {
+			r.Header.Set("X-Gateway-Secret", gateway)
+		}
+		mux.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Errorf("gateway secret %q: expected status %d, got %d", gateway, status, w.Code)
+		}
+	}
+}
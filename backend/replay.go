@@ -0,0 +1,236 @@
+// Package main provides the replay client of the speed test server.
+// This file contains the -replay mode, in which the binary replays a
+// recorded profile of requests against a target server instead of serving,
+// to benchmark the server reproducibly.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request kinds a replay profile may contain
+const (
+	replayPing     = "ping"
+	replayDownload = "download"
+	replayUpload   = "upload"
+)
+
+// replayRequestTimeout bounds each replayed request, including reading its
+// response, so a target that stops responding fails the request instead of
+// hanging the replay
+const replayRequestTimeout = 2 * time.Minute
+
+// ReplayProfile is a recorded sequence of requests, loaded from the file
+// given with -replay.
+type ReplayProfile struct {
+	Requests []ReplayRequest `json:"requests"`
+}
+
+// ReplayRequest is one request of a replay profile.
+type ReplayRequest struct {
+	// AtMs is when the request is sent, in milliseconds after the replay
+	// starts. Requests due at the same time are sent concurrently.
+	AtMs int64 `json:"atMs"`
+	// Kind is "ping", "download" or "upload"
+	Kind string `json:"kind"`
+	// Bytes is the size of a download or upload; a download without one
+	// gets the target's default size
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+// ReplayReport summarizes a replay, printed as JSON once every request has
+// finished.
+type ReplayReport struct {
+	// Requests is the number of requests in the profile
+	Requests int `json:"requests"`
+	// Completed is the number that succeeded, and Failed the number that
+	// got an error or a response other than 200 OK
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+	// Bytes is the total downloaded and uploaded by the completed requests
+	Bytes int64 `json:"bytes"`
+	// DurationMs is the time from the start of the replay until the last
+	// request finished
+	DurationMs int64 `json:"durationMs"`
+	// Mbps is Bytes over the whole replay in megabits per second
+	Mbps float64 `json:"mbps"`
+	// Latency is the distribution of the completed requests' durations
+	Latency LatencySummary `json:"latency"`
+}
+
+// loadReplayProfile reads and checks the profile at path.
+func loadReplayProfile(path string) (*ReplayProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading replay profile: %w", err)
+	}
+	var profile ReplayProfile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&profile); err != nil {
+		return nil, fmt.Errorf("invalid replay profile %s: %w", path, err)
+	}
+
+	if len(profile.Requests) == 0 {
+		return nil, fmt.Errorf("replay profile %s has no requests", path)
+	}
+	for i, req := range profile.Requests {
+		switch {
+		case req.Kind != replayPing && req.Kind != replayDownload && req.Kind != replayUpload:
+			return nil, fmt.Errorf("replay request %d: kind must be %s, %s or %s, got %q", i, replayPing, replayDownload, replayUpload, req.Kind)
+		case req.AtMs < 0:
+			return nil, fmt.Errorf("replay request %d: atMs must not be negative, got %d", i, req.AtMs)
+		case req.Bytes < 0:
+			return nil, fmt.Errorf("replay request %d: bytes must not be negative, got %d", i, req.Bytes)
+		case req.Kind == replayUpload && req.Bytes == 0:
+			return nil, fmt.Errorf("replay request %d: an upload needs a positive size", i)
+		}
+	}
+	return &profile, nil
+}
+
+// runReplay sends the requests of profile to the server at target, each at
+// its recorded time after the start, and waits for all of them to finish.
+// Failed requests are logged and counted rather than stopping the replay.
+func runReplay(ctx context.Context, client *http.Client, target string, profile *ReplayProfile) ReplayReport {
+	report := ReplayReport{Requests: len(profile.Requests)}
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for i, req := range profile.Requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			timer := time.NewTimer(time.Until(start.Add(time.Duration(req.AtMs) * time.Millisecond)))
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+
+			sent := time.Now()
+			n, err := replayRequest(ctx, client, target, req)
+			elapsed := time.Since(sent)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Replay request %d (%s) failed: %v", i, req.Kind, err)
+				report.Failed++
+				return
+			}
+			report.Completed++
+			report.Bytes += n
+			latencies = append(latencies, elapsed)
+		}()
+	}
+	wg.Wait()
+
+	duration := time.Since(start)
+	report.DurationMs = duration.Milliseconds()
+	report.Mbps = roundRate(transferRate(report.Bytes, duration, unitsBits))
+	report.Latency = summarizeLatency(latencies)
+	return report
+}
+
+// replayRequest sends one request of a profile and reads its response to
+// the end, returning the payload bytes transferred.
+func replayRequest(ctx context.Context, client *http.Client, target string, req ReplayRequest) (int64, error) {
+	var httpReq *http.Request
+	var err error
+	switch req.Kind {
+	case replayPing:
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, target+"/ping", nil)
+	case replayDownload:
+		url := target + "/download"
+		if req.Bytes > 0 {
+			url += fmt.Sprintf("?bytes=%d", req.Bytes)
+		}
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	case replayUpload:
+		body := io.LimitReader(zeroPayload{}, req.Bytes)
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, target+"/upload", body)
+		if err == nil {
+			httpReq.ContentLength = req.Bytes
+			httpReq.Header.Set("Content-Type", "application/octet-stream")
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	received, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %s", resp.Status)
+	}
+
+	switch req.Kind {
+	case replayDownload:
+		// The server may serve another size than requested, clamped to its
+		// limits or padded with -download-size-jitter, so the download is
+		// checked against the size it announced
+		expected := resp.ContentLength
+		if announced, err := strconv.ParseInt(resp.Header.Get("X-Download-Bytes"), 10, 64); err == nil {
+			expected = announced
+		}
+		if expected >= 0 && received != expected {
+			return 0, fmt.Errorf("received %d of %d download bytes", received, expected)
+		}
+		return received, nil
+	case replayUpload:
+		return req.Bytes, nil
+	default:
+		return 0, nil
+	}
+}
+
+// zeroPayload is an endless upload body of zeros, cut to size with
+// io.LimitReader.
+type zeroPayload struct{}
+
+func (zeroPayload) Read(p []byte) (int, error) {
+	return zeroFill(p)
+}
+
+// replay runs the -replay mode: it replays the profile against
+// -replay-target and prints the report to stdout. It fails if the profile
+// can't be loaded or any request failed.
+func replay(cfg *Config) error {
+	profile, err := loadReplayProfile(cfg.Replay)
+	if err != nil {
+		return err
+	}
+	target := strings.TrimSuffix(cfg.ReplayTarget, "/")
+	report := runReplay(context.Background(), &http.Client{Timeout: replayRequestTimeout}, target, profile)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("writing replay report: %w", err)
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d requests failed", report.Failed, report.Requests)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeReplayProfile writes a replay profile to a temporary file, returning
+// its path.
+func writeReplayProfile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "profile.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplay(t *testing.T) {
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	profile, err := loadReplayProfile(writeReplayProfile(t, `{"requests": [
+		{"atMs": 0, "kind": "ping"},
+		{"atMs": 0, "kind": "download", "bytes": 65536},
+		{"atMs": 10, "kind": "upload", "bytes": 32768},
+		{"atMs": 20, "kind": "ping"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := runReplay(context.Background(), server.Client(), server.URL, profile)
+
+	if report.Requests != 4 || report.Completed != 4 || report.Failed != 0 {
+		t.Fatalf("expected all 4 requests to complete, got %+v", report)
+	}
+	if report.Bytes != 65536+32768 {
+		t.Errorf("expected the download and upload bytes to be counted, got %d", report.Bytes)
+	}
+	if report.DurationMs < 20 || report.Latency.Samples != 4 {
+		t.Errorf("expected the replay to follow the recorded timings with 4 latency samples, got %dms and %d", report.DurationMs, report.Latency.Samples)
+	}
+}
+
+func TestReplayResizedDownloads(t *testing.T) {
+	useConfig(t, func(cfg *Config) {
+		cfg.MaxDownloadBytes = 4096
+		cfg.DownloadSizeJitter = 100
+	})
+	server := httptest.NewServer(newMux(activeConfig, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0)))
+	defer server.Close()
+
+	// Sizes below the minimum, above the maximum and padded by the jitter
+	// are all served as the server announces them
+	profile := &ReplayProfile{Requests: []ReplayRequest{
+		{Kind: replayDownload, Bytes: 10},
+		{Kind: replayDownload, Bytes: 1 << 20},
+		{Kind: replayDownload, Bytes: 2048},
+	}}
+	report := runReplay(context.Background(), server.Client(), server.URL, profile)
+	if report.Completed != 3 || report.Failed != 0 {
+		t.Errorf("expected every resized download to complete, got %+v", report)
+	}
+}
+
+func TestReplayFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	profile := &ReplayProfile{Requests: []ReplayRequest{{Kind: replayPing}, {Kind: replayDownload, Bytes: 1024}}}
+	report := runReplay(context.Background(), server.Client(), server.URL, profile)
+	if report.Completed != 0 || report.Failed != 2 {
+		t.Errorf("expected both requests to fail, got %+v", report)
+	}
+}
+
+func TestLoadReplayProfileInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"Empty":           `{"requests": []}`,
+		"Unknown Kind":    `{"requests": [{"kind": "websocket"}]}`,
+		"Negative Time":   `{"requests": [{"atMs": -1, "kind": "ping"}]}`,
+		"Negative Bytes":  `{"requests": [{"kind": "download", "bytes": -1}]}`,
+		"Sizeless Upload": `{"requests": [{"kind": "upload"}]}`,
+		"Unknown Field":   `{"requests": [{"kind": "ping", "delayMs": 5}]}`,
+		"Malformed":       `{"requests": [`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadReplayProfile(writeReplayProfile(t, content)); err == nil {
+				t.Error("expected the profile to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+// Package main provides server lifecycle helpers for the speed test server.
+// This file contains server construction, per-connection state, idle
+// connection reaping, in-flight request tracking and the graceful shutdown
+// path.
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// newServer creates the HTTP server listening on addr. It attaches
+// per-connection state to each connection so handlers can tell whether a
+// request arrived on a reused keep-alive connection, and closes keep-alive
+// connections left idle for idleTimeout, logging and counting each one.
+// Streaming handlers are told through shuttingDown when the server starts
+// shutting down.
+//
+// Over TLS the server offers HTTP/2 in ALPN, so a browser runs parallel
+// download streams over one multiplexed connection instead of opening one
+// HTTP/1.1 connection per stream. Plain HTTP is served as HTTP/1.1 only.
+func newServer(addr string, handler http.HandlerFunc, idleTimeout time.Duration) *http.Server {
+	draining := make(chan struct{})
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	server := &http.Server{
+		Protocols: protocols,
+		Addr:      addr,
+		Handler:   countConnRequests(handler),
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), shutdownKey{}, (<-chan struct{})(draining))
+		},
+		ConnContext: connContext,
+		IdleTimeout: idleTimeout,
+		ConnState:   newIdleReaper(idleTimeout).observe,
+	}
+	server.RegisterOnShutdown(func() { close(draining) })
+	return server
+}
+
+type shutdownKey struct{}
+
+// shuttingDown returns a channel that is closed once the server the request
+// arrived on starts shutting down. Handlers that stream for a long time
+// select on it to end their stream early but cleanly, with a complete
+// response, rather than holding up the shutdown until its timeout cuts
+// the connection. For requests not served by newServer, such as in tests,
+// it returns nil, which is never ready.
+func shuttingDown(r *http.Request) <-chan struct{} {
+	draining, _ := r.Context().Value(shutdownKey{}).(<-chan struct{})
+	return draining
+}
+
+// connStats holds connection counters, published at /debug/vars as
+// "connections": {"idle": n, "idleReaped": n}.
+var connStats = expvar.NewMap("connections")
+
+// idleReaper observes connection state transitions to report the idle
+// keep-alive connections closed by the server's IdleTimeout. The server
+// does the closing; idleReaper only makes it visible.
+type idleReaper struct {
+	timeout time.Duration
+
+	mu        sync.Mutex
+	idleSince map[net.Conn]time.Time
+}
+
+func newIdleReaper(timeout time.Duration) *idleReaper {
+	return &idleReaper{timeout: timeout, idleSince: make(map[net.Conn]time.Time)}
+}
+
+// observe is an http.Server ConnState hook. A connection closed after
+// being idle for at least the timeout is counted as reaped; one closed
+// sooner was closed by the client or a shutdown.
+func (ir *idleReaper) observe(c net.Conn, state http.ConnState) {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+
+	since, wasIdle := ir.idleSince[c]
+	if state == http.StateIdle {
+		if !wasIdle {
+			ir.idleSince[c] = clock()
+			connStats.Add("idle", 1)
+		}
+		return
+	}
+	if !wasIdle {
+		return
+	}
+
+	// The connection is leaving the idle state, either for a new request
+	// or because it was closed
+	delete(ir.idleSince, c)
+	connStats.Add("idle", -1)
+	if idle := clock().Sub(since); state == http.StateClosed && ir.timeout > 0 && idle >= ir.timeout {
+		connStats.Add("idleReaped", 1)
+		log.Printf("Closed idle connection from %s after %v", c.RemoteAddr(), idle.Round(time.Millisecond))
+	}
+}
+
+type connInfoKey struct{}
+
+type connReusedKey struct{}
+
+// connInfo is the state kept for each client connection.
+type connInfo struct {
+	conn     net.Conn
+	requests atomic.Int64
+}
+
+// connContext is an http.Server ConnContext hook that attaches a connInfo
+// to the context of every new connection.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, &connInfo{conn: c})
+}
+
+// countConnRequests counts each request against its connection and records
+// in the request context whether earlier requests used the same connection.
+func countConnRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if info, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok {
+			reused := info.requests.Add(1) > 1
+			r = r.WithContext(context.WithValue(r.Context(), connReusedKey{}, reused))
+		}
+		next(w, r)
+	}
+}
+
+// connReused reports whether the request arrived on a connection that had
+// already served an earlier request.
+func connReused(r *http.Request) bool {
+	reused, _ := r.Context().Value(connReusedKey{}).(bool)
+	return reused
+}
+
+// inFlight tracks handlers that are currently serving a request. Unlike
+// http.Server.Shutdown, which only knows about connections, it lets the
+// shutdown path wait for the handlers themselves to return, so a long
+// download is not cut off mid-stream.
+type inFlight struct {
+	wg     sync.WaitGroup
+	active atomic.Int64
+}
+
+// track registers the handler with the tracker for the duration of each request.
+func (f *inFlight) track(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.wg.Add(1)
+		f.active.Add(1)
+		defer func() {
+			f.active.Add(-1)
+			f.wg.Done()
+		}()
+		next(w, r)
+	}
+}
+
+// wait blocks until all tracked handlers have returned or ctx is done.
+// It reports whether the handlers drained before ctx expired.
+func (f *inFlight) wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shutdown stops the server from accepting new requests and waits up to
+// timeout for in-flight handlers to finish. If they have not drained by
+// then, the remaining connections are forcibly closed.
+//
+// It returns true if every handler completed before the timeout.
+func shutdown(server *http.Server, handlers *inFlight, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Graceful shutdown interrupted: %v", err)
+	}
+
+	if !handlers.wait(ctx) {
+		log.Printf("Timed out with %d request(s) in flight, forcing close", handlers.active.Load())
+		server.Close()
+		return false
+	}
+
+	log.Println("All in-flight requests drained")
+	return true
+}
+
+// stopper runs the shutdown sequence of a server at most once, so a signal
+// delivered twice cannot start a second, concurrent shutdown.
+type stopper struct {
+	server   *http.Server
+	handlers *inFlight
+	timeout  time.Duration
+
+	started  atomic.Bool
+	forced   atomic.Bool
+	done     chan struct{}
+	graceful bool
+}
+
+func newStopper(server *http.Server, handlers *inFlight, timeout time.Duration) *stopper {
+	return &stopper{
+		server:   server,
+		handlers: handlers,
+		timeout:  timeout,
+		done:     make(chan struct{}),
+	}
+}
+
+// stop shuts the server down the first time it is called, as shutdown
+// does. A call made while that shutdown is still draining forces the
+// remaining connections closed instead, and a call made after it finished
+// does nothing. Every call waits for the shutdown to complete and reports
+// whether all handlers drained gracefully.
+func (s *stopper) stop() bool {
+	if s.started.CompareAndSwap(false, true) {
+		drained := shutdown(s.server, s.handlers, s.timeout)
+		s.graceful = drained && !s.forced.Load()
+		close(s.done)
+		return s.graceful
+	}
+
+	select {
+	case <-s.done:
+	default:
+		log.Println("Shutdown already in progress, forcing close")
+		s.forced.Store(true)
+		s.server.Close()
+		<-s.done
+	}
+	return s.graceful
+}
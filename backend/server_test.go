@@ -1,8 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"expvar"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -31,3 +47,381 @@ func TestServerGracefulShutdown(t *testing.T) {
 		t.Errorf("Shutdown failed: %v", err)
 	}
 }
+
+func TestShutdownDrainsInFlightHandler(t *testing.T) {
+	started := make(chan struct{})
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	}
+
+	handlers := &inFlight{}
+	server := &http.Server{Handler: handlers.track(slow)}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{body: string(body), err: err}
+	}()
+
+	<-started
+	if !shutdown(server, handlers, 2*time.Second) {
+		t.Fatal("expected in-flight handler to drain before timeout")
+	}
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("in-flight request failed: %v", res.err)
+	}
+	if res.body != "done" {
+		t.Errorf("expected body %q, got %q", "done", res.body)
+	}
+	if n := handlers.active.Load(); n != 0 {
+		t.Errorf("expected no active handlers after shutdown, got %d", n)
+	}
+}
+
+func TestUploadReportsConnectionReuse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(ln.Addr().String(), uploadHandler, 0)
+	go server.Serve(ln)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}}
+	defer client.CloseIdleConnections()
+
+	for i, expected := range []bool{false, true} {
+		resp, err := client.Post("http://"+ln.Addr().String()+"/upload", "application/octet-stream", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var response UploadResponse
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.ConnectionReused != expected {
+			t.Errorf("request %d: expected ConnectionReused %v, got %v", i+1, expected, response.ConnectionReused)
+		}
+	}
+}
+
+func TestStopperRepeatedSignal(t *testing.T) {
+	started := make(chan struct{})
+	blocked := func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}
+
+	handlers := &inFlight{}
+	server := &http.Server{Handler: handlers.track(blocked)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	go func() {
+		if resp, err := http.Get("http://" + ln.Addr().String()); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	s := newStopper(server, handlers, 10*time.Second)
+	first := make(chan bool, 1)
+	go func() { first <- s.stop() }()
+
+	// A second signal arrives while the first shutdown is draining
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if s.stop() {
+		t.Error("expected the repeated stop to force connections closed")
+	}
+	if !<-first {
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("forced stop took %v", elapsed)
+		}
+	} else {
+		t.Error("expected the first stop to report a forced shutdown")
+	}
+
+	// Further signals after completion are ignored
+	if s.stop() {
+		t.Error("expected the completed shutdown's result to be reported again")
+	}
+	if n := handlers.active.Load(); n != 0 {
+		t.Errorf("expected no active handlers after shutdown, got %d", n)
+	}
+}
+
+func TestStopperConcurrentStops(t *testing.T) {
+	handlers := &inFlight{}
+	server := &http.Server{Handler: handlers.track(pingHandler)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+
+	s := newStopper(server, handlers, time.Second)
+	results := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- s.stop() }()
+	}
+	// Whichever call loses the race may force the close, but both see the
+	// outcome of the single shutdown
+	if a, b := <-results, <-results; a != b {
+		t.Errorf("expected both stops to report the same outcome, got %v and %v", a, b)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("expected Serve to return ErrServerClosed, got %v", err)
+	}
+}
+
+func TestIdleConnectionReaped(t *testing.T) {
+	const idleTimeout = 100 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(ln.Addr().String(), pingHandler, idleTimeout)
+	go server.Serve(ln)
+	defer server.Close()
+
+	reaped := connCounter("idleReaped")
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// One keep-alive request, after which the connection sits idle
+	if _, err := io.WriteString(conn, "GET /ping HTTP/1.1\r\nHost: pinguen\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	idleStart := time.Now()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("expected the server to close the idle connection, got %d bytes, %v", n, err)
+	}
+	if idle := time.Since(idleStart); idle < idleTimeout {
+		t.Errorf("connection closed after %v, before the idle timeout of %v", idle, idleTimeout)
+	}
+
+	// The close is observed just after the client sees it
+	deadline := time.Now().Add(time.Second)
+	for connCounter("idleReaped") == reaped && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := connCounter("idleReaped") - reaped; got != 1 {
+		t.Errorf("expected 1 reaped connection counted, got %d", got)
+	}
+}
+
+// connCounter reads one of the connection counters from expvar.
+func connCounter(name string) int64 {
+	if v, ok := connStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestShutdownEndsStreamingHandler(t *testing.T) {
+	handlers := &inFlight{}
+	server := newServer("", handlers.track(loadTestHandler(time.Minute)), time.Minute)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/loadtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	start := time.Now()
+	drained := make(chan bool, 1)
+	go func() { drained <- shutdown(server, handlers, 5*time.Second) }()
+
+	// The stream ends with a complete body and its summary trailer, instead
+	// of running for its full minute or being cut off
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatalf("expected the stream to end cleanly, got %v", err)
+	}
+	if resp.Trailer.Get("X-Loadtest-Summary") == "" {
+		t.Error("expected the summary trailer after an early end")
+	}
+	if !<-drained {
+		t.Error("expected the streaming handler to drain before the shutdown timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the stream to end promptly on shutdown, took %v", elapsed)
+	}
+}
+
+func TestShutdownEndsTimedDownload(t *testing.T) {
+	handlers := &inFlight{}
+	server := newServer("", handlers.track(downloadHandler), time.Minute)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/download?duration=30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	start := time.Now()
+	drained := make(chan bool, 1)
+	go func() { drained <- shutdown(server, handlers, 5*time.Second) }()
+
+	// The stream ends with a complete body and its byte count, instead of
+	// running for its full duration
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatalf("expected the stream to end cleanly, got %v", err)
+	}
+	if resp.Trailer.Get("X-Download-Bytes") == "" {
+		t.Error("expected the X-Download-Bytes trailer after an early end")
+	}
+	if !<-drained {
+		t.Error("expected the timed download to drain before the shutdown timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the stream to end promptly on shutdown, took %v", elapsed)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key to PEM files in a temporary directory.
+func writeTestCertificate(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestServerAdvertisesHTTP2OverTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	server := newServer("127.0.0.1:0", pingHandler, time.Minute)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, certFile, keyFile)
+	defer server.Close()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "h2" {
+		t.Errorf("expected h2 to be negotiated via ALPN, got %q", protocol)
+	}
+}
+
+func TestTLSResumedHeader(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	server := newServer("127.0.0.1:0", withTLSResumed(pingHandler), time.Minute)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, certFile, keyFile)
+	defer server.Close()
+
+	// Every request opens a new connection, and the second one resumes the
+	// session the first was given a ticket for
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		},
+		DisableKeepAlives: true,
+	}}
+	for i, expected := range []string{"false", "true"} {
+		resp, err := client.Get("https://" + ln.Addr().String() + "/ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resumed := resp.Header.Get(tlsResumedHeader); resumed != expected || resp.TLS.DidResume != (expected == "true") {
+			t.Errorf("connection %d: expected %s %s, got %q", i+1, tlsResumedHeader, expected, resumed)
+		}
+	}
+
+	// Plain HTTP has no session to resume
+	w := httptest.NewRecorder()
+	withTLSResumed(pingHandler)(w, httptest.NewRequest("GET", "/ping", nil))
+	if resumed := w.Header().Get(tlsResumedHeader); resumed != "" {
+		t.Errorf("expected no %s over plain HTTP, got %q", tlsResumedHeader, resumed)
+	}
+}
@@ -0,0 +1,327 @@
+// Package main provides test session tracking for the speed test server.
+// This file contains per-session aggregation of measurements and the
+// session verdict endpoint.
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionTTL is how long a session is kept after its last measurement
+	sessionTTL = 10 * time.Minute
+	// maxSessionStreams bounds the stream index of a parallel-stream session
+	maxSessionStreams = 32
+)
+
+// sessionIDPattern restricts client-supplied session IDs to a safe charset
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// transferStats accumulates the bytes and time spent in one direction.
+type transferStats struct {
+	Bytes    int64
+	Duration time.Duration
+}
+
+// mbps returns the throughput in megabits per second, or 0 if no time was measured.
+func (t transferStats) mbps() float64 {
+	return transferRate(t.Bytes, t.Duration, unitsBits)
+}
+
+// summary converts the stats to their JSON representation, reporting the
+// rate in the given units.
+func (t transferStats) summary(units string) TransferSummary {
+	summary := TransferSummary{
+		Bytes:      t.Bytes,
+		DurationMs: t.Duration.Milliseconds(),
+	}
+	if units == unitsBytes {
+		summary.MBps = roundRate(transferRate(t.Bytes, t.Duration, units))
+	} else {
+		summary.Mbps = roundRate(t.mbps())
+	}
+	return summary
+}
+
+// session aggregates the measurements a client made under one session ID.
+type session struct {
+	download transferStats
+	upload   transferStats
+	// downloadStreams and uploadStreams track each stream of a parallel
+	// test separately
+	downloadStreams map[int]transferStats
+	uploadStreams   map[int]transferStats
+	// adaptive tracks the escalation of /download/adaptive within the session
+	adaptive adaptiveState
+	lastSeen time.Time
+}
+
+// sessionStore holds active sessions, expiring them after a period of inactivity.
+type sessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]*session
+	ttl       time.Duration
+	nextSweep time.Time
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{
+		sessions: make(map[string]*session),
+		ttl:      ttl,
+	}
+}
+
+// sessions is the process-wide session store used by the handlers.
+var sessions = newSessionStore(sessionTTL)
+
+// record adds a measurement in the given direction to the session. A
+// non-negative stream also attributes it to that stream of the session.
+func (s *sessionStore) record(id, kind string, stream int, bytes int64, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.touch(id)
+	stats, streams := &sess.download, &sess.downloadStreams
+	if kind == "upload" {
+		stats, streams = &sess.upload, &sess.uploadStreams
+	}
+	stats.Bytes += bytes
+	stats.Duration += duration
+
+	if stream >= 0 {
+		if *streams == nil {
+			*streams = make(map[int]transferStats)
+		}
+		streamStats := (*streams)[stream]
+		streamStats.Bytes += bytes
+		streamStats.Duration += duration
+		(*streams)[stream] = streamStats
+	}
+}
+
+// touch returns the session, creating it if needed, and marks it as seen.
+// Callers must hold s.mu.
+func (s *sessionStore) touch(id string) *session {
+	now := clock()
+	s.sweep(now)
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		sess = &session{}
+		s.sessions[id] = sess
+	}
+	sess.lastSeen = now
+	return sess
+}
+
+// get returns a copy of the session, if it exists and has not expired.
+func (s *sessionStore) get(id string) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(clock())
+	sess, ok := s.sessions[id]
+	if !ok {
+		return session{}, false
+	}
+	snapshot := *sess
+	snapshot.downloadStreams = maps.Clone(sess.downloadStreams)
+	snapshot.uploadStreams = maps.Clone(sess.uploadStreams)
+	return snapshot, true
+}
+
+// sweep removes expired sessions, at most once per TTL. Callers must hold s.mu.
+func (s *sessionStore) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	for id, sess := range s.sessions {
+		if now.Sub(sess.lastSeen) > s.ttl {
+			delete(s.sessions, id)
+		}
+	}
+	s.nextSweep = now.Add(s.ttl)
+}
+
+// requestSession returns the session ID given via ?session=, if it is valid.
+func requestSession(r *http.Request) (string, bool) {
+	id := r.URL.Query().Get("session")
+	return id, sessionIDPattern.MatchString(id)
+}
+
+// requestStream returns the stream index given via ?stream=, or -1 if the
+// request is not part of a parallel-stream session.
+func requestStream(r *http.Request) int {
+	stream, err := strconv.Atoi(r.URL.Query().Get("stream"))
+	if err != nil || stream < 0 || stream >= maxSessionStreams {
+		return -1
+	}
+	return stream
+}
+
+// TransferSummary reports the aggregate of a session's measurements in one direction.
+type TransferSummary struct {
+	// Bytes is the total number of bytes transferred
+	Bytes int64 `json:"bytes"`
+	// DurationMs is the total transfer time in milliseconds
+	DurationMs int64 `json:"durationMs"`
+	// Mbps is the throughput in megabits per second, or 0 if ?units=bytes
+	// was requested
+	Mbps float64 `json:"mbps"`
+	// MBps is the throughput in megabytes per second, or 0 unless
+	// ?units=bytes was requested
+	MBps float64 `json:"MBps"`
+	// CombinedMbps and CombinedMBps add up the rates of the streams of a
+	// parallel-stream session, which ran concurrently
+	CombinedMbps float64 `json:"combinedMbps,omitempty"`
+	CombinedMBps float64 `json:"combinedMBps,omitempty"`
+	// Streams breaks the figures down per stream for parallel-stream sessions
+	Streams []StreamSummary `json:"streams,omitempty"`
+}
+
+// StreamSummary reports the measurements of one stream of a parallel-stream session.
+type StreamSummary struct {
+	// Stream is the stream index given by the client
+	Stream int `json:"stream"`
+	TransferSummary
+}
+
+// SessionResponse summarizes the measurements made in a session.
+type SessionResponse struct {
+	// Session is the session ID
+	Session string `json:"session"`
+	// Download aggregates the session's downloads
+	Download TransferSummary `json:"download"`
+	// Upload aggregates the session's uploads
+	Upload TransferSummary `json:"upload"`
+}
+
+// sessionHandler returns the summary of a session, including per-stream
+// figures so clients can spot an underperforming stream.
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	units, err := parseUnits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := r.PathValue("id")
+	sess, ok := sessions.get(id)
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	response := SessionResponse{
+		Session:  id,
+		Download: sess.download.summary(units),
+		Upload:   sess.upload.summary(units),
+	}
+	addStreams(&response.Download, sess.downloadStreams, units)
+	addStreams(&response.Upload, sess.uploadStreams, units)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// addStreams adds the per-stream figures of a parallel-stream session to
+// summary, along with the combined rate of the streams.
+func addStreams(summary *TransferSummary, streams map[int]transferStats, units string) {
+	for _, stream := range slices.Sorted(maps.Keys(streams)) {
+		streamSummary := streams[stream].summary(units)
+		summary.CombinedMbps += streamSummary.Mbps
+		summary.CombinedMBps += streamSummary.MBps
+		summary.Streams = append(summary.Streams, StreamSummary{
+			Stream:          stream,
+			TransferSummary: streamSummary,
+		})
+	}
+	// The sum of rounded rates can pick up floating-point noise
+	summary.CombinedMbps = roundRate(summary.CombinedMbps)
+	summary.CombinedMBps = roundRate(summary.CombinedMBps)
+}
+
+// Link verdicts reported by the session verdict endpoint
+const (
+	verdictSymmetric     = "symmetric"
+	verdictDownloadHeavy = "download-heavy"
+	verdictUploadHeavy   = "upload-heavy"
+)
+
+// VerdictResponse classifies a session's link by comparing its download
+// and upload throughput.
+type VerdictResponse struct {
+	// Session is the session ID
+	Session string `json:"session"`
+	// DownloadMbps is the session's download throughput
+	DownloadMbps float64 `json:"downloadMbps"`
+	// UploadMbps is the session's upload throughput
+	UploadMbps float64 `json:"uploadMbps"`
+	// Ratio is DownloadMbps divided by UploadMbps
+	Ratio float64 `json:"ratio"`
+	// Verdict is one of "symmetric", "download-heavy" or "upload-heavy"
+	Verdict string `json:"verdict"`
+}
+
+// classifyLink compares download and upload throughput. The link is
+// symmetric when neither direction is more than threshold times faster
+// than the other.
+func classifyLink(downloadMbps, uploadMbps, threshold float64) (string, float64) {
+	ratio := downloadMbps / uploadMbps
+	switch {
+	case ratio > threshold:
+		return verdictDownloadHeavy, ratio
+	case ratio < 1/threshold:
+		return verdictUploadHeavy, ratio
+	default:
+		return verdictSymmetric, ratio
+	}
+}
+
+// verdictHandler returns a handler for /session/{id}/verdict that
+// classifies the session's link once it has both a download and an upload
+// measurement.
+func verdictHandler(threshold float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := r.PathValue("id")
+		sess, ok := sessions.get(id)
+		if !ok {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+
+		downloadMbps, uploadMbps := sess.download.mbps(), sess.upload.mbps()
+		if downloadMbps == 0 || uploadMbps == 0 {
+			http.Error(w, "Session needs both a download and an upload measurement", http.StatusConflict)
+			return
+		}
+
+		verdict, ratio := classifyLink(downloadMbps, uploadMbps, threshold)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(VerdictResponse{
+			Session:      id,
+			DownloadMbps: roundRate(downloadMbps),
+			UploadMbps:   roundRate(uploadMbps),
+			Ratio:        ratio,
+			Verdict:      verdict,
+		})
+	}
+}
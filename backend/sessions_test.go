@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClassifyLink(t *testing.T) {
+	tests := []struct {
+		name     string
+		download float64
+		upload   float64
+		expected string
+	}{
+		{"Symmetric", 100, 90, verdictSymmetric},
+		{"Download Heavy", 500, 20, verdictDownloadHeavy},
+		{"Upload Heavy", 10, 100, verdictUploadHeavy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verdict, ratio := classifyLink(tt.download, tt.upload, 1.5)
+			if verdict != tt.expected {
+				t.Errorf("expected verdict %q, got %q", tt.expected, verdict)
+			}
+			if want := tt.download / tt.upload; ratio != want {
+				t.Errorf("expected ratio %v, got %v", want, ratio)
+			}
+		})
+	}
+}
+
+// useSessions swaps the package session store for a fresh one for the
+// duration of the test.
+func useSessions(t *testing.T) *sessionStore {
+	previous := sessions
+	sessions = newSessionStore(sessionTTL)
+	t.Cleanup(func() { sessions = previous })
+	return sessions
+}
+
+func TestVerdictHandler(t *testing.T) {
+	s := useSessions(t)
+	// 100 Mbps down, 10 Mbps up
+	s.record("abc", "download", -1, 12_500_000, time.Second)
+	s.record("abc", "upload", -1, 1_250_000, time.Second)
+	s.record("half", "download", -1, 12_500_000, time.Second)
+
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/session/abc/verdict", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var response VerdictResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Verdict != verdictDownloadHeavy || response.Ratio != 10 {
+		t.Errorf("expected download-heavy with ratio 10, got %+v", response)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/session/half/verdict", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status %d for incomplete session, got %d", http.StatusConflict, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/session/missing/verdict", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for unknown session, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestSessionRecordedFromRequests(t *testing.T) {
+	s := useSessions(t)
+
+	downloadHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/download?session=xyz", nil))
+
+	sess, ok := s.get("xyz")
+	if !ok {
+		t.Fatal("expected session to be recorded")
+	}
+	if sess.download.Bytes != downloadSize {
+		t.Errorf("expected %d download bytes, got %d", downloadSize, sess.download.Bytes)
+	}
+}
+
+func TestSessionPerStreamDownloads(t *testing.T) {
+	useSessions(t)
+
+	for stream := 0; stream < 3; stream++ {
+		for i := 0; i <= stream; i++ {
+			target := fmt.Sprintf("/download?session=par&stream=%d", stream)
+			downloadHandler(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/session/par", nil)
+	req.SetPathValue("id", "par")
+	sessionHandler(w, req)
+
+	var response SessionResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Download.Bytes != 6*downloadSize {
+		t.Errorf("expected aggregate of %d bytes, got %d", 6*downloadSize, response.Download.Bytes)
+	}
+	if len(response.Download.Streams) != 3 {
+		t.Fatalf("expected 3 streams, got %+v", response.Download.Streams)
+	}
+	for i, stream := range response.Download.Streams {
+		want := int64(i+1) * downloadSize
+		if stream.Stream != i || stream.Bytes != want {
+			t.Errorf("stream %d: expected %d bytes, got %+v", i, want, stream)
+		}
+		if stream.Mbps <= 0 {
+			t.Errorf("stream %d: expected non-zero throughput", i)
+		}
+	}
+}
+
+func TestSessionParallelUploads(t *testing.T) {
+	useSessions(t)
+
+	var wg sync.WaitGroup
+	for stream := 0; stream < 4; stream++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := strings.NewReader(strings.Repeat("a", (stream+1)*1024))
+			target := fmt.Sprintf("/upload?session=up&stream=%d", stream)
+			uploadHandler(httptest.NewRecorder(), httptest.NewRequest("POST", target, body))
+		}()
+	}
+	wg.Wait()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/session/up", nil)
+	req.SetPathValue("id", "up")
+	sessionHandler(w, req)
+
+	var response SessionResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := int64((1 + 2 + 3 + 4) * 1024); response.Upload.Bytes != want {
+		t.Errorf("expected aggregate of %d bytes, got %d", want, response.Upload.Bytes)
+	}
+	if len(response.Upload.Streams) != 4 {
+		t.Fatalf("expected 4 streams, got %+v", response.Upload.Streams)
+	}
+	var combined float64
+	for i, stream := range response.Upload.Streams {
+		if want := int64(i+1) * 1024; stream.Stream != i || stream.Bytes != want {
+			t.Errorf("stream %d: expected %d bytes, got %+v", i, want, stream)
+		}
+		combined += stream.Mbps
+	}
+	if combined = roundRate(combined); response.Upload.CombinedMbps != combined {
+		t.Errorf("expected combined rate %v, got %v", combined, response.Upload.CombinedMbps)
+	}
+	if len(response.Download.Streams) != 0 {
+		t.Errorf("expected no download streams, got %+v", response.Download.Streams)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	c := useFakeClock(t)
+	s := newSessionStore(sessionTTL)
+	s.record("old", "upload", 0, 1024, time.Millisecond)
+
+	c.advance(sessionTTL / 2)
+	s.record("active", "upload", 0, 1024, time.Millisecond)
+
+	c.advance(sessionTTL/2 + time.Second)
+	if _, ok := s.get("old"); ok {
+		t.Error("expected session to expire after its TTL")
+	}
+	if _, ok := s.get("active"); !ok {
+		t.Error("expected a session seen within the TTL to be kept")
+	}
+}
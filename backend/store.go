@@ -0,0 +1,168 @@
+// Package main provides result storage for the speed test server.
+// This file contains the Store interface and its in-memory implementation.
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// historySize is the number of results kept by the default in-memory store
+	historySize = 1000
+	// defaultHistoryLimit is the number of results /history returns by default
+	defaultHistoryLimit = 20
+	// dedupScanLimit is the number of recent results searched for a duplicate
+	dedupScanLimit = 50
+	// dedupSizeTolerance is the relative size difference within which two
+	// results count as the same test
+	dedupSizeTolerance = 0.01
+)
+
+// Result is a single completed download or upload measurement.
+type Result struct {
+	// Kind is the measurement type, "download" or "upload"
+	Kind string `json:"kind"`
+	// ClientIP is the address of the client that ran the test
+	ClientIP string `json:"clientIp"`
+	// Bytes is the number of payload bytes transferred
+	Bytes int64 `json:"bytes"`
+	// DurationMs is the transfer time in milliseconds
+	DurationMs int64 `json:"durationMs"`
+	// Timestamp is when the measurement completed
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Store persists measurement results. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Record saves a completed measurement.
+	Record(result Result) error
+	// Recent returns up to n of the most recent results, newest first.
+	Recent(n int) ([]Result, error)
+}
+
+// store is where handlers record their results. It defaults to an
+// in-memory store whose contents are lost on restart.
+var store Store = newMemoryStore(historySize)
+
+// memoryStore is a Store that keeps a bounded number of results in a ring buffer.
+type memoryStore struct {
+	mu      sync.Mutex
+	results []Result
+	next    int
+	full    bool
+}
+
+func newMemoryStore(capacity int) *memoryStore {
+	return &memoryStore{results: make([]Result, capacity)}
+}
+
+func (s *memoryStore) Record(result Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.results[s.next] = result
+	s.next = (s.next + 1) % len(s.results)
+	if s.next == 0 {
+		s.full = true
+	}
+	return nil
+}
+
+func (s *memoryStore) Recent(n int) ([]Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := s.next
+	if s.full {
+		count = len(s.results)
+	}
+	n = min(n, count)
+
+	recent := make([]Result, 0, n)
+	for i := 1; i <= n; i++ {
+		recent = append(recent, s.results[(s.next-i+len(s.results))%len(s.results)])
+	}
+	return recent, nil
+}
+
+// isDuplicate reports whether recent, newest first, holds a result of the
+// same kind from the same client IP, whatever the port, of about the same
+// size, recorded less than window before result. Such a result is most
+// likely the same test started twice, by a double click for example.
+func isDuplicate(result Result, recent []Result, window time.Duration) bool {
+	for _, previous := range recent {
+		if result.Timestamp.Sub(previous.Timestamp) >= window {
+			break
+		}
+		if previous.Kind != result.Kind || addrHost(previous.ClientIP) != addrHost(result.ClientIP) {
+			continue
+		}
+		difference := math.Abs(float64(result.Bytes - previous.Bytes))
+		if difference <= dedupSizeTolerance*float64(max(result.Bytes, previous.Bytes)) {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupMu serializes recordUnlessDuplicate, so two simultaneous
+// duplicates cannot both pass the check.
+var dedupMu sync.Mutex
+
+// recordUnlessDuplicate records result in the store unless it duplicates
+// one recorded within window, and reports whether it was recorded.
+func recordUnlessDuplicate(result Result, window time.Duration) (bool, error) {
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+
+	recent, err := store.Recent(dedupScanLimit)
+	if err == nil && isDuplicate(result, recent, window) {
+		return false, nil
+	}
+	return true, store.Record(result)
+}
+
+// historyHandler returns the caller's most recent measurement results as
+// JSON. The number of results can be set with ?limit=. Results of other
+// clients are left out, so their addresses aren't disclosed.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, historySize)
+	}
+
+	recent, err := store.Recent(historySize)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	client := addrHost(clientIP(r))
+	results := make([]Result, 0, limit)
+	for _, result := range recent {
+		if len(results) == limit {
+			break
+		}
+		if addrHost(result.ClientIP) == client {
+			results = append(results, result)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStoreContract exercises the behavior every Store implementation
+// must provide.
+func testStoreContract(t *testing.T, newStore func(capacity int) Store) {
+	t.Run("Empty", func(t *testing.T) {
+		results, err := newStore(3).Recent(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 0 {
+			t.Errorf("expected no results, got %d", len(results))
+		}
+	})
+
+	t.Run("NewestFirst", func(t *testing.T) {
+		s := newStore(3)
+		for i := 1; i <= 2; i++ {
+			if err := s.Record(Result{Kind: "download", Bytes: int64(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		results, err := s.Recent(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 || results[0].Bytes != 2 || results[1].Bytes != 1 {
+			t.Errorf("expected results newest first, got %+v", results)
+		}
+	})
+
+	t.Run("BoundedCapacity", func(t *testing.T) {
+		s := newStore(3)
+		for i := 1; i <= 5; i++ {
+			s.Record(Result{Kind: "upload", Bytes: int64(i)})
+		}
+
+		results, _ := s.Recent(10)
+		if len(results) != 3 || results[0].Bytes != 5 || results[2].Bytes != 3 {
+			t.Errorf("expected the 3 newest results, got %+v", results)
+		}
+
+		results, _ = s.Recent(1)
+		if len(results) != 1 || results[0].Bytes != 5 {
+			t.Errorf("expected only the newest result, got %+v", results)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		s := newStore(100)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					s.Record(Result{Kind: "download", ClientIP: fmt.Sprint(i)})
+					s.Recent(5)
+				}
+			}()
+		}
+		wg.Wait()
+
+		results, _ := s.Recent(1000)
+		if len(results) != 100 {
+			t.Errorf("expected 100 results, got %d", len(results))
+		}
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStoreContract(t, func(capacity int) Store { return newMemoryStore(capacity) })
+}
+
+// mockStore records results in a slice for assertions in handler tests.
+type mockStore struct {
+	mu      sync.Mutex
+	results []Result
+}
+
+func (m *mockStore) Record(result Result) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results = append(m.results, result)
+	return nil
+}
+
+func (m *mockStore) Recent(n int) ([]Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.results[:min(n, len(m.results))], nil
+}
+
+// useStore swaps the package store for s for the duration of the test.
+func useStore(t *testing.T, s Store) {
+	previous := store
+	store = s
+	t.Cleanup(func() { store = previous })
+}
+
+func TestHandlersRecordResults(t *testing.T) {
+	mock := &mockStore{}
+	useStore(t, mock)
+
+	uploadHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("payload")))
+	downloadHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/download", nil))
+
+	if len(mock.results) != 2 {
+		t.Fatalf("expected 2 recorded results, got %d", len(mock.results))
+	}
+	if r := mock.results[0]; r.Kind != "upload" || r.Bytes != 7 || r.Timestamp.IsZero() {
+		t.Errorf("unexpected upload result: %+v", r)
+	}
+	if r := mock.results[1]; r.Kind != "download" || r.Bytes != downloadSize {
+		t.Errorf("unexpected download result: %+v", r)
+	}
+}
+
+func TestDuplicateResultsDropped(t *testing.T) {
+	fake := useFakeClock(t)
+	useStore(t, newMemoryStore(10))
+	useConfig(t, func(cfg *Config) { cfg.DedupWindow = 5 * time.Second })
+
+	upload := func(body string) {
+		uploadHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader(body)))
+	}
+
+	// A double click: the same upload twice, a moment apart
+	upload(strings.Repeat("a", 1000))
+	fake.advance(time.Second)
+	// The second click opens a new connection, from another port
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("a", 1005)))
+	req.RemoteAddr = "192.0.2.1:5678"
+	uploadHandler(httptest.NewRecorder(), req)
+	results, _ := store.Recent(10)
+	if len(results) != 1 {
+		t.Fatalf("expected 1 recorded result for near-identical uploads, got %d", len(results))
+	}
+
+	// A differently sized upload, or the same one after the window, is a new test
+	upload(strings.Repeat("a", 2000))
+	fake.advance(10 * time.Second)
+	upload(strings.Repeat("a", 1000))
+	// Session streams are never deduplicated
+	uploadHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload?session=abc", strings.NewReader(strings.Repeat("a", 1000))))
+
+	if results, _ := store.Recent(10); len(results) != 4 {
+		t.Errorf("expected 4 recorded results, got %d", len(results))
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	s := newMemoryStore(10)
+	useStore(t, s)
+	s.Record(Result{Kind: "upload", ClientIP: "192.0.2.1:1234", Bytes: 1, Timestamp: time.Now()})
+	s.Record(Result{Kind: "download", ClientIP: "192.0.2.1:5678", Bytes: 2, Timestamp: time.Now()})
+	s.Record(Result{Kind: "upload", ClientIP: "198.51.100.9:1234", Bytes: 3, Timestamp: time.Now()})
+
+	w := httptest.NewRecorder()
+	historyHandler(w, httptest.NewRequest("GET", "/history?limit=1", nil))
+
+	if !strings.Contains(w.Body.String(), `"kind":"download"`) || strings.Contains(w.Body.String(), `"kind":"upload"`) {
+		t.Errorf("expected only the caller's newest result, got %s", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "198.51.100.9") {
+		t.Errorf("expected other clients' results to be left out, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,113 @@
+// Package main provides per-subnet limits for the speed test server.
+// This file contains the subnet keying and the middleware that rate limits
+// and caps the concurrent tests of whole networks, on top of the per-client
+// limits.
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+)
+
+const (
+	// defaultSubnetV4Prefix and defaultSubnetV6Prefix are the network sizes
+	// clients are grouped by: a /24 is a typical IPv4 allocation and a /48
+	// a typical IPv6 site
+	defaultSubnetV4Prefix = 24
+	defaultSubnetV6Prefix = 48
+)
+
+// subnetMask groups client addresses into the networks they belong to.
+type subnetMask struct {
+	v4Bits, v6Bits int
+}
+
+// network returns the network of the client identified by ip, such as
+// "203.0.113.0/24", accepting an address with or without a port. An
+// address that can't be parsed is its own network, so it is still limited.
+func (m subnetMask) network(ip string) string {
+	ip = addrHost(ip)
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	bits := m.v6Bits
+	if addr.Is4() {
+		bits = m.v4Bits
+	}
+	prefix, err := addr.WithZone("").Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// withSubnetRateLimit rejects requests with 429 Too Many Requests once the
+// client's network has used up its limit, so a botnet spread over many
+// addresses of one network can't multiply the per-client limit.
+func withSubnetRateLimit(mask subnetMask, limiter requestLimiter, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		network := mask.network(clientIP(r))
+		if !limiter.isAllowed(network) {
+			transferTotals.rateLimited.Add(1)
+			reset := int(math.Ceil(limiter.usage(network).Reset.Sub(clock()).Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, reset)))
+			w.Header().Set(rejectedByHeader, "subnet-rate-limit")
+			http.Error(w, "Rate limit exceeded for your network", http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// subnetConcurrency counts the requests in flight from each network.
+type subnetConcurrency struct {
+	mu       sync.Mutex
+	limit    int
+	inFlight map[string]int
+}
+
+func newSubnetConcurrency(limit int) *subnetConcurrency {
+	return &subnetConcurrency{limit: limit, inFlight: make(map[string]int)}
+}
+
+// acquire counts a request from network, reporting false without counting
+// it if the network already has limit requests in flight.
+func (c *subnetConcurrency) acquire(network string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight[network] >= c.limit {
+		return false
+	}
+	c.inFlight[network]++
+	return true
+}
+
+func (c *subnetConcurrency) release(network string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight[network]--; c.inFlight[network] <= 0 {
+		delete(c.inFlight, network)
+	}
+}
+
+// withSubnetConcurrency rejects requests with 429 Too Many Requests while
+// the client's network already has the maximum number of tests running.
+func withSubnetConcurrency(mask subnetMask, concurrency *subnetConcurrency, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		network := mask.network(clientIP(r))
+		if !concurrency.acquire(network) {
+			w.Header().Set(rejectedByHeader, "subnet-concurrency")
+			http.Error(w, "Too many tests in progress from your network", http.StatusTooManyRequests)
+			return
+		}
+		defer concurrency.release(network)
+		handler(w, r)
+	}
+}
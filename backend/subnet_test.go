@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSubnetMaskNetwork(t *testing.T) {
+	mask := subnetMask{v4Bits: 24, v6Bits: 48}
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"203.0.113.7", "203.0.113.0/24"},
+		{"203.0.113.200:50123", "203.0.113.0/24"},
+		{"[2001:db8:1:2::5]:443", "2001:db8:1::/48"},
+		{"2001:db8:1:ffff::1", "2001:db8:1::/48"},
+		{"::ffff:198.51.100.9", "198.51.100.0/24"},
+		{"not-an-ip", "not-an-ip"},
+	}
+
+	for _, tt := range tests {
+		if got := mask.network(tt.ip); got != tt.expected {
+			t.Errorf("network(%q): expected %q, got %q", tt.ip, tt.expected, got)
+		}
+	}
+}
+
+func TestSubnetRateLimit(t *testing.T) {
+	useFakeClock(t)
+	cfg := defaultConfig()
+	cfg.SubnetRateLimit = 2
+	mux := newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	request := func(ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/history", nil)
+		r.RemoteAddr = ip + ":1234"
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// Three clients of one /24 share its budget of two requests
+	for _, ip := range []string{"203.0.113.1", "203.0.113.2"} {
+		if w := request(ip); w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d within the subnet budget, got %d", ip, http.StatusOK, w.Code)
+		}
+	}
+	w := request("203.0.113.3")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d once the subnet budget is spent, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if got := w.Header().Get(rejectedByHeader); got != "subnet-rate-limit" {
+		t.Errorf("expected %s subnet-rate-limit, got %q", rejectedByHeader, got)
+	}
+
+	if w := request("198.51.100.1"); w.Code != http.StatusOK {
+		t.Errorf("expected another subnet to have its own budget, got status %d", w.Code)
+	}
+}
+
+func TestSubnetConcurrency(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SubnetMaxInFlight = 1
+	mux := newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	download := func(w http.ResponseWriter, ip string) {
+		r := httptest.NewRequest("GET", "/download?bytes=1024", nil)
+		r.RemoteAddr = ip + ":1234"
+		mux.ServeHTTP(w, r)
+	}
+
+	// Hold a download from the subnet in flight
+	held := &blockingRecorder{ResponseRecorder: httptest.NewRecorder(), started: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		download(held, "203.0.113.1")
+	}()
+	<-held.started
+
+	sameSubnet := httptest.NewRecorder()
+	download(sameSubnet, "203.0.113.2")
+	otherSubnet := httptest.NewRecorder()
+	download(otherSubnet, "198.51.100.1")
+	close(held.release)
+	<-done
+
+	if sameSubnet.Code != http.StatusTooManyRequests || sameSubnet.Header().Get(rejectedByHeader) != "subnet-concurrency" {
+		t.Errorf("expected a second test from the subnet to be refused, got status %d", sameSubnet.Code)
+	}
+	if otherSubnet.Code != http.StatusOK {
+		t.Errorf("expected a test from another subnet to run, got status %d", otherSubnet.Code)
+	}
+
+	after := httptest.NewRecorder()
+	download(after, "203.0.113.2")
+	if after.Code != http.StatusOK {
+		t.Errorf("expected the subnet's slot to be released, got status %d", after.Code)
+	}
+}
@@ -0,0 +1,83 @@
+// Package main provides sustained throughput measurement for the speed test
+// server. This file contains the download progress recorder behind the
+// X-Sustained-Mbps trailer.
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// sustainedMbpsHeader is the trailer reporting a download's sustained rate
+	sustainedMbpsHeader = "X-Sustained-Mbps"
+	// sustainedMilestones is roughly how many progress points a download
+	// records, bounding the memory used whatever the write size
+	sustainedMilestones = 256
+)
+
+// wantsSustained reports whether the client asked for the sustained rate
+// with ?sustained=1.
+func wantsSustained(r *http.Request) bool {
+	return r.URL.Query().Get("sustained") == "1"
+}
+
+// milestone is the number of bytes written by a point in time.
+type milestone struct {
+	at    time.Time
+	bytes int
+}
+
+// progressRecorder timestamps byte milestones as a download is written, so
+// the rate of its final stretch can be told apart from the average, which
+// TCP slow start drags down at the beginning of the transfer.
+type progressRecorder struct {
+	w io.Writer
+	// every is the number of bytes between milestones
+	every      int
+	written    int
+	milestones []milestone
+}
+
+// newProgressRecorder returns a recorder for a size-byte stream that
+// started at start.
+func newProgressRecorder(w io.Writer, size int, start time.Time) *progressRecorder {
+	return &progressRecorder{
+		w:          w,
+		every:      max(1, size/sustainedMilestones),
+		milestones: []milestone{{at: start}},
+	}
+}
+
+func (p *progressRecorder) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += n
+	if p.written-p.milestones[len(p.milestones)-1].bytes >= p.every {
+		p.milestones = append(p.milestones, milestone{at: clock(), bytes: p.written})
+	}
+	return n, err
+}
+
+// sustainedMbps returns the rate in megabits per second over the second
+// half of the transfer by time, measured from the last milestone no later
+// than its halfway point. By then the ramp has usually finished, so the
+// figure is closer to the capacity of the link than the average. It
+// returns 0 if too little was recorded to measure.
+func (p *progressRecorder) sustainedMbps() float64 {
+	end := p.milestones[len(p.milestones)-1]
+	if p.written > end.bytes {
+		end = milestone{at: clock(), bytes: p.written}
+	}
+	start := p.milestones[0].at
+	halfway := start.Add(end.at.Sub(start) / 2)
+
+	from := p.milestones[0]
+	for _, m := range p.milestones {
+		if m.bytes >= end.bytes || m.at.After(halfway) {
+			break
+		}
+		from = m
+	}
+	return transferRate(int64(end.bytes-from.bytes), end.at.Sub(from.at), unitsBits)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// pacedWriter advances a fake clock on every write, by ramp for the first
+// rampWrites writes and by steady after them, imitating slow start.
+type pacedWriter struct {
+	http.ResponseWriter
+	clock        *fakeClock
+	rampWrites   int
+	ramp, steady time.Duration
+	writes       int
+}
+
+func (p *pacedWriter) Write(b []byte) (int, error) {
+	p.writes++
+	if p.writes <= p.rampWrites {
+		p.clock.advance(p.ramp)
+	} else {
+		p.clock.advance(p.steady)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+func TestDownloadSustainedMbps(t *testing.T) {
+	fake := useFakeClock(t)
+	const size, writeSize = 1024 * 1024, 32 * 1024
+
+	rr := httptest.NewRecorder()
+	w := &pacedWriter{ResponseWriter: rr, clock: fake, rampWrites: 4, ramp: 5 * time.Millisecond, steady: time.Millisecond}
+	downloadHandler(w, httptest.NewRequest("GET", "/download?sustained=1&bytes=1048576&writeSize=32768", nil))
+
+	response := rr.Result()
+	if response.Header.Get("Content-Length") != "" {
+		t.Error("expected a chunked response to carry the trailer")
+	}
+	sustained, err := strconv.ParseFloat(response.Trailer.Get(sustainedMbpsHeader), 64)
+	if err != nil {
+		t.Fatalf("expected a numeric %s trailer, got %q", sustainedMbpsHeader, response.Trailer.Get(sustainedMbpsHeader))
+	}
+
+	// 4 writes over 20ms of ramp, then 28 writes 1ms apart
+	steady := transferRate(writeSize, time.Millisecond, unitsBits)
+	average := transferRate(size, 48*time.Millisecond, unitsBits)
+	if expected := formatRate(steady); response.Trailer.Get(sustainedMbpsHeader) != expected {
+		t.Errorf("expected a sustained rate of %s Mbps excluding the ramp, got %v", expected, sustained)
+	}
+	if sustained <= average {
+		t.Errorf("expected the sustained rate %v to exceed the average %v", sustained, average)
+	}
+}
+
+func TestDownloadSustainedOptIn(t *testing.T) {
+	rr := httptest.NewRecorder()
+	downloadHandler(rr, httptest.NewRequest("GET", "/download?bytes=1024", nil))
+
+	response := rr.Result()
+	if response.Trailer.Get(sustainedMbpsHeader) != "" || response.Header.Get("Trailer") != "" {
+		t.Error("expected no sustained rate without ?sustained=1")
+	}
+	if response.Header.Get("Content-Length") != "1024" {
+		t.Errorf("expected Content-Length 1024, got %q", response.Header.Get("Content-Length"))
+	}
+}
@@ -0,0 +1,168 @@
+// Package main provides the raw TCP echo server of the speed test server.
+// This file contains the optional -tcp-echo-port listener, which measures
+// latency without any HTTP overhead by echoing probes with a server
+// timestamp.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// tcpEchoMaxProbe is the largest probe payload a client may send
+	tcpEchoMaxProbe = 1024
+	// tcpEchoMaxConns caps the echo connections open at once
+	tcpEchoMaxConns = 256
+	// tcpEchoMaxConnsPerIP caps the echo connections open at once from one
+	// client address, so a single client can't take every slot
+	tcpEchoMaxConnsPerIP = 4
+	// tcpEchoLengthBytes is the size of the big-endian uint16 payload
+	// length that starts every probe
+	tcpEchoLengthBytes = 2
+	// tcpEchoTimestampBytes is the size of the server timestamp that
+	// starts every reply
+	tcpEchoTimestampBytes = 8
+	// tcpEchoWriteTimeout bounds each reply to a client that stopped reading
+	tcpEchoWriteTimeout = 10 * time.Second
+)
+
+// tcpEchoServer answers latency probes on a raw TCP listener. A probe is a
+// big-endian uint16 payload length followed by that many bytes, at most
+// tcpEchoMaxProbe. Each is answered with the time it was received, in
+// nanoseconds since the Unix epoch as a big-endian int64 like the frames of
+// /ws, followed by the probe exactly as sent. A client may send any number
+// of probes over one connection; one that sends an oversized probe or
+// stays silent for the idle timeout is disconnected.
+type tcpEchoServer struct {
+	listener    net.Listener
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	perIP   map[string]int
+	closing bool
+}
+
+func newTCPEchoServer(listener net.Listener, idleTimeout time.Duration) *tcpEchoServer {
+	return &tcpEchoServer{
+		listener:    listener,
+		idleTimeout: idleTimeout,
+		conns:       make(map[net.Conn]struct{}),
+		perIP:       make(map[string]int),
+	}
+}
+
+// serve accepts connections until shutdown closes the listener.
+func (s *tcpEchoServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Such as running out of file descriptors; back off rather
+			// than spin
+			log.Printf("TCP echo accept failed: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !s.track(conn) {
+			conn.Close()
+			continue
+		}
+		go s.echo(conn)
+	}
+}
+
+// track registers an accepted connection, reporting false if the server
+// is shutting down or already has tcpEchoMaxConns open, or
+// tcpEchoMaxConnsPerIP from the connection's address.
+func (s *tcpEchoServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ip := addrHost(conn.RemoteAddr().String())
+	if s.closing || len(s.conns) >= tcpEchoMaxConns || s.perIP[ip] >= tcpEchoMaxConnsPerIP {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.perIP[ip]++
+	return true
+}
+
+func (s *tcpEchoServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+	ip := addrHost(conn.RemoteAddr().String())
+	if s.perIP[ip]--; s.perIP[ip] == 0 {
+		delete(s.perIP, ip)
+	}
+}
+
+// awaitProbe arms the idle timeout for the next probe, reporting false
+// once the server is shutting down. It holds the lock so that shutdown
+// can't be undone by a deadline set just after it.
+func (s *tcpEchoServer) awaitProbe(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+	return true
+}
+
+// echo answers the probes of one connection until it closes.
+func (s *tcpEchoServer) echo(conn net.Conn) {
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	// The reply is the timestamp followed by the probe as received
+	reply := make([]byte, tcpEchoTimestampBytes+tcpEchoLengthBytes+tcpEchoMaxProbe)
+	probe := reply[tcpEchoTimestampBytes:]
+	for s.awaitProbe(conn) {
+		if _, err := io.ReadFull(reader, probe[:tcpEchoLengthBytes]); err != nil {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(probe))
+		if n > tcpEchoMaxProbe {
+			log.Printf("TCP echo client %s sent a %d-byte probe, over the %d-byte limit", conn.RemoteAddr(), n, tcpEchoMaxProbe)
+			return
+		}
+		if _, err := io.ReadFull(reader, probe[tcpEchoLengthBytes:tcpEchoLengthBytes+n]); err != nil {
+			return
+		}
+		binary.BigEndian.PutUint64(reply, uint64(clock().UnixNano()))
+
+		conn.SetWriteDeadline(time.Now().Add(tcpEchoWriteTimeout))
+		if _, err := conn.Write(reply[:tcpEchoTimestampBytes+tcpEchoLengthBytes+n]); err != nil {
+			return
+		}
+	}
+}
+
+// shutdown stops accepting connections and ends the open ones by cutting
+// their reads short, so each closes once any reply being sent has gone
+// out. It is registered to run when the HTTP server shuts down, and does
+// not wait for the connections to close.
+func (s *tcpEchoServer) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closing = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
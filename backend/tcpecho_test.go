@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTCPEcho runs an echo server on a free local port until the test
+// ends, returning it and its address.
+func startTCPEcho(t *testing.T) (*tcpEchoServer, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := newTCPEchoServer(listener, time.Minute)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		echo.serve()
+	}()
+	t.Cleanup(func() {
+		echo.shutdown()
+		<-done
+	})
+	return echo, listener.Addr().String()
+}
+
+func TestTCPEcho(t *testing.T) {
+	_, addr := startTCPEcho(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, payload := range []string{"probe-1", "", "probe-3"} {
+		probe := binary.BigEndian.AppendUint16(nil, uint16(len(payload)))
+		probe = append(probe, payload...)
+		before := time.Now().UnixNano()
+		if _, err := conn.Write(probe); err != nil {
+			t.Fatal(err)
+		}
+
+		reply := make([]byte, tcpEchoTimestampBytes+len(probe))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if stamp := int64(binary.BigEndian.Uint64(reply)); stamp < before || stamp > time.Now().UnixNano() {
+			t.Errorf("%q: expected the reply to start with the server time, got %d", payload, stamp)
+		}
+		if echoed := reply[tcpEchoTimestampBytes:]; !bytes.Equal(echoed, probe) {
+			t.Errorf("expected the probe %q echoed back, got %q", probe, echoed)
+		}
+	}
+}
+
+func TestTCPEchoOversizedProbe(t *testing.T) {
+	_, addr := startTCPEcho(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write(binary.BigEndian.AppendUint16(nil, tcpEchoMaxProbe+1))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the connection to be closed after an oversized probe, read %d bytes", n)
+	}
+}
+
+func TestTCPEchoConnectionCapPerIP(t *testing.T) {
+	_, addr := startTCPEcho(t)
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	probe := func(conn net.Conn) error {
+		if _, err := conn.Write([]byte{0, 1, 'x'}); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, make([]byte, tcpEchoTimestampBytes+3))
+		return err
+	}
+
+	for i := 0; i < tcpEchoMaxConnsPerIP; i++ {
+		if err := probe(dial()); err != nil {
+			t.Fatalf("connection %d: expected an echo within the cap, got %v", i+1, err)
+		}
+	}
+	if err := probe(dial()); err == nil {
+		t.Errorf("expected a connection over the %d per address to be closed", tcpEchoMaxConnsPerIP)
+	}
+}
+
+func TestTCPEchoShutsDownWithHTTPServer(t *testing.T) {
+	echo, addr := startTCPEcho(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Wait for the connection to be tracked by exchanging a probe
+	conn.Write([]byte{0, 0})
+	if _, err := io.ReadFull(conn, make([]byte, tcpEchoTimestampBytes+2)); err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer("127.0.0.1:0", pingHandler, time.Minute)
+	server.RegisterOnShutdown(echo.shutdown)
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The idle connection is closed and no new ones are accepted
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the open connection to be closed on shutdown")
+	}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Error("expected new connections to be refused after shutdown")
+	}
+}
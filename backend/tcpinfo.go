@@ -0,0 +1,56 @@
+// Package main provides kernel TCP diagnostics for the speed test server.
+// This file contains the platform-independent reporting of TCP_INFO
+// statistics in response headers.
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TCP diagnostic headers set when -tcp-info is enabled
+const (
+	tcpRetransmitsHeader = "X-TCP-Retransmits"
+	tcpRTTHeader         = "X-TCP-RTT-Us"
+)
+
+// tcpStats holds the kernel's view of a TCP connection.
+type tcpStats struct {
+	// Retransmits is the number of segments retransmitted over the
+	// lifetime of the connection
+	Retransmits uint32
+	// RTT is the kernel's smoothed round-trip time estimate
+	RTT time.Duration
+}
+
+// requestConn returns the client connection the request arrived on. For
+// HTTPS requests it is the TCP connection underneath TLS.
+func requestConn(r *http.Request) (net.Conn, bool) {
+	info, ok := r.Context().Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return nil, false
+	}
+	if tlsConn, ok := info.conn.(*tls.Conn); ok {
+		return tlsConn.NetConn(), true
+	}
+	return info.conn, true
+}
+
+// setTCPInfo sets the TCP diagnostic headers in h from the request's
+// connection. It does nothing if the statistics can't be read, such as on
+// platforms other than Linux or for connections that are not plain TCP.
+func setTCPInfo(h http.Header, r *http.Request) {
+	conn, ok := requestConn(r)
+	if !ok {
+		return
+	}
+	stats, ok := readTCPInfo(conn)
+	if !ok {
+		return
+	}
+	h.Set(tcpRetransmitsHeader, strconv.FormatUint(uint64(stats.Retransmits), 10))
+	h.Set(tcpRTTHeader, strconv.FormatInt(stats.RTT.Microseconds(), 10))
+}
@@ -0,0 +1,43 @@
+//go:build linux && !386
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// tcpInfoSupported reports whether readTCPInfo works on this platform.
+const tcpInfoSupported = true
+
+// readTCPInfo reads the kernel's TCP_INFO statistics for conn.
+func readTCPInfo(conn net.Conn) (tcpStats, bool) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return tcpStats{}, false
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return tcpStats{}, false
+	}
+
+	// The syscall package has no TCP_INFO wrapper, so call getsockopt
+	// directly to avoid a dependency on golang.org/x/sys.
+	var info syscall.TCPInfo
+	var errno syscall.Errno
+	if err := raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(info))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	}); err != nil || errno != 0 {
+		return tcpStats{}, false
+	}
+
+	return tcpStats{
+		Retransmits: info.Total_retrans,
+		RTT:         time.Duration(info.Rtt) * time.Microsecond,
+	}, true
+}
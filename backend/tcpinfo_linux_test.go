@@ -0,0 +1,46 @@
+//go:build linux && !386
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTCPInfoHeaders(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.TCPInfo = true })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", downloadHandler)
+	mux.HandleFunc("/upload", uploadHandler)
+	server := httptest.NewUnstartedServer(mux)
+	server.Config.ConnContext = connContext
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/download?bytes=65536")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	for _, name := range []string{tcpRetransmitsHeader, tcpRTTHeader} {
+		if resp.Trailer.Get(name) == "" {
+			t.Errorf("expected download trailer %s, got %v", name, resp.Trailer)
+		}
+	}
+
+	resp, err = http.Post(server.URL+"/upload", "application/octet-stream", strings.NewReader(strings.Repeat("a", 65536)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, name := range []string{tcpRetransmitsHeader, tcpRTTHeader} {
+		if resp.Header.Get(name) == "" {
+			t.Errorf("expected upload header %s, got %v", name, resp.Header)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux || 386
+
+package main
+
+import "net"
+
+// tcpInfoSupported reports whether readTCPInfo works on this platform. On
+// linux/386 getsockopt is multiplexed through socketcall, so TCP_INFO is
+// not supported there either.
+const tcpInfoSupported = false
+
+// readTCPInfo reports that TCP_INFO is not available on this platform.
+func readTCPInfo(conn net.Conn) (tcpStats, bool) {
+	return tcpStats{}, false
+}
@@ -0,0 +1,94 @@
+// Package main provides hot-link protection for the speed test server.
+// This file contains the signed, time-limited download tokens.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errTokenMissing   = errors.New("download token required")
+	errTokenMalformed = errors.New("malformed download token")
+	errTokenSignature = errors.New("invalid download token signature")
+	errTokenExpired   = errors.New("download token expired")
+)
+
+// TokenResponse is the JSON body of /token.
+type TokenResponse struct {
+	// Token is passed to /download as ?token=
+	Token string `json:"token"`
+	// ExpiresAt is when the token stops being accepted, in Unix seconds
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// signToken returns the HMAC-SHA256 signature of a token's expiry.
+func signToken(secret []byte, expiry string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(expiry))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newDownloadToken returns a token of the form "<expiry>.<signature>",
+// where expiry is in Unix seconds.
+func newDownloadToken(secret []byte, expiresAt time.Time) string {
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expiry + "." + signToken(secret, expiry)
+}
+
+// verifyDownloadToken checks a token's signature, then its expiry.
+func verifyDownloadToken(secret []byte, token string) error {
+	if token == "" {
+		return errTokenMissing
+	}
+	expiry, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return errTokenMalformed
+	}
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return errTokenMalformed
+	}
+	if !hmac.Equal([]byte(signature), []byte(signToken(secret, expiry))) {
+		return errTokenSignature
+	}
+	if !clock().Before(time.Unix(expiresAt, 0)) {
+		return errTokenExpired
+	}
+	return nil
+}
+
+// tokenHandler issues download tokens valid for ttl.
+func tokenHandler(secret []byte, ttl time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expiresAt := clock().Add(ttl)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(TokenResponse{
+			Token:     newDownloadToken(secret, expiresAt),
+			ExpiresAt: expiresAt.Unix(),
+		})
+	}
+}
+
+// requireToken refuses requests with 403 Forbidden unless they carry a
+// valid, unexpired ?token= issued by tokenHandler.
+func requireToken(secret []byte, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyDownloadToken(secret, r.URL.Query().Get("token")); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(rejectedByHeader, "download-token")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issueToken fetches a download token from the mux's /token endpoint.
+func issueToken(t *testing.T, mux *http.ServeMux) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/token", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected /token status %d, got %d", http.StatusOK, w.Code)
+	}
+	var response TokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response.Token
+}
+
+func TestDownloadToken(t *testing.T) {
+	fake := useFakeClock(t)
+	cfg := defaultConfig()
+	cfg.DownloadTokenSecret = "test-secret"
+	mux := newMux(cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	valid := issueToken(t, mux)
+	expiry, signature, _ := strings.Cut(valid, ".")
+	tampered := expiry + "." + strings.Repeat("A", len(signature))
+	foreign := newDownloadToken([]byte("other-secret"), fake.Now().Add(time.Hour))
+
+	tests := []struct {
+		name     string
+		token    string
+		advance  time.Duration
+		expected int
+	}{
+		{"Valid Token", valid, 0, http.StatusOK},
+		{"Missing Token", "", 0, http.StatusForbidden},
+		{"Malformed Token", "not-a-token", 0, http.StatusForbidden},
+		{"Tampered Signature", tampered, 0, http.StatusForbidden},
+		{"Wrong Secret", foreign, 0, http.StatusForbidden},
+		{"Expired Token", valid, cfg.DownloadTokenTTL, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.advance(tt.advance)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", "/download?bytes=1024&token="+url.QueryEscape(tt.token), nil))
+
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestTokenRouteDisabledByDefault(t *testing.T) {
+	mux := newMux(defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/token", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d without a secret, got %d", http.StatusNotFound, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/download?bytes=1024", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected downloads without a token to be served, got %d", w.Code)
+	}
+}
@@ -0,0 +1,81 @@
+// Package main provides distributed tracing for the speed test server.
+// This file contains the OpenTelemetry setup and the per-request tracing
+// middleware.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans created by this server
+const tracerName = "pinguen"
+
+// tracePropagator reads the caller's W3C traceparent and tracestate headers.
+var tracePropagator = propagation.TraceContext{}
+
+// setupTracing installs a global tracer provider that batches spans to the
+// OTLP/HTTP collector at endpoint, such as "http://localhost:4318". The
+// returned function flushes pending spans and should be called on exit.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracerName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(tracePropagator)
+	return provider.Shutdown, nil
+}
+
+// withTracing wraps a handler in a server span named after its route,
+// continuing the trace of an incoming traceparent header if there is one.
+// The span records the route and response status, and its context is
+// passed to the handler.
+func withTracing(provider trace.TracerProvider, route string, handler http.HandlerFunc) http.HandlerFunc {
+	tracer := provider.Tracer(tracerName)
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		recorder := &statusRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			status := recorder.statusCode()
+			span.SetAttributes(
+				semconv.HTTPResponseStatusCode(status),
+				attribute.Int64("http.response.body.size", recorder.bytes),
+			)
+			if !completed {
+				span.SetStatus(codes.Error, "response aborted")
+			} else if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			span.End()
+		}()
+
+		handler(recorder, r.WithContext(ctx))
+		completed = true
+	}
+}
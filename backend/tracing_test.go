@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingRecordsSpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(t.Context())
+
+	var handlerSpan trace.SpanContext
+	handler := withTracing(provider, "/ping", func(w http.ResponseWriter, r *http.Request) {
+		handlerSpan = trace.SpanContextFromContext(r.Context())
+		pingHandler(w, r)
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/ping", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	handler(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+
+	if span.Name != "GET /ping" {
+		t.Errorf("expected span name %q, got %q", "GET /ping", span.Name)
+	}
+	if got := span.SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("expected span to continue trace %s, got %s", traceID, got)
+	}
+	if handlerSpan.SpanID() != span.SpanContext.SpanID() {
+		t.Error("expected the span context to be propagated to the handler")
+	}
+
+	attrs := attribute.NewSet(span.Attributes...)
+	if v, _ := attrs.Value("http.route"); v.AsString() != "/ping" {
+		t.Errorf("expected http.route /ping, got %q", v.AsString())
+	}
+	if v, _ := attrs.Value("http.response.status_code"); v.AsInt64() != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, v.AsInt64())
+	}
+}
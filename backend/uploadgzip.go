@@ -0,0 +1,92 @@
+// Package main provides gzip upload handling for the speed test server.
+// This file contains the decoder that measures the logical size of an
+// upload sent with Content-Encoding: gzip, alongside the compressed bytes
+// the upload is otherwise measured by.
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	// errInvalidGzip is reported for a gzip upload that doesn't decode
+	errInvalidGzip = errors.New("request body is not valid gzip")
+	// errDecompressedTooLarge is reported for a gzip upload that decodes to
+	// more than the upload limit
+	errDecompressedTooLarge = errors.New("decompressed upload exceeds the limit")
+)
+
+// isGzipUpload reports whether the client compressed the body of r.
+func isGzipUpload(r *http.Request) bool {
+	encoding := strings.TrimSpace(r.Header.Get("Content-Encoding"))
+	return strings.EqualFold(encoding, "gzip") || strings.EqualFold(encoding, "x-gzip")
+}
+
+// gunzipCounter decodes the compressed bytes written to it in the
+// background, counting the decompressed bytes. It never fails a write, so
+// a body that turns out not to be gzip is still read and measured in full;
+// the decoding error is reported by finish instead.
+type gunzipCounter struct {
+	pipe *io.PipeWriter
+	done chan struct{}
+	// n and err are set by the decoder before done is closed
+	n   int64
+	err error
+}
+
+// newGunzipCounter starts decoding. Decoding stops once more than limit
+// bytes have been decompressed, so that a small body can't make the server
+// inflate an unbounded amount of data.
+func newGunzipCounter(limit int64) *gunzipCounter {
+	reader, writer := io.Pipe()
+	c := &gunzipCounter{pipe: writer, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		c.n, c.err = decodedSize(reader, limit)
+		// Discard whatever is still written once decoding has stopped
+		reader.CloseWithError(c.err)
+	}()
+	return c
+}
+
+// decodedSize returns the decompressed size of the gzip stream r, up to
+// limit bytes.
+func decodedSize(r io.Reader, limit int64) (int64, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(zr, limit+1))
+	if err == nil && n > limit {
+		return limit, errDecompressedTooLarge
+	}
+	return n, err
+}
+
+func (c *gunzipCounter) Write(p []byte) (int, error) {
+	c.pipe.Write(p)
+	return len(p), nil
+}
+
+// finish ends the compressed stream and returns the decompressed size.
+// truncated tells whether the stream was cut short on purpose, by ?target=
+// or ?duration=, in which case an incomplete stream is not an error.
+func (c *gunzipCounter) finish(truncated bool) (int64, error) {
+	c.pipe.Close()
+	<-c.done
+	switch {
+	case c.err == nil, truncated && errors.Is(c.err, io.ErrUnexpectedEOF):
+		return c.n, nil
+	case errors.Is(c.err, errDecompressedTooLarge):
+		return c.n, c.err
+	default:
+		return c.n, errInvalidGzip
+	}
+}
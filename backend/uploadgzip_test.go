@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gzipBody compresses data as a client would before sending it.
+func gzipBody(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestUploadGzip(t *testing.T) {
+	data := bytes.Repeat([]byte("pinguen "), 16*1024)
+	compressed := gzipBody(t, data)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/upload", bytes.NewReader(compressed))
+	req.Header.Set("Content-Encoding", "gzip")
+	uploadHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var response UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.BytesUploaded != int64(len(compressed)) {
+		t.Errorf("expected the %d compressed bytes to be measured, got %d", len(compressed), response.BytesUploaded)
+	}
+	if response.DecompressedBytes != int64(len(data)) || response.ContentEncoding != "gzip" {
+		t.Errorf("expected %d decompressed gzip bytes, got %d with encoding %q", len(data), response.DecompressedBytes, response.ContentEncoding)
+	}
+}
+
+func TestUploadGzipRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   func(t *testing.T) []byte
+		status int
+	}{
+		{"Not Gzip", func(t *testing.T) []byte { return []byte("plain text") }, http.StatusBadRequest},
+		{"Truncated", func(t *testing.T) []byte {
+			compressed := gzipBody(t, []byte(strings.Repeat("a", 4096)))
+			return compressed[:len(compressed)-4]
+		}, http.StatusBadRequest},
+		// A small body must not inflate past the upload limit
+		{"Over Limit When Decompressed", func(t *testing.T) []byte { return gzipBody(t, make([]byte, 64*1024)) }, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(cfg *Config) { cfg.MaxUploadBytes = 32 * 1024 })
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(tt.body(t)))
+			req.Header.Set("Content-Encoding", "gzip")
+			uploadHandler(rr, req)
+			if rr.Code != tt.status {
+				t.Errorf("expected status %d, got %d: %s", tt.status, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestUploadGzipTarget(t *testing.T) {
+	compressed := gzipBody(t, bytes.Repeat([]byte("pinguen "), 16*1024))
+
+	// The target cuts the stream short, which is not a decoding error
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/upload?target=100", bytes.NewReader(compressed))
+	req.Header.Set("Content-Encoding", "gzip")
+	uploadHandler(rr, req)
+
+	var response UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.BytesUploaded != 100 || response.DecompressedBytes <= 0 {
+		t.Errorf("expected 100 bytes measured with some decoded, got %d and %d decompressed", response.BytesUploaded, response.DecompressedBytes)
+	}
+}
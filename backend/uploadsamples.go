@@ -0,0 +1,99 @@
+// Package main provides detailed upload timing for the speed test server.
+// This file contains the ?detailed=true mode of /upload, which samples the
+// progress of the body so clients can tell a steady upload from a bursty
+// one.
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// uploadSampleBytes is the chunk size a detailed upload is read in
+	uploadSampleBytes = 64 * 1024
+	// maxUploadSamples caps the samples in a detailed upload response
+	maxUploadSamples = 1000
+)
+
+// UploadSample is the progress of a detailed upload at the end of a chunk.
+type UploadSample struct {
+	// Bytes is the total received by then
+	Bytes int64 `json:"bytes"`
+	// ElapsedMs is the time since the upload started
+	ElapsedMs float64 `json:"elapsedMs"`
+}
+
+// wantsDetailed reports whether the client asked for per-chunk timing
+// with ?detailed=true.
+func wantsDetailed(r *http.Request) bool {
+	value := r.URL.Query().Get("detailed")
+	return value == "true" || value == "1"
+}
+
+// copySampled reads r to the end in uploadSampleBytes chunks, discarding
+// the data as io.Copy to io.Discard would, and samples the bytes received
+// and the time since start after each chunk, and at the end of the body.
+// Once maxUploadSamples are taken, every other sample is dropped and
+// samples are taken half as often, so a long upload is still covered
+// evenly from start to end.
+//
+// Only io.EOF ends the body. Any other error, such as io.ErrUnexpectedEOF
+// from a client that disconnects partway through its Content-Length, is
+// returned like io.Copy would.
+func copySampled(r io.Reader, start time.Time) (int64, []UploadSample, error) {
+	buffer := make([]byte, uploadSampleBytes)
+	var samples []UploadSample
+	sample := func(total int64) {
+		elapsed := clock().Sub(start)
+		samples = append(samples, UploadSample{Bytes: total, ElapsedMs: float64(elapsed.Microseconds()) / 1000})
+	}
+	thin := func() {
+		kept := samples[:0]
+		for i := 1; i < len(samples); i += 2 {
+			kept = append(kept, samples[i])
+		}
+		samples = kept
+	}
+
+	var total int64
+	// A sample is taken every chunksPerSample chunks, which doubles each
+	// time the samples are thinned
+	chunks, chunksPerSample := 0, 1
+	for {
+		// Fill the chunk by hand rather than with io.ReadFull, which would
+		// turn a truncated body into an io.ErrUnexpectedEOF of its own
+		n := 0
+		var err error
+		for n < len(buffer) && err == nil {
+			var read int
+			read, err = r.Read(buffer[n:])
+			n += read
+		}
+		total += int64(n)
+		if n == len(buffer) {
+			chunks++
+			if chunks%chunksPerSample == 0 && len(samples) == maxUploadSamples {
+				thin()
+				chunksPerSample *= 2
+			}
+			if chunks%chunksPerSample == 0 {
+				sample(total)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			if total > 0 && (len(samples) == 0 || samples[len(samples)-1].Bytes != total) {
+				if len(samples) == maxUploadSamples {
+					thin()
+				}
+				sample(total)
+			}
+			return total, samples, nil
+		}
+		if err != nil {
+			return total, samples, err
+		}
+	}
+}
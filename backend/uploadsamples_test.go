@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestUploadDetailed(t *testing.T) {
+	fake := useFakeClock(t)
+	// 10ms per 64KB, with a short chunk at the end
+	sender := &timedSender{clock: fake, step: 10 * time.Millisecond, readBytes: uploadSampleBytes, reads: 3}
+	body := io.MultiReader(sender, strings.NewReader("tail"))
+	rr := httptest.NewRecorder()
+	uploadHandler(rr, httptest.NewRequest("POST", "/upload?detailed=true", body))
+
+	var response UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	expected := []UploadSample{
+		{Bytes: uploadSampleBytes, ElapsedMs: 10},
+		{Bytes: 2 * uploadSampleBytes, ElapsedMs: 20},
+		{Bytes: 3 * uploadSampleBytes, ElapsedMs: 30},
+		{Bytes: 3*uploadSampleBytes + 4, ElapsedMs: 30},
+	}
+	if len(response.Samples) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, response.Samples)
+	}
+	for i, sample := range response.Samples {
+		if sample != expected[i] {
+			t.Errorf("sample %d: expected %v, got %v", i, expected[i], sample)
+		}
+	}
+	if response.BytesUploaded != 3*uploadSampleBytes+4 {
+		t.Errorf("expected the whole body to be counted, got %d bytes", response.BytesUploaded)
+	}
+}
+
+func TestUploadWithoutDetailed(t *testing.T) {
+	rr := httptest.NewRecorder()
+	uploadHandler(rr, httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("a", 2*uploadSampleBytes))))
+	if strings.Contains(rr.Body.String(), "samples") {
+		t.Errorf("expected no samples without ?detailed, got %s", rr.Body.String())
+	}
+}
+
+func TestUploadDetailedTruncated(t *testing.T) {
+	// A client that disconnects partway through its Content-Length
+	truncated := func() io.Reader {
+		return io.MultiReader(strings.NewReader(strings.Repeat("a", 5000)), iotest.ErrReader(io.ErrUnexpectedEOF))
+	}
+	plain := httptest.NewRecorder()
+	uploadHandler(plain, httptest.NewRequest("POST", "/upload", truncated()))
+	detailed := httptest.NewRecorder()
+	uploadHandler(detailed, httptest.NewRequest("POST", "/upload?detailed=true", truncated()))
+
+	if plain.Code == http.StatusOK || detailed.Code != plain.Code {
+		t.Errorf("expected a truncated detailed upload to fail like a plain one with %d, got %d", plain.Code, detailed.Code)
+	}
+}
+
+func TestCopySampledCap(t *testing.T) {
+	for _, chunks := range []int64{maxUploadSamples, maxUploadSamples + 1, 5*maxUploadSamples + 7} {
+		total := chunks*uploadSampleBytes + 100
+		n, samples, err := copySampled(io.LimitReader(zeroPayload{}, total), clock())
+		if err != nil || n != total {
+			t.Fatalf("%d chunks: expected %d bytes, got %d (%v)", chunks, total, n, err)
+		}
+		if len(samples) > maxUploadSamples {
+			t.Errorf("%d chunks: expected at most %d samples, got %d", chunks, maxUploadSamples, len(samples))
+		}
+		if last := samples[len(samples)-1]; last.Bytes != total {
+			t.Errorf("%d chunks: expected the last sample at the end of the body, got %v", chunks, last)
+		}
+		// The samples stay evenly spread once thinned
+		step := samples[1].Bytes - samples[0].Bytes
+		for i := 1; i < len(samples)-1; i++ {
+			if gap := samples[i].Bytes - samples[i-1].Bytes; gap != step {
+				t.Fatalf("%d chunks: expected samples every %d bytes, got a gap of %d at %d", chunks, step, gap, i)
+			}
+		}
+	}
+}
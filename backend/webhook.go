@@ -0,0 +1,156 @@
+// Package main provides result notifications for the speed test server.
+// This file contains the asynchronous webhook dispatcher that posts each
+// completed measurement to an external system.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookQueueSize is the number of results buffered for delivery;
+	// results arriving while the queue is full are dropped
+	webhookQueueSize = 256
+	// webhookAttempts is the number of times a delivery is tried
+	webhookAttempts = 3
+	// webhookBackoff is the wait before the first retry, doubled after
+	// each failed attempt
+	webhookBackoff = 500 * time.Millisecond
+	// webhookTimeout bounds each delivery attempt
+	webhookTimeout = 5 * time.Second
+)
+
+// WebhookEvent is the JSON body posted to the webhook for each measurement.
+type WebhookEvent struct {
+	Result
+	// Mbps is the measured throughput in megabits per second
+	Mbps float64 `json:"mbps"`
+}
+
+// webhookDispatcher delivers events to a webhook URL from a background
+// goroutine, so a slow or failing receiver never blocks a measurement.
+type webhookDispatcher struct {
+	url     string
+	client  *http.Client
+	backoff time.Duration
+	queue   chan WebhookEvent
+	// done is closed once run has returned, and abandon by close to make
+	// run drop the events still queued
+	done    chan struct{}
+	abandon chan struct{}
+
+	// mu guards closed, so send never writes to the queue once it is
+	// closed, even from a handler still running after shutdown
+	mu     sync.Mutex
+	closed bool
+}
+
+// newWebhookDispatcher starts a dispatcher posting to url.
+func newWebhookDispatcher(url string) *webhookDispatcher {
+	d := &webhookDispatcher{
+		url:     url,
+		client:  &http.Client{Timeout: webhookTimeout},
+		backoff: webhookBackoff,
+		queue:   make(chan WebhookEvent, webhookQueueSize),
+		done:    make(chan struct{}),
+		abandon: make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// webhook receives every recorded result when -webhook-url is set.
+var webhook *webhookDispatcher
+
+// send queues an event for delivery without blocking, dropping it if the
+// queue is full or the dispatcher is closed.
+func (d *webhookDispatcher) send(event WebhookEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		log.Printf("Webhook closed, dropping %s result", event.Kind)
+		return
+	}
+	select {
+	case d.queue <- event:
+	default:
+		log.Printf("Webhook queue full, dropping %s result", event.Kind)
+	}
+}
+
+func (d *webhookDispatcher) run() {
+	defer close(d.done)
+	for event := range d.queue {
+		select {
+		case <-d.abandon:
+		default:
+			d.deliver(event)
+		}
+	}
+}
+
+// deliver posts an event, retrying with exponential backoff, and gives up
+// after webhookAttempts failures.
+func (d *webhookDispatcher) deliver(event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding webhook event: %v", err)
+		return
+	}
+
+	wait := d.backoff
+	for attempt := 1; ; attempt++ {
+		err := d.post(body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("Dropping %s result after %d webhook attempts: %v", event.Kind, attempt, err)
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-d.abandon:
+			return
+		}
+		wait *= 2
+	}
+}
+
+func (d *webhookDispatcher) post(body []byte) error {
+	resp, err := d.client.Post(d.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// close stops accepting events and waits until the queued ones are
+// delivered or ctx is done, in which case the rest are dropped. It reports
+// whether the queue drained, and must be called only once.
+func (d *webhookDispatcher) close(ctx context.Context) bool {
+	d.mu.Lock()
+	d.closed = true
+	close(d.queue)
+	d.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return true
+	case <-ctx.Done():
+		close(d.abandon)
+		return false
+	}
+}
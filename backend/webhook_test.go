@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useWebhook points the package webhook at url for the duration of the
+// test, with retries shortened so failures resolve quickly. The dispatcher
+// is closed afterwards, dropping any events left undelivered.
+func useWebhook(t *testing.T, url string) *webhookDispatcher {
+	d := newWebhookDispatcher(url)
+	d.backoff = 10 * time.Millisecond
+	previous := webhook
+	webhook = d
+	t.Cleanup(func() {
+		webhook = previous
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		d.close(ctx)
+		<-d.done
+	})
+	return d
+}
+
+func TestWebhookDeliversResult(t *testing.T) {
+	var attempts atomic.Int32
+	events := make(chan WebhookEvent, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt to exercise the retry
+		if attempts.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("invalid webhook body: %v", err)
+		}
+		events <- event
+	}))
+	defer receiver.Close()
+	useWebhook(t, receiver.URL)
+
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("a", 4096)))
+	uploadHandler(httptest.NewRecorder(), req)
+
+	select {
+	case event := <-events:
+		if event.Kind != "upload" || event.Bytes != 4096 || event.ClientIP != req.RemoteAddr {
+			t.Errorf("unexpected event %+v", event)
+		}
+		if event.Timestamp.IsZero() {
+			t.Error("expected the event to carry a timestamp")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook did not receive the result")
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("expected delivery on the second attempt, got %d attempts", n)
+	}
+}
+
+func TestWebhookDoesNotBlockRequests(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+	useWebhook(t, receiver.URL)
+
+	start := time.Now()
+	for i := 0; i < webhookQueueSize+10; i++ {
+		uploadHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("a")))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("uploads took %v with a stalled webhook", elapsed)
+	}
+}
+
+func TestWebhookSendAfterClose(t *testing.T) {
+	d := newWebhookDispatcher("http://127.0.0.1:0")
+	if !d.close(context.Background()) {
+		t.Fatal("expected an empty queue to drain")
+	}
+
+	// A handler still running after shutdown must not panic
+	d.send(WebhookEvent{Result: Result{Kind: "upload"}})
+}
@@ -0,0 +1,293 @@
+// Package main provides the WebSocket test channel of the speed test
+// server. This file contains the /ws endpoint, which measures latency,
+// download and upload over a single persistent connection instead of one
+// HTTP request per sample.
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsTimestampBytes is the size of the server timestamp, in nanoseconds
+	// since the Unix epoch as a big-endian int64, that starts every binary
+	// frame the server sends
+	wsTimestampBytes = 8
+	// defaultWSFrameBytes is the download frame size when the client does
+	// not choose one
+	defaultWSFrameBytes = 32 * 1024
+	// wsWriteTimeout bounds each write to a client that stopped reading
+	wsWriteTimeout = 10 * time.Second
+)
+
+// WSCommand is a text message sent by the client over /ws.
+type WSCommand struct {
+	// Type is "ping" or "download"
+	Type string `json:"type"`
+	// ClientTime is echoed back in the pong, for the client to compute
+	// the round-trip time
+	ClientTime int64 `json:"clientTime,omitempty"`
+	// Bytes is the total payload a download streams
+	Bytes int `json:"bytes,omitempty"`
+	// FrameBytes is the size of each binary frame of a download,
+	// including its timestamp
+	FrameBytes int `json:"frameBytes,omitempty"`
+}
+
+// WSMessage is a text message sent by the server over /ws.
+type WSMessage struct {
+	// Type is "pong", "downloadDone", "upload" or "error"
+	Type string `json:"type"`
+	// ServerTime is the server's clock in nanoseconds when it sent the
+	// message
+	ServerTime int64 `json:"serverTime"`
+	ClientTime int64 `json:"clientTime,omitempty"`
+	// Bytes is the payload of a finished download, or of one upload frame
+	Bytes int `json:"bytes,omitempty"`
+	// TotalBytes is the upload payload received on the connection so far
+	TotalBytes int64 `json:"totalBytes,omitempty"`
+	// DurationMs is how long a finished download took to send
+	DurationMs float64 `json:"durationMs,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// wsUpgrader accepts WebSocket handshakes from the CORS allowlist and from
+// non-browser clients, which send no Origin.
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || originAllowed(origin)
+	},
+}
+
+// wsConnections counts the open /ws connections, in total and per client.
+type wsConnections struct {
+	mu           sync.Mutex
+	open         int
+	perClient    map[string]int
+	max          int
+	maxPerClient int // zero leaves clients uncapped
+}
+
+func newWSConnections(max, maxPerClient int) *wsConnections {
+	return &wsConnections{perClient: make(map[string]int), max: max, maxPerClient: maxPerClient}
+}
+
+// acquire takes a connection slot for client, or reports why there is none.
+func (c *wsConnections) acquire(client string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.open >= c.max {
+		return "too many WebSocket connections", false
+	}
+	if c.maxPerClient > 0 && c.perClient[client] >= c.maxPerClient {
+		return "too many WebSocket connections from this client", false
+	}
+	c.open++
+	c.perClient[client]++
+	return "", true
+}
+
+func (c *wsConnections) release(client string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.open--
+	if c.perClient[client]--; c.perClient[client] == 0 {
+		delete(c.perClient, client)
+	}
+}
+
+// wsSession is the state of one /ws connection.
+type wsSession struct {
+	conn    *websocket.Conn
+	client  string
+	limiter requestLimiter
+	load    *loadMonitor
+	budget  *dailyBudget // nil without a daily download cap
+}
+
+// wsHandler upgrades the request to a WebSocket that serves measurements
+// until the client closes it:
+//   - A "ping" command is answered with a "pong" carrying the server time.
+//   - A "download" command streams Bytes of payload in binary frames of
+//     FrameBytes, each starting with the server time, then reports
+//     "downloadDone".
+//   - Each binary frame from the client is counted as upload payload and
+//     acknowledged with an "upload" message carrying the server time.
+//
+// A WebSocket is long-lived, so on top of the limits on the handshake,
+// connections are capped at maxConns at a time and maxConnsPerClient per
+// client, and closed after -idle-timeout without a message. Each download
+// counts as a request against limiter, is refused while load is overloaded
+// or budget is spent, and its bytes are charged to both. Frames are bounded
+// by -max-chunk-bytes and downloads by -max-download-bytes.
+func wsHandler(maxConns, maxConnsPerClient int, limiter requestLimiter, load *loadMonitor, budget *dailyBudget) http.HandlerFunc {
+	conns := newWSConnections(maxConns, maxConnsPerClient)
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := addrHost(clientIP(r))
+		if reason, ok := conns.acquire(client); !ok {
+			w.Header().Set(rejectedByHeader, "ws-conns")
+			writeError(w, http.StatusServiceUnavailable, reason)
+			return
+		}
+		defer conns.release(client)
+
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader has already sent an error response
+			return
+		}
+		defer conn.Close()
+		conn.SetReadLimit(int64(activeConfig.MaxChunkBytes))
+
+		// Close the connection when the server shuts down, which ends the
+		// read loop below
+		closed := make(chan struct{})
+		defer close(closed)
+		go func() {
+			select {
+			case <-shuttingDown(r):
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+					time.Now().Add(time.Second))
+				conn.Close()
+			case <-closed:
+			}
+		}()
+
+		session := &wsSession{conn: conn, client: client, limiter: limiter, load: load, budget: budget}
+		var uploaded int64
+		for {
+			conn.SetReadDeadline(time.Now().Add(activeConfig.IdleTimeout))
+			kind, data, err := conn.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					log.Printf("WebSocket from %s closed: %v", clientIP(r), err)
+				}
+				return
+			}
+
+			if kind == websocket.BinaryMessage {
+				uploaded += int64(len(data))
+				transferTotals.uploadBytes.Add(int64(len(data)))
+				err = writeWSMessage(conn, WSMessage{Type: "upload", Bytes: len(data), TotalBytes: uploaded})
+			} else {
+				var command WSCommand
+				if json.Unmarshal(data, &command) != nil {
+					err = writeWSMessage(conn, WSMessage{Type: "error", Error: "commands must be JSON objects"})
+				} else {
+					err = session.run(command)
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// run carries out a text command from the client.
+func (s *wsSession) run(command WSCommand) error {
+	switch command.Type {
+	case "ping":
+		return writeWSMessage(s.conn, WSMessage{Type: "pong", ClientTime: command.ClientTime})
+	case "download":
+		frameBytes := command.FrameBytes
+		if frameBytes == 0 {
+			frameBytes = defaultWSFrameBytes
+		}
+		if frameBytes <= wsTimestampBytes || frameBytes > activeConfig.MaxChunkBytes {
+			return writeWSMessage(s.conn, WSMessage{Type: "error", Error: fmt.Sprintf("frameBytes must be between %d and %d", wsTimestampBytes+1, activeConfig.MaxChunkBytes)})
+		}
+		if command.Bytes <= 0 || command.Bytes > activeConfig.MaxDownloadBytes {
+			return writeWSMessage(s.conn, WSMessage{Type: "error", Error: fmt.Sprintf("bytes must be between 1 and %d", activeConfig.MaxDownloadBytes)})
+		}
+		if reason, refused := s.refuseDownload(); refused {
+			return writeWSMessage(s.conn, WSMessage{Type: "error", Error: reason})
+		}
+		return streamWSDownload(s.conn, command.Bytes, frameBytes, s.count)
+	default:
+		return writeWSMessage(s.conn, WSMessage{Type: "error", Error: fmt.Sprintf("unknown command %q", command.Type)})
+	}
+}
+
+// refuseDownload applies the limits an HTTP download would meet to a
+// download over the socket, and reports why it is refused, if it is.
+func (s *wsSession) refuseDownload() (string, bool) {
+	if !s.limiter.isAllowed(s.client) {
+		transferTotals.rateLimited.Add(1)
+		rateLimitRejections.record(s.client)
+		return "Rate limit exceeded", true
+	}
+	// The socket itself is already counted as in flight
+	if reason, busy := s.load.overloaded(s.load.inFlight.Load()); busy {
+		return "Server busy: " + reason, true
+	}
+	if s.budget != nil {
+		if _, spent := s.budget.exhausted(); spent {
+			return "Daily download bandwidth cap reached", true
+		}
+	}
+	return "", false
+}
+
+// count charges n bytes sent over the socket to the egress monitor and the
+// daily budget, which never see them as the connection has been hijacked.
+func (s *wsSession) count(n int) {
+	s.load.egress.add(n)
+	if s.budget != nil {
+		s.budget.add(n)
+	}
+}
+
+// streamWSDownload sends size bytes of payload in binary frames of up to
+// frameBytes, each starting with the server time, and reports the time it
+// took in a "downloadDone" message. The bytes of each frame are reported
+// to count.
+func streamWSDownload(conn *websocket.Conn, size, frameBytes int, count func(n int)) error {
+	buffer := downloadBuffers.get(frameBytes)
+	defer downloadBuffers.put(buffer)
+
+	start := clock()
+	for sent := 0; sent < size; {
+		frame := buffer[:min(frameBytes, size-sent+wsTimestampBytes)]
+		if _, err := payloadSource(frame[wsTimestampBytes:]); err != nil {
+			log.Printf("Error generating random data after %d bytes: %v", sent, err)
+			return err
+		}
+		binary.BigEndian.PutUint64(frame, uint64(clock().UnixNano()))
+
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			return err
+		}
+		count(len(frame))
+		payload := len(frame) - wsTimestampBytes
+		sent += payload
+		transferTotals.downloadBytes.Add(int64(payload))
+	}
+
+	elapsed := clock().Sub(start)
+	return writeWSMessage(conn, WSMessage{
+		Type:       "downloadDone",
+		Bytes:      size,
+		DurationMs: float64(elapsed.Microseconds()) / 1000,
+	})
+}
+
+// writeWSMessage sends message as JSON text, stamped with the server time.
+func writeWSMessage(conn *websocket.Conn, message WSMessage) error {
+	message.ServerTime = clock().UnixNano()
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.WriteJSON(message)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startWSServer serves newMux with the given settings until the test ends.
+// Hijacked connections outlive httptest.Server.Close, so the cleanup also
+// waits for every handler to return, before the test's clock and config
+// are restored underneath them.
+func startWSServer(t *testing.T, cfg *Config, limiter requestLimiter, load *loadMonitor) *httptest.Server {
+	t.Helper()
+	handlers := &inFlight{}
+	server := httptest.NewServer(handlers.track(newMux(cfg, limiter, load).ServeHTTP))
+	t.Cleanup(func() {
+		server.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !handlers.wait(ctx) {
+			t.Error("expected the WebSocket handlers to return once their connections closed")
+		}
+	})
+	return server
+}
+
+// dialWS opens a WebSocket to /ws on the test server.
+func dialWS(t *testing.T, server *httptest.Server) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readWSMessage reads the next text message from the server.
+func readWSMessage(t *testing.T, conn *websocket.Conn) WSMessage {
+	t.Helper()
+	var message WSMessage
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestWebSocketPing(t *testing.T) {
+	server := startWSServer(t, defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	conn := dialWS(t, server)
+
+	before := time.Now().UnixNano()
+	if err := conn.WriteJSON(WSCommand{Type: "ping", ClientTime: 42}); err != nil {
+		t.Fatal(err)
+	}
+	pong := readWSMessage(t, conn)
+	if pong.Type != "pong" || pong.ClientTime != 42 {
+		t.Errorf("expected a pong echoing the client time, got %+v", pong)
+	}
+	if pong.ServerTime < before {
+		t.Errorf("expected the server time in the pong, got %d", pong.ServerTime)
+	}
+}
+
+func TestWebSocketDownload(t *testing.T) {
+	server := startWSServer(t, defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	conn := dialWS(t, server)
+
+	const size, frameBytes = 10000, 1024
+	before := uint64(time.Now().UnixNano())
+	if err := conn.WriteJSON(WSCommand{Type: "download", Bytes: size, FrameBytes: frameBytes}); err != nil {
+		t.Fatal(err)
+	}
+
+	received := 0
+	for received < size {
+		kind, frame, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != websocket.BinaryMessage || len(frame) > frameBytes || len(frame) <= wsTimestampBytes {
+			t.Fatalf("expected binary frames of at most %d bytes, got a %d-byte frame of type %d", frameBytes, len(frame), kind)
+		}
+		if stamp := binary.BigEndian.Uint64(frame); stamp < before {
+			t.Errorf("expected each frame to start with the server time, got %d", stamp)
+		}
+		received += len(frame) - wsTimestampBytes
+	}
+	if done := readWSMessage(t, conn); done.Type != "downloadDone" || done.Bytes != size || received != size {
+		t.Errorf("expected %d payload bytes and a downloadDone, got %d and %+v", size, received, done)
+	}
+
+	if err := conn.WriteJSON(WSCommand{Type: "download", Bytes: size, FrameBytes: wsTimestampBytes}); err != nil {
+		t.Fatal(err)
+	}
+	if message := readWSMessage(t, conn); message.Type != "error" {
+		t.Errorf("expected an error for frames with no room for payload, got %+v", message)
+	}
+}
+
+func TestWebSocketUpload(t *testing.T) {
+	server := startWSServer(t, defaultConfig(), newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	conn := dialWS(t, server)
+
+	for i, expected := range []int64{2048, 4096} {
+		if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, 2048)); err != nil {
+			t.Fatal(err)
+		}
+		ack := readWSMessage(t, conn)
+		if ack.Type != "upload" || ack.Bytes != 2048 || ack.TotalBytes != expected {
+			t.Errorf("frame %d: expected an upload ack totalling %d bytes, got %+v", i, expected, ack)
+		}
+	}
+}
+
+func TestWebSocketConnectionCap(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxWSConns = 1
+	server := startWSServer(t, cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	first := dialWS(t, server)
+	_, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err == nil || response == nil || response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected a second connection to be refused with %d, got %v", http.StatusServiceUnavailable, err)
+	}
+	if got := response.Header.Get(rejectedByHeader); got != "ws-conns" {
+		t.Errorf("expected %s ws-conns, got %q", rejectedByHeader, got)
+	}
+
+	first.Close()
+	// The slot is released once the server notices the close
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a connection to be accepted after the first closed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketConnectionCapPerClient(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxWSConnsPerClient = 1
+	server := startWSServer(t, cfg, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	dialWS(t, server)
+	_, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err == nil || response == nil || response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected a second connection from the client to be refused with %d, got %v", http.StatusServiceUnavailable, err)
+	}
+	if got := response.Header.Get(rejectedByHeader); got != "ws-conns" {
+		t.Errorf("expected %s ws-conns, got %q", rejectedByHeader, got)
+	}
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.IdleTimeout = 50 * time.Millisecond })
+	server := startWSServer(t, activeConfig, newRateLimiter(defaultRateLimit, defaultRateWindow), newLoadMonitor(0, 0, 0))
+	conn := dialWS(t, server)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the server to close an idle connection, got %v", err)
+	}
+}
+
+func TestWebSocketHandshakeLimits(t *testing.T) {
+	// One request's worth of rate limit is spent on the first handshake
+	server := startWSServer(t, defaultConfig(), newRateLimiter(1, defaultRateWindow), newLoadMonitor(0, 0, 0))
+
+	dialWS(t, server)
+	_, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err == nil || response == nil || response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a second handshake to be rate limited with %d, got %v", http.StatusTooManyRequests, err)
+	}
+}
+
+func TestWebSocketDownloadLimits(t *testing.T) {
+	fake := useFakeClock(t)
+	const size = 1000
+	cfg := defaultConfig()
+	// Room for one download, timestamps included
+	cfg.DailyDownloadCapGB = 1e-6
+	load := newLoadMonitor(0, 0, 0)
+	// The handshake and two downloads
+	server := startWSServer(t, cfg, newRateLimiter(3, defaultRateWindow), load)
+	conn := dialWS(t, server)
+
+	download := func() WSMessage {
+		t.Helper()
+		if err := conn.WriteJSON(WSCommand{Type: "download", Bytes: size}); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			kind, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind == websocket.TextMessage {
+				var message WSMessage
+				if err := json.Unmarshal(data, &message); err != nil {
+					t.Fatal(err)
+				}
+				return message
+			}
+		}
+	}
+
+	if done := download(); done.Type != "downloadDone" {
+		t.Fatalf("expected the first download to finish, got %+v", done)
+	}
+	fake.advance(time.Second)
+	if got := load.egress.rate(); got != size+wsTimestampBytes {
+		t.Errorf("expected %d bytes charged to egress, got %d", size+wsTimestampBytes, got)
+	}
+	if refused := download(); refused.Type != "error" || !strings.Contains(refused.Error, "cap") {
+		t.Errorf("expected a download past the daily cap to be refused, got %+v", refused)
+	}
+	if refused := download(); refused.Type != "error" || !strings.Contains(refused.Error, "Rate limit") {
+		t.Errorf("expected a download past the rate limit to be refused, got %+v", refused)
+	}
+}